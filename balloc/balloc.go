@@ -3,7 +3,12 @@ package balloc
 import (
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -25,6 +30,11 @@ type MemoryManager interface {
 	GetPtr(pos uint64) unsafe.Pointer
 	GetOffset(p unsafe.Pointer) uint64
 
+	// AllocateNode and DeallocateNode manage zeroed memory for nodes, which
+	// is counted apart from the rest in the statistics
+	AllocateNode(size uint64) (uint64, error)
+	DeallocateNode(pos, size uint64) error
+
 	GetUsed() uint64
 	GetFree() uint64
 
@@ -34,28 +44,127 @@ type MemoryManager interface {
 
 // BufferAllocator allocates memory in a preallocated buffer
 type BufferAllocator struct {
-	bufferPtr  unsafe.Pointer
+	bufferPtr unsafe.Pointer
+	// bufferSize grows under headLock while the buffer is in use, so it is
+	// read atomically outside of it
 	bufferSize uint64
 	header     *header
 	headerLock uintptr
 
+	caches []allocCache
+	// cachePool hands out the allocation caches goroutines last used, see
+	// getCache
+	cachePool sync.Pool
+	nextCache uint32
+
+	// Chunks added to the free lists since they were last merged, and the
+	// chunks the merge left, see mergeFree. Guarded by headLock.
+	unmerged int
+	merged   int
+
 	bufferMux sync.RWMutex
 }
 
+// cacheSize is the number of chunks an allocation cache keeps per size
+// class, half of them are returned to the free lists when it is full
+const cacheSize = 64
+
+// cacheBatch is the number of chunks moved from the free lists to an empty
+// allocation cache at once
+const cacheBatch = 16
+
+// numCacheShards is the number of allocation caches, see getCache for the
+// one a goroutine uses
+const numCacheShards = 8
+
+// allocCache is an allocation cache, which keeps freed chunks of the size
+// classes apart from the free lists, so that concurrent allocations do not
+// contend on the header lock. Its chunks are linked like those of the free
+// lists, from the Cached heads of the header, so they are not lost when the
+// process ends without a Flush.
+type allocCache struct {
+	lock  uintptr
+	shard int
+
+	// number of chunks in the lists of the shard
+	counts [numSizeClasses]int
+
+	_ [64]byte // keep the locks of the caches in separate cache lines
+}
+
 const magic uint32 = 0xca01af01
 
+// headerVersion is the version of new allocator headers. Headers of older
+// versions are only used with the single free list of FreePage, and without
+// allocation caches, until UpgradeHeader moves them and their free chunks to
+// the current layout.
+const headerVersion uint16 = 5
+
+// listsVersion is the first version whose free lists and statistics are
+// those of the current one, which ReadOnlyAllocator can read
+const listsVersion uint16 = 3
+
+// numSizeClasses is the number of size classes. Class i holds free chunks of
+// exactly i+1 pages.
+const numSizeClasses = 8
+
+// numBuckets is the number of free lists of chunks larger than the size
+// classes. Bucket i holds chunks of up to numSizeClasses<<(i+1) pages and the
+// last one all the larger chunks.
+const numBuckets = 16
+
+// header is stored in the buffer as laid out on little-endian 64-bit hosts,
+// with its padding spelled out
 type header struct {
 	magic         uint32
 	BufferStart   uint32
 	PageSize      uint16
+	Version       uint16
+	_             uint32
 	DataWatermark uint64
 	FreePage      uint64
 	TotalUsed     uint64
+
+	// Chunks below LegacyLimit were allocated with LegacyPageSize pages
+	// before a page size change, see ChangePageSize.
+	LegacyLimit    uint64
+	LegacyPageSize uint16
+	_              [6]byte
+
+	// Heads of the free lists of the size classes and of the buckets
+	Classes [numSizeClasses]uint64
+	Buckets [numBuckets]uint64
+
+	// Space of the chunks holding nodes, part of TotalUsed
+	NodesUsed uint64
+
+	// Heads of the chunks kept by the allocation caches, by shard and size
+	// class
+	Cached [numCacheShards][numSizeClasses]uint64
+
+	// Number of nodes allocated less those freed
+	Nodes uint64
+}
+
+// HeaderSize is the space the allocator header occupies in the buffer
+var HeaderSize = uint64(unsafe.Sizeof(header{}))
+
+// LegacyHeaderSize is the space a version 0 allocator header occupies
+var LegacyHeaderSize = uint64(unsafe.Offsetof(header{}.Classes))
+
+// headerSizes are the sizes of the headers of the older versions
+var headerSizes = []uint64{
+	LegacyHeaderSize,
+	uint64(unsafe.Offsetof(header{}.Buckets)),
+	uint64(unsafe.Offsetof(header{}.NodesUsed)),
+	uint64(unsafe.Offsetof(header{}.Cached)),
+	uint64(unsafe.Offsetof(header{}.Nodes)),
 }
 
 type chunk struct {
 	nextFree uint64
 	size     uint32
+	_        uint32
 }
 
 var chunkSize = uint64(unsafe.Sizeof(chunk{}))
@@ -66,7 +175,8 @@ type allocPreable struct {
 
 var allocPreableSize uint64 = uint64(unsafe.Sizeof(allocPreable{}))
 
-// NewBufferAllocator created a new buffer allocator
+// NewBufferAllocator created a new buffer allocator. The page size is only
+// used when the buffer is initialized, existing buffers keep their own.
 func NewBufferAllocator(bufPtr unsafe.Pointer, bufSize uint64, firstFree uint64, pageSize uint16) (*BufferAllocator, error) {
 	if bufSize&alignmentBytesMinusOne != 0 {
 		return nil, ErrInvalidSize
@@ -75,27 +185,103 @@ func NewBufferAllocator(bufPtr unsafe.Pointer, bufSize uint64, firstFree uint64,
 	buffer := &BufferAllocator{
 		bufferPtr:  bufPtr,
 		bufferSize: bufSize,
+		caches:     make([]allocCache, numCacheShards),
+	}
+	for i := range buffer.caches {
+		buffer.caches[i].shard = i
 	}
 
 	firstFree = alignSize(firstFree)
 
 	buffer.header = (*header)(unsafe.Pointer(uintptr(bufPtr) + uintptr(firstFree)))
-	buffer.SetPageSize(pageSize)
 
 	if buffer.header.magic != magic {
+		buffer.SetPageSize(pageSize)
+
 		dataStart := alignSize(firstFree + uint64(unsafe.Sizeof(*buffer.header)))
 		dataStart = buffer.GetPageOffset(dataStart + uint64(pageSize) - 1)
 
 		buffer.header.magic = magic
+		buffer.header.Version = headerVersion
 		buffer.header.BufferStart = uint32(dataStart)
 		buffer.header.DataWatermark = dataStart
 		buffer.header.FreePage = 0
 		buffer.header.TotalUsed = 0
+		buffer.header.LegacyLimit = 0
+		buffer.header.LegacyPageSize = 0
+		buffer.header.Classes = [numSizeClasses]uint64{}
+		buffer.header.Buckets = [numBuckets]uint64{}
+		buffer.header.NodesUsed = 0
+		buffer.header.Cached = [numCacheShards][numSizeClasses]uint64{}
+		buffer.header.Nodes = 0
+	}
+
+	if buffer.header.Version >= headerVersion {
+		for i := range buffer.caches {
+			c := &buffer.caches[i]
+			for k, p := range buffer.header.Cached[i] {
+				for ; p != 0; p = buffer.getChunk(p).nextFree {
+					c.counts[k]++
+				}
+			}
+		}
 	}
 
 	return buffer, nil
 }
 
+// HeaderUpgrade returns the version of the allocator header at firstFree
+// and the version UpgradeHeader converts it to, the same when it needs no
+// upgrade, without changing the buffer
+func HeaderUpgrade(bufPtr unsafe.Pointer, firstFree uint64) (from, to uint16) {
+	h := (*header)(unsafe.Pointer(uintptr(bufPtr) + uintptr(alignSize(firstFree))))
+	if h.magic != magic || h.Version >= headerVersion {
+		return h.Version, h.Version
+	}
+	return h.Version, headerVersion
+}
+
+// UpgradeHeader moves a header of an older version, which has no room for
+// the current free lists, to an allocation of its own and returns its
+// offset. Current headers are left in place.
+func (b *BufferAllocator) UpgradeHeader() (uint64, error) {
+	if b.header.Version == headerVersion {
+		return b.GetOffset(unsafe.Pointer(b.header)), nil
+	}
+	if int(b.header.Version) >= len(headerSizes) {
+		return 0, fmt.Errorf("Unsupported allocator header version %d", b.header.Version)
+	}
+
+	p, err := b.Allocate(HeaderSize, true)
+	if err != nil {
+		return 0, err
+	}
+
+	b.headLock()
+	defer b.headUnlock()
+
+	old := b.header
+	h := (*header)(b.GetPtr(p))
+	size := headerSizes[old.Version]
+	copy((*[maxBufferSize]byte)(unsafe.Pointer(h))[:size], (*[maxBufferSize]byte)(unsafe.Pointer(old))[:size])
+	h.Version = headerVersion
+	h.FreePage = 0
+	b.header = h
+
+	// Older headers miss some statistics of the nodes, so they are all
+	// counted again, see CountNode
+	h.NodesUsed = 0
+
+	for f := old.FreePage; f != 0; {
+		c := b.getChunk(f)
+		next := c.nextFree
+		b.insertChunk(f, uint64(c.size))
+		f = next
+	}
+
+	return p, nil
+}
+
 func (b *BufferAllocator) GetHeader() *header {
 	return b.header
 }
@@ -104,6 +290,187 @@ func (b *BufferAllocator) SetPageSize(s uint16) {
 	b.header.PageSize = s
 }
 
+// ChangePageSize switches the buffer to a page size that divides the current
+// one. Chunks allocated up to now keep being rounded to the old page size so
+// that they are freed with the size they were allocated with.
+func (b *BufferAllocator) ChangePageSize(pageSize uint16) error {
+	b.Flush()
+
+	b.headLock()
+	defer b.headUnlock()
+
+	oldSize := b.header.PageSize
+	if pageSize == oldSize {
+		return nil
+	}
+	if uint64(pageSize) < chunkSize || oldSize%pageSize != 0 || b.header.LegacyLimit != 0 {
+		return ErrInvalidSize
+	}
+
+	ratio := uint32(oldSize / pageSize)
+	if b.header.Version < listsVersion {
+		for p := b.header.FreePage; p != 0; {
+			c := b.getChunk(p)
+			c.size *= ratio
+			p = c.nextFree
+		}
+	} else {
+		var free []uint64
+		for _, lists := range [][]uint64{b.header.Classes[:], b.header.Buckets[:]} {
+			for _, p := range lists {
+				for ; p != 0; p = b.getChunk(p).nextFree {
+					free = append(free, p)
+				}
+			}
+		}
+		b.header.Classes = [numSizeClasses]uint64{}
+		b.header.Buckets = [numBuckets]uint64{}
+		b.header.PageSize = pageSize
+		for _, p := range free {
+			b.insertChunk(p, uint64(b.getChunk(p).size*ratio))
+		}
+	}
+
+	b.header.LegacyLimit = b.header.DataWatermark
+	b.header.LegacyPageSize = oldSize
+	b.header.PageSize = pageSize
+
+	return nil
+}
+
+// freeList returns the free list of chunks of the given number of pages
+func (b *BufferAllocator) freeList(pages uint64) *uint64 {
+	if pages <= numSizeClasses {
+		return &b.header.Classes[pages-1]
+	}
+	return &b.header.Buckets[bucketFor(pages)]
+}
+
+func bucketFor(pages uint64) int {
+	i := bits.Len64((pages-1)/numSizeClasses) - 1
+	if i < 0 {
+		return 0
+	}
+	if i >= numBuckets {
+		return numBuckets - 1
+	}
+	return i
+}
+
+// insertChunk adds a free chunk to its free list, or lowers the watermark
+// when the chunk ends at it
+func (b *BufferAllocator) insertChunk(offset, pages uint64) {
+	psize := uint64(b.header.PageSize)
+
+	if offset+pages*psize == b.header.DataWatermark {
+		atomic.StoreUint64(&b.header.DataWatermark, offset)
+		if b.header.LegacyLimit > offset {
+			b.header.LegacyLimit = offset
+		}
+		return
+	}
+
+	l := b.freeList(pages)
+	c := b.getChunk(offset)
+	c.nextFree = *l
+	c.size = uint32(pages)
+	*l = offset
+}
+
+// takeChunk removes a free chunk able to hold size bytes from the free
+// lists, returning its unneeded pages to them. Exact size classes are tried
+// first, then the smallest chunk of the bucket of the size and the first
+// chunk of the larger ones. It returns 0 when there is no such chunk.
+func (b *BufferAllocator) takeChunk(size uint64) (uint64, uint64) {
+	psize := uint64(b.header.PageSize)
+	pages := (size + psize - 1) / psize
+
+	take := func(l *uint64, prev, p, have uint64) (uint64, uint64) {
+		next := b.getChunk(p).nextFree
+		if prev == 0 {
+			*l = next
+		} else {
+			b.getChunk(prev).nextFree = next
+		}
+
+		need := b.pagesFor(p, size)
+		if have > need {
+			b.insertChunk(p+need*psize, have-need)
+		}
+		return p, need
+	}
+
+	for i := pages; i <= numSizeClasses; i++ {
+		l := &b.header.Classes[i-1]
+		if *l != 0 && b.pagesFor(*l, size) <= i {
+			return take(l, 0, *l, i)
+		}
+	}
+
+	first := 0
+	if pages > numSizeClasses {
+		first = bucketFor(pages)
+	}
+	for i := first; i < numBuckets; i++ {
+		l := &b.header.Buckets[i]
+
+		var best, bestPrev, bestSize uint64
+		for prev, p := uint64(0), *l; p != 0; prev, p = p, b.getChunk(p).nextFree {
+			have := uint64(b.getChunk(p).size)
+			if have < b.pagesFor(p, size) || (best != 0 && have >= bestSize) {
+				continue
+			}
+			best, bestPrev, bestSize = p, prev, have
+			if have == pages || i > first {
+				break
+			}
+		}
+
+		if best != 0 {
+			return take(l, bestPrev, best, bestSize)
+		}
+	}
+
+	return 0, 0
+}
+
+// takeLegacyChunk takes the first chunk of the free list of older headers if
+// it can hold size bytes. It returns 0 otherwise.
+func (b *BufferAllocator) takeLegacyChunk(size uint64) (uint64, uint64) {
+	psize := uint64(b.header.PageSize)
+
+	p := b.header.FreePage
+	if p == 0 {
+		return 0, 0
+	}
+
+	chunk := b.getChunk(p)
+	pagesNeeded := b.pagesFor(p, size)
+	if chunk.size == uint32(pagesNeeded) {
+		b.header.FreePage = chunk.nextFree
+	} else if chunk.size > uint32(pagesNeeded) {
+		newChunk := b.getChunk(p + pagesNeeded*psize)
+		newChunk.nextFree = chunk.nextFree
+		newChunk.size = chunk.size - uint32(pagesNeeded)
+		b.header.FreePage = p + pagesNeeded*psize
+	} else {
+		return 0, 0
+	}
+
+	return p, pagesNeeded
+}
+
+// pagesFor returns the number of pages an allocation of size bytes at
+// offset occupies
+func (b *BufferAllocator) pagesFor(offset, size uint64) uint64 {
+	psize := uint64(b.header.PageSize)
+	if offset < b.header.LegacyLimit {
+		lpsize := uint64(b.header.LegacyPageSize)
+		size = (size + lpsize - 1) / lpsize * lpsize
+	}
+	return (size + psize - 1) / psize
+}
+
 func (b *BufferAllocator) GetPageOffset(offset uint64) uint64 {
 	psize := uint64(b.header.PageSize)
 	return (offset / psize) * psize
@@ -135,6 +502,278 @@ func (b *BufferAllocator) headUnlock() {
 	atomic.StoreUintptr(&b.headerLock, 0)
 }
 
+// getCache locks and returns an allocation cache. Goroutines start from the
+// cache last put back on their P, kept by cachePool, so that each P tends to
+// use the same one, and take the next one that is not locked. Caches the pool
+// dropped are handed out again in turn.
+func (b *BufferAllocator) getCache() *allocCache {
+	var i int
+	if c, ok := b.cachePool.Get().(*allocCache); ok {
+		i = c.shard
+	} else {
+		i = int(atomic.AddUint32(&b.nextCache, 1) % uint32(len(b.caches)))
+	}
+
+	for {
+		for j := range b.caches {
+			c := &b.caches[(i+j)%len(b.caches)]
+			if atomic.CompareAndSwapUintptr(&c.lock, 0, 1) {
+				return c
+			}
+		}
+		runtime.Gosched()
+	}
+}
+
+// putCache unlocks a cache of getCache and puts it back in cachePool
+func (b *BufferAllocator) putCache(c *allocCache) {
+	c.unlock()
+	b.cachePool.Put(c)
+}
+
+func (c *allocCache) unlock() {
+	atomic.StoreUintptr(&c.lock, 0)
+}
+
+// cachedPages returns the pages of the size class of size bytes, or 0 when
+// chunks of this size are not kept in the allocation caches
+func (b *BufferAllocator) cachedPages(size uint64) uint64 {
+	if b.header.Version < headerVersion {
+		return 0
+	}
+	psize := uint64(b.header.PageSize)
+	if pages := (size + psize - 1) / psize; pages <= numSizeClasses {
+		return pages
+	}
+	return 0
+}
+
+// cachedChunk takes a chunk of a size class from an allocation cache,
+// refilling the cache from the free list of the class when it is empty. It
+// returns 0 when there is no such chunk.
+func (b *BufferAllocator) cachedChunk(size uint64) (uint64, uint64) {
+	pages := b.cachedPages(size)
+	if pages == 0 {
+		return 0, 0
+	}
+
+	c := b.getCache()
+	defer b.putCache(c)
+
+	l := &b.header.Cached[c.shard][pages-1]
+	if *l == 0 {
+		// The chunks are unlinked from the free list before they are linked
+		// from the cache, so that no chunk is ever listed twice
+		b.headLock()
+		head := &b.header.Classes[pages-1]
+		first, last := *head, uint64(0)
+		n := 0
+		for ; n < cacheBatch && *head != 0 && *head >= b.header.LegacyLimit; n++ {
+			last = *head
+			*head = b.getChunk(last).nextFree
+		}
+		b.headUnlock()
+
+		if n == 0 {
+			if p := b.stealChunk(c, pages); p != 0 {
+				return p, pages
+			}
+			return 0, 0
+		}
+		b.getChunk(last).nextFree = 0
+		*l = first
+		c.counts[pages-1] = n
+	}
+
+	p := *l
+	*l = b.getChunk(p).nextFree
+	c.counts[pages-1]--
+
+	return p, pages
+}
+
+// stealChunk takes a chunk of a size class from an allocation cache other
+// than c, as the goroutines freeing chunks are not always the ones that get
+// the same cache when allocating. It returns 0 when the caches it can lock
+// have none.
+func (b *BufferAllocator) stealChunk(c *allocCache, pages uint64) uint64 {
+	for i := range b.caches {
+		o := &b.caches[i]
+		if o == c || !atomic.CompareAndSwapUintptr(&o.lock, 0, 1) {
+			continue
+		}
+		l := &b.header.Cached[o.shard][pages-1]
+		p := *l
+		if p != 0 {
+			*l = b.getChunk(p).nextFree
+			o.counts[pages-1]--
+		}
+		o.unlock()
+		if p != 0 {
+			return p
+		}
+	}
+	return 0
+}
+
+// cacheChunk keeps a freed chunk in an allocation cache and returns its
+// pages, or 0 when it is not cached. Chunks allocated with the legacy page
+// size are not. The older half of a full cache goes back to the free list.
+func (b *BufferAllocator) cacheChunk(offset, size uint64) uint64 {
+	pages := b.cachedPages(size)
+	if pages == 0 || offset < b.header.LegacyLimit {
+		return 0
+	}
+
+	c := b.getCache()
+	defer b.putCache(c)
+
+	l := &b.header.Cached[c.shard][pages-1]
+	ch := b.getChunk(offset)
+	ch.nextFree = *l
+	ch.size = uint32(pages)
+	*l = offset
+	c.counts[pages-1]++
+
+	if c.counts[pages-1] > cacheSize {
+		last := *l
+		for i := 1; i < cacheSize/2; i++ {
+			last = b.getChunk(last).nextFree
+		}
+		rest := b.getChunk(last).nextFree
+		b.getChunk(last).nextFree = 0
+		c.counts[pages-1] = cacheSize / 2
+
+		b.headLock()
+		b.insertChunks(rest, pages)
+		b.headUnlock()
+	}
+
+	return pages
+}
+
+// insertChunks adds the free chunks of pages linked from p to the free
+// lists
+func (b *BufferAllocator) insertChunks(p, pages uint64) {
+	for p != 0 {
+		next := b.getChunk(p).nextFree
+		b.insertChunk(p, pages)
+		b.unmerged++
+		p = next
+	}
+}
+
+// mergeFree merges the adjacent chunks of the free lists, lowering the
+// watermark when they end at it, and tells if any chunk was added since the
+// last merge. Sorting all the chunks is only worth it once a quarter of the
+// chunks left by the last merge have been freed since. Chunks kept by the
+// allocation caches are not merged until they go back to the free lists.
+func (b *BufferAllocator) mergeFree() bool {
+	if b.unmerged == 0 || b.unmerged < b.merged/4 {
+		return false
+	}
+	psize := uint64(b.header.PageSize)
+
+	var free []freeRun
+	for _, l := range b.freeListHeads() {
+		for p := *l; p != 0; p = b.getChunk(p).nextFree {
+			free = append(free, freeRun{p, uint64(b.getChunk(p).size) * psize})
+		}
+		*l = 0
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i].offset < free[j].offset })
+
+	runs := free[:0]
+	for _, r := range free {
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if last.offset+last.size == r.offset && last.size+r.size <= math.MaxUint32*psize {
+				last.size += r.size
+				continue
+			}
+		}
+		runs = append(runs, r)
+	}
+
+	// The lowest chunks end up first in the lists
+	for i := len(runs) - 1; i >= 0; i-- {
+		b.insertChunk(runs[i].offset, runs[i].size/psize)
+	}
+
+	b.unmerged = 0
+	b.merged = len(runs)
+	return true
+}
+
+// freeListHeads returns the heads of the free lists of the header
+func (b *BufferAllocator) freeListHeads() []*uint64 {
+	heads := make([]*uint64, 0, numSizeClasses+numBuckets)
+	for i := range b.header.Classes {
+		heads = append(heads, &b.header.Classes[i])
+	}
+	for i := range b.header.Buckets {
+		heads = append(heads, &b.header.Buckets[i])
+	}
+	return heads
+}
+
+// Flush returns the chunks of the allocation caches to the free lists of the
+// header, for the free lists to describe all the free space, as when the
+// page size changes
+func (b *BufferAllocator) Flush() {
+	for i := range b.caches {
+		c := &b.caches[i]
+		for !atomic.CompareAndSwapUintptr(&c.lock, 0, 1) {
+			runtime.Gosched()
+		}
+
+		for k, n := range c.counts {
+			if n == 0 {
+				continue
+			}
+			l := &b.header.Cached[c.shard][k]
+			p := *l
+			*l = 0
+			b.headLock()
+			b.insertChunks(p, uint64(k+1))
+			b.headUnlock()
+			c.counts[k] = 0
+		}
+
+		c.unlock()
+	}
+}
+
+// lockCaches locks all the allocation caches, to read their lists
+func (b *BufferAllocator) lockCaches() {
+	for i := range b.caches {
+		for !atomic.CompareAndSwapUintptr(&b.caches[i].lock, 0, 1) {
+			runtime.Gosched()
+		}
+	}
+}
+
+func (b *BufferAllocator) unlockCaches() {
+	for i := range b.caches {
+		b.caches[i].unlock()
+	}
+}
+
+// freeLists returns the heads of the lists of free chunks, those of the
+// allocation caches included
+func (b *BufferAllocator) freeLists() []uint64 {
+	if b.header.Version < listsVersion {
+		return []uint64{b.header.FreePage}
+	}
+	lists := append(b.header.Classes[:numSizeClasses:numSizeClasses], b.header.Buckets[:]...)
+	if b.header.Version >= headerVersion {
+		for i := range b.header.Cached {
+			lists = append(lists, b.header.Cached[i][:]...)
+		}
+	}
+	return lists
+}
+
 func (b *BufferAllocator) SetBuffer(bufPtr unsafe.Pointer, bufSize uint64, firstFree uint64) {
 	firstFree = alignSize(firstFree + uint64(uintptr(bufPtr)))
 
@@ -143,6 +782,17 @@ func (b *BufferAllocator) SetBuffer(bufPtr unsafe.Pointer, bufSize uint64, first
 	b.header = (*header)(unsafe.Pointer(uintptr(firstFree)))
 }
 
+// Extend grows the buffer to bufSize bytes without moving it, for buffers
+// mapped with room past their end. Unlike SetBuffer it is safe while the
+// buffer is in use.
+func (b *BufferAllocator) Extend(bufSize uint64) {
+	b.headLock()
+	if bufSize > b.bufferSize {
+		atomic.StoreUint64(&b.bufferSize, bufSize)
+	}
+	b.headUnlock()
+}
+
 func (b *BufferAllocator) GetFree() uint64 {
 	b.headLock()
 	defer b.headUnlock()
@@ -154,7 +804,7 @@ func (b *BufferAllocator) GetUsed() uint64 {
 }
 
 func (b *BufferAllocator) GetCapacity() uint64 {
-	return b.bufferSize
+	return atomic.LoadUint64(&b.bufferSize)
 }
 
 func (b *BufferAllocator) GetPtr(pos uint64) unsafe.Pointer {
@@ -185,7 +835,10 @@ func (b *BufferAllocator) mergeChunks(offset uint64) uint64 {
 		curChunk := b.getChunk(curOff)
 
 		if curOff+uint64(curChunk.size)*psize == b.header.DataWatermark {
-			b.header.DataWatermark -= uint64(curChunk.size) * psize
+			atomic.StoreUint64(&b.header.DataWatermark, curOff)
+			if b.header.LegacyLimit > b.header.DataWatermark {
+				b.header.LegacyLimit = b.header.DataWatermark
+			}
 			curOff = curChunk.nextFree
 			continue
 		}
@@ -214,42 +867,59 @@ func (b *BufferAllocator) mergeChunks(offset uint64) uint64 {
 
 // Allocate a new buffer of specific size
 func (b *BufferAllocator) Allocate(size uint64, zero bool) (uint64, error) {
+	p, _, err := b.alloc(size, zero)
+	return p, err
+}
+
+// AllocateNode allocates zeroed memory for a node
+func (b *BufferAllocator) AllocateNode(size uint64) (uint64, error) {
+	p, pages, err := b.alloc(size, true)
+	if err == nil {
+		atomic.AddUint64(&b.header.NodesUsed, pages*uint64(b.header.PageSize))
+		atomic.AddUint64(&b.header.Nodes, 1)
+	}
+	return p, err
+}
+
+// NodeCount returns the number of nodes allocated less those freed, which
+// headers before version 5 do not keep
+func (b *BufferAllocator) NodeCount() int64 {
+	if b.header.Version < headerVersion {
+		return 0
+	}
+	return int64(atomic.LoadUint64(&b.header.Nodes))
+}
+
+// CountNode adds an existing node to the statistics of the nodes, to
+// rebuild those of buffers from before they were kept
+func (b *BufferAllocator) CountNode(pos, size uint64) {
+	atomic.AddUint64(&b.header.NodesUsed, b.NodeSpace(pos, size))
+	atomic.AddUint64(&b.header.Nodes, 1)
+}
+
+// NodeSpace returns the space a node of size bytes at pos adds to NodesUsed
+func (b *BufferAllocator) NodeSpace(pos, size uint64) uint64 {
+	return b.pagesFor(pos, alignSize(size)) * uint64(b.header.PageSize)
+}
+
+// alloc allocates size bytes and returns their offset and pages
+func (b *BufferAllocator) alloc(size uint64, zero bool) (uint64, uint64, error) {
 	if size == 0 {
-		return 0, ErrInvalidSize
+		return 0, 0, ErrInvalidSize
 	}
 
 	// Ensure alignement
 	size = alignSize(size)
 	psize := uint64(b.header.PageSize)
 
-	pagesNeeded := (size + psize - 1) / psize
-
-	b.headLock()
-
-	var p uint64
-	chunk := b.getChunk(b.header.FreePage)
-	if b.header.FreePage != 0 && chunk.size == uint32(pagesNeeded) {
-		p = b.header.FreePage
-		b.header.FreePage = chunk.nextFree
-		//println("allocate page", p, "new free", *l)
-	} else if b.header.FreePage != 0 && chunk.size > uint32(pagesNeeded) {
-		p = b.header.FreePage
-		newChunk := b.getChunk(p + pagesNeeded*psize)
-		newChunk.nextFree = chunk.nextFree
-		newChunk.size = chunk.size - uint32(pagesNeeded)
-		b.header.FreePage = p + pagesNeeded*psize
-	} else {
-		if b.header.DataWatermark+pagesNeeded*psize > b.bufferSize {
-			b.headUnlock()
-			return 0, ErrOutOfMemory
+	p, pagesNeeded := b.cachedChunk(size)
+	if p == 0 {
+		var err error
+		if p, pagesNeeded, err = b.allocate(size); err != nil {
+			return 0, 0, err
 		}
-
-		p = b.header.DataWatermark
-		b.header.DataWatermark += pagesNeeded * psize
 	}
 
-	b.headUnlock()
-
 	if zero {
 		buf := (*[maxBufferSize]byte)(b.GetPtr(p))[:size]
 		for i := range buf { // Optimized by the compiler to simple memclr
@@ -261,38 +931,97 @@ func (b *BufferAllocator) Allocate(size uint64, zero bool) (uint64, error) {
 
 	// fmt.Printf("+ allocate %d bytes at %d\n", size, p)
 
-	return p, nil
+	return p, pagesNeeded, nil
+}
+
+// allocate takes a chunk for size bytes from the free lists of the header,
+// or from the space after the watermark
+func (b *BufferAllocator) allocate(size uint64) (uint64, uint64, error) {
+	psize := uint64(b.header.PageSize)
+
+	b.headLock()
+	defer b.headUnlock()
+
+	var p, pagesNeeded uint64
+	if b.header.Version < listsVersion {
+		p, pagesNeeded = b.takeLegacyChunk(size)
+	} else {
+		p, pagesNeeded = b.takeChunk(size)
+		if p == 0 && b.mergeFree() {
+			p, pagesNeeded = b.takeChunk(size)
+		}
+	}
+
+	if p == 0 {
+		pagesNeeded = b.pagesFor(b.header.DataWatermark, size)
+		if b.header.DataWatermark+pagesNeeded*psize > b.bufferSize {
+			return 0, 0, ErrOutOfMemory
+		}
+
+		p = b.header.DataWatermark
+		atomic.StoreUint64(&b.header.DataWatermark, p+pagesNeeded*psize)
+	}
+
+	return p, pagesNeeded, nil
 }
 
 func (b *BufferAllocator) Deallocate(offset, size uint64) error {
+	_, err := b.free(offset, size)
+	return err
+}
+
+// DeallocateNode frees the memory of a node
+func (b *BufferAllocator) DeallocateNode(offset, size uint64) error {
+	pages, err := b.free(offset, size)
+	if err == nil {
+		atomic.AddUint64(&b.header.NodesUsed, ^uint64(pages*uint64(b.header.PageSize)-1))
+		atomic.AddUint64(&b.header.Nodes, ^uint64(0))
+	}
+	return err
+}
+
+// free frees size bytes at offset and returns their pages
+func (b *BufferAllocator) free(offset, size uint64) (uint64, error) {
 	// Ensure alignement
 	size = alignSize(size)
 	psize := uint64(b.header.PageSize)
 
 	if offset%psize != 0 {
-		return fmt.Errorf("Free of non page aligned address %d (%d)", offset, offset%psize)
+		return 0, fmt.Errorf("Free of non page aligned address %d (%d)", offset, offset%psize)
 	}
 
-	pagesNeeded := (size + psize - 1) / psize
-
-	atomic.AddUint64(&b.header.TotalUsed, ^uint64(pagesNeeded*psize-1))
-
 	// println("++ Freeing ", size, "at ", offset)
 
+	// Chunks ending at the watermark lower it rather than being cached
+	pagesNeeded := b.pagesFor(offset, size)
+	if offset+pagesNeeded*psize != atomic.LoadUint64(&b.header.DataWatermark) {
+		if pages := b.cacheChunk(offset, size); pages != 0 {
+			atomic.AddUint64(&b.header.TotalUsed, ^uint64(pages*psize-1))
+			return pages, nil
+		}
+	}
+
 	b.headLock()
 
-	l := b.getChunk(offset)
-	l.nextFree = b.header.FreePage
-	l.size = uint32(pagesNeeded)
-	b.header.FreePage = b.mergeChunks(offset)
+	atomic.AddUint64(&b.header.TotalUsed, ^uint64(pagesNeeded*psize-1))
+
+	if b.header.Version < listsVersion {
+		l := b.getChunk(offset)
+		l.nextFree = b.header.FreePage
+		l.size = uint32(pagesNeeded)
+		b.header.FreePage = b.mergeChunks(offset)
+	} else {
+		b.insertChunk(offset, pagesNeeded)
+		b.unmerged++
+	}
 
 	b.headUnlock()
 
-	return nil
+	return pagesNeeded, nil
 }
 
 func (b *BufferAllocator) getChunk(offset uint64) *chunk {
-	if offset == 0 || offset > b.bufferSize-uint64(unsafe.Sizeof(chunk{})) {
+	if offset == 0 || offset > atomic.LoadUint64(&b.bufferSize)-uint64(unsafe.Sizeof(chunk{})) {
 		return nil
 	}
 	return (*chunk)(unsafe.Pointer(uintptr(b.bufferPtr) + uintptr(offset)))
@@ -300,31 +1029,150 @@ func (b *BufferAllocator) getChunk(offset uint64) *chunk {
 
 func (b *BufferAllocator) getPreample(offset uint64) *allocPreable {
 	offset -= allocPreableSize
-	if offset <= 0 || offset > b.bufferSize-allocPreableSize {
+	if offset <= 0 || offset > atomic.LoadUint64(&b.bufferSize)-allocPreableSize {
 		return nil
 	}
 	return (*allocPreable)(unsafe.Pointer(uintptr(b.bufferPtr) + uintptr(offset)))
 }
 
 func (b *BufferAllocator) PrintFreeChunks() {
-	chunkPos := b.header.FreePage
+	b.FprintFreeChunks(os.Stdout)
+}
+
+// FprintFreeChunks writes the free chunks to w
+func (b *BufferAllocator) FprintFreeChunks(w io.Writer) {
+	b.Flush()
+
+	b.lockCaches()
+	defer b.unlockCaches()
+
+	b.headLock()
+	defer b.headUnlock()
+
 	var c *chunk
 	i := 0
 	s := uint64(0)
-	fmt.Printf("---------------------------------------\n")
-	for chunkPos != 0 {
-		c = b.getChunk(chunkPos)
+	fmt.Fprintf(w, "---------------------------------------\n")
+	for _, chunkPos := range b.freeLists() {
+		for chunkPos != 0 {
+			c = b.getChunk(chunkPos)
+
+			fmt.Fprintf(w, "Free chunk %d to %d (pages: %d)\n", chunkPos, chunkPos+uint64(c.size)*uint64(b.header.PageSize), c.size)
+
+			chunkPos = c.nextFree
+			i++
+			s += uint64(c.size)
+		}
+	}
+	fmt.Fprintf(w, "---------------------------------------\n")
+	fmt.Fprintf(w, "  Total free chunks: %d\n", i)
+	fmt.Fprintf(w, "  Total free pages : %d\n", s)
+
+}
+
+// Stats describes how the space of a buffer is used
+type Stats struct {
+	Start     uint64 // offset of the first page
+	PageSize  uint16
+	Capacity  uint64
+	Watermark uint64
+
+	// Space of the allocated chunks, in total, holding nodes and holding
+	// anything else, mostly byte arrays
+	Used      uint64
+	NodesUsed uint64
+	DataUsed  uint64
+
+	// Free chunks below the watermark, their space and a histogram of their
+	// sizes, where FreeHistogram[i] counts the chunks of 2^i to 2^(i+1)-1
+	// pages
+	FreeChunks    uint64
+	FreeSpace     uint64
+	FreeHistogram []uint64
+
+	// LargestFreeRun is the largest space of adjacent free chunks below the
+	// watermark
+	LargestFreeRun uint64
+
+	// Reclaimable is the space past the end of the highest allocated chunk,
+	// which a buffer truncated there would give back without moving any
+	// chunk
+	Reclaimable uint64
+}
+
+// freeRun is the space of free chunks at offset
+type freeRun struct {
+	offset, size uint64
+}
+
+// mergeRuns merges the adjacent free runs and returns the largest of them
+// and the offset of the one that ends at end, or end when none does
+func mergeRuns(free []freeRun, end uint64) (largest, lastStart uint64) {
+	sort.Slice(free, func(i, j int) bool { return free[i].offset < free[j].offset })
+
+	var cur freeRun
+	for _, r := range free {
+		if cur.offset+cur.size == r.offset {
+			cur.size += r.size
+		} else {
+			cur = r
+		}
+		if cur.size > largest {
+			largest = cur.size
+		}
+	}
+
+	if cur.size != 0 && cur.offset+cur.size == end {
+		return largest, cur.offset
+	}
+	return largest, end
+}
+
+// Stats collects the statistics of the buffer. It walks all the free chunks,
+// so it is not meant for hot paths.
+func (b *BufferAllocator) Stats() Stats {
+	b.Flush()
 
-		fmt.Printf("Free chunk %d to %d (pages: %d)\n", chunkPos, uint32(chunkPos)+c.size*uint32(b.header.PageSize), c.size)
+	b.lockCaches()
+	defer b.unlockCaches()
 
-		chunkPos = c.nextFree
-		i++
-		s += uint64(c.size)
+	b.headLock()
+	defer b.headUnlock()
+
+	psize := uint64(b.header.PageSize)
+	st := Stats{
+		Start:     uint64(b.header.BufferStart),
+		PageSize:  b.header.PageSize,
+		Capacity:  b.bufferSize,
+		Watermark: b.header.DataWatermark,
+		Used:      atomic.LoadUint64(&b.header.TotalUsed),
+		NodesUsed: atomic.LoadUint64(&b.header.NodesUsed),
+	}
+	if st.Used > st.NodesUsed {
+		st.DataUsed = st.Used - st.NodesUsed
 	}
-	fmt.Printf("---------------------------------------\n")
-	fmt.Printf("  Total free chunks: %d\n", i)
-	fmt.Printf("  Total free pages : %d\n", s)
 
+	var free []freeRun
+	for _, p := range b.freeLists() {
+		for ; p != 0; p = b.getChunk(p).nextFree {
+			pages := uint64(b.getChunk(p).size)
+			free = append(free, freeRun{p, pages * psize})
+
+			i := bits.Len64(pages) - 1
+			for len(st.FreeHistogram) <= i {
+				st.FreeHistogram = append(st.FreeHistogram, 0)
+			}
+			st.FreeHistogram[i]++
+			st.FreeChunks++
+			st.FreeSpace += pages * psize
+		}
+	}
+
+	var usedEnd uint64
+	st.LargestFreeRun, usedEnd = mergeRuns(free, st.Watermark)
+	st.Reclaimable = st.Capacity - usedEnd
+
+	return st
 }
 
 func alignSize(size uint64) uint64 {
@@ -1,6 +1,9 @@
 package balloc_test
 
 import (
+	"bytes"
+	"math/rand"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -104,8 +107,10 @@ func Test_AllocateDeallocate(t *testing.T) {
 
 	ba.PrintFreeChunks()
 
+	// Single pages are reused from their size class, last freed first. The
+	// chunks freed at the end lowered the watermark instead.
 	p, err := ba.Allocate(128, true)
-	if p != ps[0] {
+	if p != ps[7] {
 		t.Fatal("failed to allocate 128 bytes")
 	}
 
@@ -128,7 +133,7 @@ func Test_AllocateDeallocate(t *testing.T) {
 }
 
 func Test_AllocateGrow(t *testing.T) {
-	totalSpace := uint64(1000 + 256)
+	totalSpace := 1000 + 128 + (balloc.HeaderSize+127)/128*128
 	buffer := make([]byte, totalSpace)
 
 	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 128)
@@ -244,3 +249,614 @@ func Test_DeallocateMissaligned(t *testing.T) {
 		t.Fatal("Incorrect free space")
 	}
 }
+
+func Test_ChangePageSize(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 192)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	used := ba.GetUsed()
+
+	ps := make([]uint64, 0)
+	for i := 0; i < 4; i++ {
+		p, err := ba.Allocate(20, true)
+		if err != nil {
+			t.Fatal("failed to allocate 20 bytes")
+		}
+		ps = append(ps, p)
+	}
+
+	if err := ba.Deallocate(ps[1], 20); err != nil {
+		t.Fatal("failed to dellocate 20 bytes")
+	}
+
+	if err := ba.ChangePageSize(100); err != balloc.ErrInvalidSize {
+		t.Fatal("Should not accept a page size not dividing the current one")
+	}
+
+	if err := ba.ChangePageSize(16); err != nil {
+		t.Fatal("failed to change page size", err)
+	}
+
+	if ba.GetHeader().PageSize != 16 {
+		t.Fatal("Page size not changed")
+	}
+
+	// Reuses the freed legacy chunk as a whole
+	p, err := ba.Allocate(20, true)
+	if err != nil || p != ps[1] {
+		t.Fatal("failed to reuse the freed chunk", p, ps[1])
+	}
+	ps[1] = p
+
+	// New allocations use the small pages
+	p1, _ := ba.Allocate(20, true)
+	p2, _ := ba.Allocate(20, true)
+	if p2-p1 != 32 {
+		t.Fatal("Allocation not rounded to the new page size", p1, p2)
+	}
+	ps = append(ps, p1, p2)
+
+	for _, p := range ps {
+		if err := ba.Deallocate(p, 20); err != nil {
+			t.Fatal("failed to dellocate 20 bytes")
+		}
+	}
+
+	if ba.GetUsed() != used {
+		t.Fatal("Incorrect used space", ba.GetUsed(), used)
+	}
+}
+
+func Test_SizeClasses(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	used := ba.GetUsed()
+
+	small, _ := ba.Allocate(24, true)
+	large, _ := ba.Allocate(1024, true)
+	ba.Allocate(16, true)
+
+	ba.Deallocate(small, 24)
+	ba.Deallocate(large, 1024)
+
+	ba.Flush()
+	if ba.GetHeader().Classes[1] != small {
+		t.Fatal("Freed chunk not kept in its size class")
+	}
+
+	p, _ := ba.Allocate(30, true)
+	if p != small {
+		t.Fatal("Size class chunk not reused", p, small)
+	}
+
+	// Larger chunks go to the buckets
+	p, _ = ba.Allocate(1000, true)
+	if p != large {
+		t.Fatal("Large chunk not reused", p, large)
+	}
+
+	if ba.GetUsed() != used+32+1008+16 {
+		t.Fatal("Incorrect used space", ba.GetUsed()-used)
+	}
+}
+
+func Test_BestFit(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	used := ba.GetUsed()
+
+	sizes := []uint64{400, 16, 300, 16, 260, 16, 4000, 16}
+	ps := make([]uint64, len(sizes))
+	for i, size := range sizes {
+		ps[i], _ = ba.Allocate(size, true)
+	}
+	watermark := ba.GetHeader().DataWatermark
+
+	ba.Deallocate(ps[0], 400)
+	ba.Deallocate(ps[2], 300)
+	ba.Deallocate(ps[4], 260)
+	ba.Deallocate(ps[6], 4000)
+
+	// The smallest chunk holding it is used, not the first one
+	p, _ := ba.Allocate(288, true)
+	if p != ps[2] {
+		t.Fatal("Best fitting chunk not used", p, ps[2])
+	}
+
+	// Larger chunks are split and their rest is reused
+	p, _ = ba.Allocate(3000, true)
+	if p != ps[6] {
+		t.Fatal("Larger chunk not used", p, ps[6])
+	}
+	p, _ = ba.Allocate(900, true)
+	if p != ps[6]+3008 {
+		t.Fatal("Rest of the chunk not reused", p, ps[6]+3008)
+	}
+
+	// Smaller sizes are split from the size classes and the buckets
+	p, _ = ba.Allocate(100, true)
+	if p != ps[4] {
+		t.Fatal("Chunk of the bucket not split", p, ps[4])
+	}
+	p, _ = ba.Allocate(160, true)
+	if p != ps[4]+112 {
+		t.Fatal("Rest of the chunk not reused", p, ps[4]+112)
+	}
+
+	if ba.GetHeader().DataWatermark != watermark {
+		t.Fatal("Free space not reused")
+	}
+
+	for _, p := range []uint64{ps[1], ps[3], ps[5], ps[7]} {
+		ba.Deallocate(p, 16)
+	}
+	if ba.GetUsed() != used+288+3008+912+112+160 {
+		t.Fatal("Incorrect used space", ba.GetUsed()-used)
+	}
+}
+
+func Test_MergeFree(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	used := ba.GetUsed()
+
+	ps := make([]uint64, 16)
+	for i := range ps {
+		ps[i], _ = ba.Allocate(256, true)
+	}
+	guard, _ := ba.Allocate(16, true)
+	watermark := ba.GetHeader().DataWatermark
+
+	for i := 0; i < len(ps); i += 2 {
+		ba.Deallocate(ps[i], 256)
+	}
+	for i := 1; i < len(ps); i += 2 {
+		ba.Deallocate(ps[i], 256)
+	}
+
+	// The adjacent chunks are merged to hold their combined size
+	p, _ := ba.Allocate(256*uint64(len(ps)), true)
+	if p != ps[0] {
+		t.Fatal("Adjacent free chunks not merged", p, ps[0])
+	}
+	if ba.GetHeader().DataWatermark != watermark {
+		t.Fatal("Merged chunks not reused")
+	}
+
+	// Chunks ending at the watermark lower it, even those of the sizes the
+	// allocation caches keep
+	ba.Deallocate(guard, 16)
+	if ba.GetHeader().DataWatermark != guard {
+		t.Fatal("Chunk at the watermark cached", ba.GetHeader().DataWatermark, guard)
+	}
+	ba.Deallocate(p, 256*uint64(len(ps)))
+	if ba.GetHeader().DataWatermark != ps[0] {
+		t.Fatal("Watermark not lowered", ba.GetHeader().DataWatermark, ps[0])
+	}
+
+	if ba.GetUsed() != used {
+		t.Fatal("Incorrect used space", ba.GetUsed(), used)
+	}
+}
+
+func Test_UpgradeHeader(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	if offset, err := ba.UpgradeHeader(); err != nil || offset != 0 {
+		t.Fatal("Current header should not move", offset, err)
+	}
+
+	// Turn it into a version 0 header, which keeps its free chunks in a
+	// single list
+	h := ba.GetHeader()
+	h.Version = 0
+	h.Classes = [8]uint64{}
+	h.Buckets = [16]uint64{}
+	p1, _ := ba.Allocate(32, true)
+	ba.Allocate(16, true)
+	p2, _ := ba.Allocate(balloc.HeaderSize+64, true)
+	ba.Allocate(16, true)
+	ba.Deallocate(p1, 32)
+	ba.Deallocate(p2, balloc.HeaderSize+64)
+	if h.FreePage != p2 || h.Classes[1] != 0 {
+		t.Fatal("Version 0 header should not use the size classes")
+	}
+
+	used := ba.GetUsed()
+	offset, err := ba.UpgradeHeader()
+	if err != nil || offset != p2 {
+		t.Fatal("failed to upgrade header", offset, err)
+	}
+
+	h = ba.GetHeader()
+	if h.Version == 0 || h.PageSize != 16 || ba.GetUsed() < used+balloc.HeaderSize {
+		t.Fatal("Header not copied", h)
+	}
+
+	// The free chunks were moved to the free lists
+	if h.FreePage != 0 || h.Classes[1] != p1 || h.Classes[3] != p2+(balloc.HeaderSize+15)/16*16 {
+		t.Fatal("Free chunks not moved", h)
+	}
+	p, _ := ba.Allocate(32, true)
+	if p != p1 {
+		t.Fatal("Moved chunk not reused", p, p1)
+	}
+
+	ba, err = balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), offset, 16)
+	if err != nil || ba.GetHeader() != h {
+		t.Fatal("Moved header not found")
+	}
+}
+
+func Test_AllocationCache(t *testing.T) {
+	totalSpace := uint64(16 * 1024 * 1024) // 16MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	used := ba.GetUsed()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			ps := make(map[uint64]uint64)
+			for i := 0; i < 10000; i++ {
+				size := uint64(r.Intn(200) + 1)
+				p, err := ba.Allocate(size, true)
+				if err != nil {
+					t.Error("failed to allocate", err)
+					return
+				}
+				if _, ok := ps[p]; ok {
+					t.Error("Chunk allocated twice", p)
+					return
+				}
+				ps[p] = size
+				if len(ps) > 100 {
+					for p, size := range ps {
+						ba.Deallocate(p, size)
+						delete(ps, p)
+						break
+					}
+				}
+			}
+			for p, size := range ps {
+				ba.Deallocate(p, size)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if ba.GetUsed() != used {
+		t.Fatal("Incorrect used space", ba.GetUsed(), used)
+	}
+
+	// The cached chunks are listed in the header, so the buffer opened again
+	// without a flush has all its free space
+	watermark := ba.GetHeader().DataWatermark
+	ba, err = balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil {
+		t.Fatal("failed to open buffer")
+	}
+	if st := ba.Stats(); st.Used+st.FreeSpace != st.Watermark-st.Start {
+		t.Fatal("Cached chunks lost", st.Used, st.FreeSpace, st.Watermark-st.Start)
+	}
+	for i := 0; i < 100; i++ {
+		ba.Allocate(uint64(i%128+1), true)
+	}
+	if ba.GetHeader().DataWatermark > watermark {
+		t.Fatal("Cached chunks not reused")
+	}
+}
+
+func Test_CacheSteal(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	p, _ := ba.Allocate(100, true)
+	ba.Allocate(16, true)
+	ba.Deallocate(p, 100)
+	watermark := ba.GetHeader().DataWatermark
+
+	// Move the freed chunk to the first cache, the one the buffer opened
+	// again does not start from
+	h := ba.GetHeader()
+	for i := range h.Cached {
+		for k := range h.Cached[i] {
+			if h.Cached[i][k] == p {
+				h.Cached[i][k], h.Cached[0][k] = 0, p
+			}
+		}
+	}
+
+	// Chunks of other caches are taken before the watermark is raised
+	ba, err = balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil {
+		t.Fatal("failed to open buffer")
+	}
+	if q, _ := ba.Allocate(100, true); q != p {
+		t.Fatal("Cached chunk not reused", q, p)
+	}
+	if ba.GetHeader().DataWatermark != watermark {
+		t.Fatal("Watermark raised", ba.GetHeader().DataWatermark, watermark)
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	totalSpace := uint64(1024 * 1024) // 1MB
+	buffer := make([]byte, totalSpace)
+
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+
+	n1, _ := ba.AllocateNode(100)
+	p1, _ := ba.Allocate(32, true)
+	p2, _ := ba.Allocate(48, true)
+	p3, _ := ba.Allocate(320, true)
+	n2, _ := ba.AllocateNode(20)
+
+	ba.Deallocate(p1, 32)
+	ba.Deallocate(p2, 48)
+	ba.Deallocate(p3, 320)
+
+	s := ba.Stats()
+	if s.NodesUsed != 112+32 || s.Used != s.NodesUsed || s.DataUsed != 0 {
+		t.Fatal("Incorrect used space", s)
+	}
+	if s.FreeChunks != 3 || s.FreeSpace != 400 || s.LargestFreeRun != 400 || s.Reclaimable != s.Capacity-s.Watermark {
+		t.Fatal("Incorrect free space", s)
+	}
+	if len(s.FreeHistogram) != 5 || s.FreeHistogram[1] != 2 || s.FreeHistogram[4] != 1 {
+		t.Fatal("Incorrect histogram", s.FreeHistogram)
+	}
+
+	ba.DeallocateNode(n1, 100)
+	if s := ba.Stats(); s.NodesUsed != 32 || s.LargestFreeRun != 512 {
+		t.Fatal("Incorrect stats after freeing a node", s)
+	}
+
+	// Freeing the highest chunk makes the free runs below it reclaimable
+	ba.DeallocateNode(n2, 20)
+	if s := ba.Stats(); s.Reclaimable != s.Capacity-s.Start {
+		t.Fatal("Incorrect reclaimable space", s)
+	}
+}
+
+func Test_HeapAllocator(t *testing.T) {
+	h, err := balloc.NewHeapAllocator(4096, 64, 16)
+	if err != nil || h == nil {
+		t.Fatal("failed to create heap allocator")
+	}
+
+	if _, err := h.Allocate(8192, false); err != balloc.ErrInvalidSize {
+		t.Fatal("Allocations larger than a segment should fail", err)
+	}
+
+	ps := make([]uint64, 100)
+	for i := range ps {
+		p, err := h.Allocate(1000, true)
+		if err != nil {
+			t.Fatal("Failed to allocate", err)
+		}
+		if p < 64 || p%4096+1000 > 4096 {
+			t.Fatal("Allocation crosses a segment", p)
+		}
+		*(*uint64)(h.GetPtr(p)) = uint64(i)
+		ps[i] = p
+	}
+	if h.GetCapacity() < 100*1000 {
+		t.Fatal("Segments not added", h.GetCapacity())
+	}
+
+	// Memory does not move when segments are added
+	for i, p := range ps {
+		if *(*uint64)(h.GetPtr(p)) != uint64(i) {
+			t.Fatal("Memory moved", i)
+		}
+		if h.GetOffset(h.GetPtr(p)) != p {
+			t.Fatal("Incorrect offset", p)
+		}
+	}
+
+	capacity := h.GetCapacity()
+	for _, p := range ps[:50] {
+		h.Deallocate(p, 1000)
+	}
+	for i := 0; i < 50; i++ {
+		h.Allocate(1000, false)
+	}
+	if h.GetCapacity() != capacity {
+		t.Fatal("Free memory not reused", h.GetCapacity())
+	}
+
+	n, _ := h.AllocateNode(100)
+	s := h.Stats()
+	if s.NodesUsed != 112 || s.Used != 100*1008+112 {
+		t.Fatal("Incorrect stats", s)
+	}
+	h.DeallocateNode(n, 100)
+	if s := h.Stats(); s.NodesUsed != 0 || s.FreeChunks == 0 || s.Reclaimable < s.Capacity-s.Watermark+112 {
+		t.Fatal("Incorrect stats after freeing a node", s)
+	}
+}
+
+func Test_FaultInjector(t *testing.T) {
+	buffer := make([]byte, 1024*1024)
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil || ba == nil {
+		t.Fatal("failed to create buffer")
+	}
+	used := ba.GetUsed()
+
+	f := balloc.NewFaultInjector(ba, 1)
+
+	f.FailAt(3)
+	for i := 1; i <= 5; i++ {
+		p, err := f.Allocate(32, false)
+		if (i == 3) != (err == balloc.ErrInjectedFault) {
+			t.Fatal("Incorrect allocation failed", i, err)
+		}
+		if err == nil {
+			f.Deallocate(p, 32)
+		}
+	}
+	if f.Allocations() != 5 || f.Failures() != 1 {
+		t.Fatal("Incorrect counts", f.Allocations(), f.Failures())
+	}
+
+	f.FailRate(0.5)
+	for i := 0; i < 1000; i++ {
+		if p, err := f.AllocateNode(64); err == nil {
+			f.DeallocateNode(p, 64)
+		}
+	}
+	if n := f.Failures(); n < 400 || n > 600 {
+		t.Fatal("Incorrect number of random failures", n)
+	}
+
+	// Failures leave garbage in memory that is not zeroed
+	f.FailRate(0)
+	f.Scribble(true)
+	f.FailAt(1)
+	if _, err := f.Allocate(256, false); err != balloc.ErrInjectedFault {
+		t.Fatal("Allocation did not fail", err)
+	}
+	p, _ := ba.Allocate(256, false)
+	if bytes.Equal((*[256]byte)(ba.GetPtr(p))[:], make([]byte, 256)) {
+		t.Fatal("Failed allocation left no garbage")
+	}
+	ba.Deallocate(p, 256)
+
+	if ba.GetUsed() != used {
+		t.Fatal("Failed allocations leaked memory", ba.GetUsed()-used)
+	}
+}
+
+func benchmarkAllocator(b *testing.B) *balloc.BufferAllocator {
+	buffer := make([]byte, 256*1024*1024)
+	ba, err := balloc.NewBufferAllocator(unsafe.Pointer(&buffer[0]), uint64(len(buffer)), 0, 16)
+	if err != nil {
+		b.Fatal("failed to create buffer")
+	}
+	return ba
+}
+
+func BenchmarkAllocateDeallocateSmall(b *testing.B) {
+	ba := benchmarkAllocator(b)
+	sizes := []uint64{8, 20, 40, 72, 120}
+
+	ps := make([]uint64, 1024)
+	for i := range ps {
+		ps[i], _ = ba.Allocate(sizes[i%len(sizes)], false)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(ps)
+		size := sizes[j%len(sizes)]
+		ba.Deallocate(ps[j], size)
+		ps[j], _ = ba.Allocate(size, false)
+	}
+}
+
+// benchmarkFragmentation frees and allocates random sizes up to maxSize and
+// reports how far the watermark moves past the space in use
+func benchmarkFragmentation(b *testing.B, maxSize int) {
+	ba := benchmarkAllocator(b)
+	r := rand.New(rand.NewSource(1))
+
+	type alloc struct {
+		p, size uint64
+	}
+	allocs := make([]alloc, 4096)
+	for i := range allocs {
+		size := uint64(r.Intn(maxSize) + 1)
+		p, _ := ba.Allocate(size, false)
+		allocs[i] = alloc{p, size}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a := &allocs[r.Intn(len(allocs))]
+		ba.Deallocate(a.p, a.size)
+		a.size = uint64(r.Intn(maxSize) + 1)
+		var err error
+		if a.p, err = ba.Allocate(a.size, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	h := ba.GetHeader()
+	b.ReportMetric(float64(h.DataWatermark-uint64(h.BufferStart))/float64(ba.GetUsed()), "watermark/used")
+}
+
+func BenchmarkFragmentation(b *testing.B) {
+	benchmarkFragmentation(b, 128)
+}
+
+func BenchmarkFragmentationMixed(b *testing.B) {
+	benchmarkFragmentation(b, 4096)
+}
+
+// BenchmarkConcurrentAllocate allocates and frees small chunks from all the
+// goroutines, run it with -cpu to see how it scales
+func BenchmarkConcurrentAllocate(b *testing.B) {
+	ba := benchmarkAllocator(b)
+
+	b.RunParallel(func(pb *testing.PB) {
+		var ps [64]uint64
+		i := 0
+		for pb.Next() {
+			j := i % len(ps)
+			size := uint64(j%8+1) * 16
+			if ps[j] != 0 {
+				ba.Deallocate(ps[j], size)
+			}
+			ps[j], _ = ba.Allocate(size, false)
+			i++
+		}
+	})
+}
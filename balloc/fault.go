@@ -0,0 +1,127 @@
+package balloc
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// ErrInjectedFault is returned by the allocations a FaultInjector fails
+var ErrInjectedFault = errors.New("Injected allocation failure")
+
+// FaultInjector wraps a MemoryManager failing some of its allocations, to
+// test how callers recover when memory runs out in the middle of a change.
+// Deallocations and everything else are passed through.
+type FaultInjector struct {
+	MemoryManager
+
+	failAt   uint64
+	failRate float64
+	scribble bool
+
+	rand     *rand.Rand
+	count    uint64
+	failures uint64
+	lock     sync.Mutex
+}
+
+// NewFaultInjector wraps mm. Random failures are drawn from seed, so runs
+// with the same seed fail the same allocations.
+func NewFaultInjector(mm MemoryManager, seed int64) *FaultInjector {
+	return &FaultInjector{
+		MemoryManager: mm,
+		rand:          rand.New(rand.NewSource(seed)),
+	}
+}
+
+// FailAt makes the nth allocation from now fail, counting from one. Zero
+// cancels it.
+func (f *FaultInjector) FailAt(n uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.failAt = 0
+	if n != 0 {
+		f.failAt = f.count + n
+	}
+}
+
+// FailRate makes allocations fail with probability p
+func (f *FaultInjector) FailRate(p float64) {
+	f.lock.Lock()
+	f.failRate = p
+	f.lock.Unlock()
+}
+
+// Scribble makes failing allocations leave garbage behind. The memory is
+// taken from the wrapped manager, a random part of it is scribbled over and
+// it is freed again before failing, so that memory handed out later without
+// zeroing holds the garbage. Memory in use is never written.
+func (f *FaultInjector) Scribble(scribble bool) {
+	f.lock.Lock()
+	f.scribble = scribble
+	f.lock.Unlock()
+}
+
+// Allocations returns the number of allocations requested so far
+func (f *FaultInjector) Allocations() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.count
+}
+
+// Failures returns the number of allocations failed so far
+func (f *FaultInjector) Failures() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.failures
+}
+
+func (f *FaultInjector) Allocate(size uint64, zero bool) (uint64, error) {
+	if f.fail(size) {
+		return 0, ErrInjectedFault
+	}
+	return f.MemoryManager.Allocate(size, zero)
+}
+
+func (f *FaultInjector) AllocateNode(size uint64) (uint64, error) {
+	if f.fail(size) {
+		return 0, ErrInjectedFault
+	}
+	return f.MemoryManager.AllocateNode(size)
+}
+
+// fail counts an allocation of size bytes and tells if it should fail
+func (f *FaultInjector) fail(size uint64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.count++
+	if f.count != f.failAt && (f.failRate == 0 || f.rand.Float64() >= f.failRate) {
+		return false
+	}
+
+	if f.count == f.failAt {
+		f.failAt = 0
+	}
+	f.failures++
+
+	if f.scribble {
+		f.scribbleFree(size)
+	}
+
+	return true
+}
+
+// scribbleFree writes garbage over free memory of size bytes
+func (f *FaultInjector) scribbleFree(size uint64) {
+	p, err := f.MemoryManager.Allocate(size, false)
+	if err != nil {
+		return
+	}
+
+	buf := (*[maxBufferSize]byte)(f.GetPtr(p))[:size]
+	f.rand.Read(buf[:f.rand.Intn(int(size))+1])
+
+	f.MemoryManager.Deallocate(p, size)
+}
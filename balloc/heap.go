@@ -0,0 +1,304 @@
+package balloc
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// maxSegments is the number of segments a heap allocator can have
+const maxSegments = 1 << 14
+
+// HeapAllocator allocates memory in segments on the Go heap. It grows by
+// adding segments, so memory is never copied or moved. Its free lists are
+// kept in Go memory, so it is meant for ephemeral state that is never
+// written to a file.
+type HeapAllocator struct {
+	segmentSize  uint64
+	segmentShift uint
+	segments     *[maxSegments]unsafe.Pointer
+	numSegments  uint64
+	maxSegments  uint64
+
+	pageSize  uint64
+	reserved  uint64
+	watermark uint64
+	free      map[uint64][]uint64
+
+	used      uint64
+	nodesUsed uint64
+	nodes     int64
+
+	headerLock sync.Mutex
+	bufferMux  sync.RWMutex
+}
+
+// NewHeapAllocator creates a heap allocator with segments of segmentSize
+// bytes, rounded up to a power of two. The first reserved bytes are not
+// allocated, as with the firstFree of NewBufferAllocator.
+func NewHeapAllocator(segmentSize, reserved uint64, pageSize uint16) (*HeapAllocator, error) {
+	if segmentSize == 0 || reserved >= segmentSize {
+		return nil, ErrInvalidSize
+	}
+
+	shift := uint(bits.Len64(segmentSize - 1))
+	segmentSize = 1 << shift
+
+	psize := uint64(pageSize)
+	start := (alignSize(reserved) + psize - 1) / psize * psize
+
+	h := &HeapAllocator{
+		segmentSize:  segmentSize,
+		segmentShift: shift,
+		segments:     new([maxSegments]unsafe.Pointer),
+		maxSegments:  maxSegments,
+		pageSize:     psize,
+		reserved:     start,
+		watermark:    start,
+		free:         make(map[uint64][]uint64),
+	}
+	h.addSegment()
+
+	return h, nil
+}
+
+// SetLimit limits the memory of the allocator to size bytes, allocations
+// needing more segments fail with ErrOutOfMemory. The segments already
+// added are kept.
+func (h *HeapAllocator) SetLimit(size uint64) {
+	h.headerLock.Lock()
+	defer h.headerLock.Unlock()
+
+	h.maxSegments = size >> h.segmentShift
+	if h.maxSegments < 1 {
+		h.maxSegments = 1
+	}
+	if h.maxSegments > maxSegments {
+		h.maxSegments = maxSegments
+	}
+}
+
+// addSegment adds a segment. Segments are only added, so GetPtr reads them
+// without locking.
+func (h *HeapAllocator) addSegment() {
+	segment := make([]byte, h.segmentSize)
+	h.segments[h.numSegments] = unsafe.Pointer(&segment[0])
+	h.numSegments++
+}
+
+// Allocate a new buffer of specific size. Sizes larger than a segment are
+// invalid.
+func (h *HeapAllocator) Allocate(size uint64, zero bool) (uint64, error) {
+	p, _, err := h.alloc(size, zero)
+	return p, err
+}
+
+// AllocateNode allocates zeroed memory for a node
+func (h *HeapAllocator) AllocateNode(size uint64) (uint64, error) {
+	p, space, err := h.alloc(size, true)
+	if err == nil {
+		atomic.AddUint64(&h.nodesUsed, space)
+		atomic.AddInt64(&h.nodes, 1)
+	}
+	return p, err
+}
+
+// NodeCount returns the number of nodes allocated
+func (h *HeapAllocator) NodeCount() int64 {
+	return atomic.LoadInt64(&h.nodes)
+}
+
+// NodeSpace returns the space a node of size bytes adds to NodesUsed
+func (h *HeapAllocator) NodeSpace(pos, size uint64) uint64 {
+	return (alignSize(size) + h.pageSize - 1) / h.pageSize * h.pageSize
+}
+
+func (h *HeapAllocator) alloc(size uint64, zero bool) (uint64, uint64, error) {
+	if size == 0 || size > h.segmentSize {
+		return 0, 0, ErrInvalidSize
+	}
+
+	space := (alignSize(size) + h.pageSize - 1) / h.pageSize * h.pageSize
+
+	h.headerLock.Lock()
+
+	var p uint64
+	if l := h.free[space]; len(l) > 0 {
+		p = l[len(l)-1]
+		h.free[space] = l[:len(l)-1]
+	} else {
+		if end := h.numSegments << h.segmentShift; h.watermark+space > end {
+			if h.numSegments >= h.maxSegments {
+				h.headerLock.Unlock()
+				return 0, 0, ErrOutOfMemory
+			}
+
+			// The rest of the segment is kept for smaller allocations
+			if rest := end - h.watermark; rest > 0 {
+				h.free[rest] = append(h.free[rest], h.watermark)
+			}
+			h.watermark = h.numSegments << h.segmentShift
+			h.addSegment()
+		}
+
+		p = h.watermark
+		h.watermark += space
+	}
+
+	h.headerLock.Unlock()
+
+	if zero {
+		buf := (*[maxBufferSize]byte)(h.GetPtr(p))[:size]
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+
+	atomic.AddUint64(&h.used, space)
+
+	return p, space, nil
+}
+
+func (h *HeapAllocator) Deallocate(pos, size uint64) error {
+	_, err := h.dealloc(pos, size)
+	return err
+}
+
+// DeallocateNode frees the memory of a node
+func (h *HeapAllocator) DeallocateNode(pos, size uint64) error {
+	space, err := h.dealloc(pos, size)
+	if err == nil {
+		atomic.AddUint64(&h.nodesUsed, ^uint64(space-1))
+		atomic.AddInt64(&h.nodes, -1)
+	}
+	return err
+}
+
+func (h *HeapAllocator) dealloc(pos, size uint64) (uint64, error) {
+	if pos%h.pageSize != 0 {
+		return 0, fmt.Errorf("Free of non page aligned address %d (%d)", pos, pos%h.pageSize)
+	}
+
+	space := (alignSize(size) + h.pageSize - 1) / h.pageSize * h.pageSize
+
+	h.headerLock.Lock()
+	h.free[space] = append(h.free[space], pos)
+	h.headerLock.Unlock()
+
+	atomic.AddUint64(&h.used, ^uint64(space-1))
+
+	return space, nil
+}
+
+func (h *HeapAllocator) GetPtr(pos uint64) unsafe.Pointer {
+	return unsafe.Pointer(uintptr(h.segments[pos>>h.segmentShift]) + uintptr(pos&(h.segmentSize-1)))
+}
+
+func (h *HeapAllocator) GetOffset(p unsafe.Pointer) uint64 {
+	for i, s := range h.segments[:h.numSegments] {
+		if uintptr(p) >= uintptr(s) && uintptr(p) < uintptr(s)+uintptr(h.segmentSize) {
+			return uint64(i)<<h.segmentShift + uint64(uintptr(p)-uintptr(s))
+		}
+	}
+	return 0
+}
+
+func (h *HeapAllocator) GetUsed() uint64 {
+	return atomic.LoadUint64(&h.used)
+}
+
+// GetFree returns the space that can still be added in segments
+func (h *HeapAllocator) GetFree() uint64 {
+	h.headerLock.Lock()
+	defer h.headerLock.Unlock()
+	return maxSegments<<h.segmentShift - h.watermark
+}
+
+// GetCapacity returns the space of the segments added so far
+func (h *HeapAllocator) GetCapacity() uint64 {
+	h.headerLock.Lock()
+	defer h.headerLock.Unlock()
+	return h.numSegments << h.segmentShift
+}
+
+func (h *HeapAllocator) Lock() {
+	h.bufferMux.RLock()
+}
+
+func (h *HeapAllocator) Unlock() {
+	h.bufferMux.RUnlock()
+}
+
+func (h *HeapAllocator) WLock() {
+	h.bufferMux.Lock()
+}
+
+func (h *HeapAllocator) WUnlock() {
+	h.bufferMux.Unlock()
+}
+
+// Flush does nothing, the free lists are never written anywhere
+func (h *HeapAllocator) Flush() {
+}
+
+// Stats collects the statistics of the allocator
+func (h *HeapAllocator) Stats() Stats {
+	h.headerLock.Lock()
+	defer h.headerLock.Unlock()
+
+	st := Stats{
+		Start:     h.reserved,
+		PageSize:  uint16(h.pageSize),
+		Capacity:  h.numSegments << h.segmentShift,
+		Watermark: h.watermark,
+		Used:      atomic.LoadUint64(&h.used),
+		NodesUsed: atomic.LoadUint64(&h.nodesUsed),
+	}
+	if st.Used > st.NodesUsed {
+		st.DataUsed = st.Used - st.NodesUsed
+	}
+
+	var free []freeRun
+	for space, l := range h.free {
+		if len(l) == 0 {
+			continue
+		}
+
+		i := bits.Len64(space/h.pageSize) - 1
+		for len(st.FreeHistogram) <= i {
+			st.FreeHistogram = append(st.FreeHistogram, 0)
+		}
+		st.FreeHistogram[i] += uint64(len(l))
+		st.FreeChunks += uint64(len(l))
+		st.FreeSpace += space * uint64(len(l))
+
+		if space > st.LargestFreeRun {
+			st.LargestFreeRun = space
+		}
+		for _, pos := range l {
+			free = append(free, freeRun{pos, space})
+		}
+	}
+
+	// Free chunks are not merged, adjacent ones are only reclaimable
+	_, usedEnd := mergeRuns(free, st.Watermark)
+	st.Reclaimable = st.Capacity - usedEnd
+
+	return st
+}
+
+func (h *HeapAllocator) PrintFreeChunks() {
+	h.FprintFreeChunks(os.Stdout)
+}
+
+// FprintFreeChunks writes the totals of the free chunks to w
+func (h *HeapAllocator) FprintFreeChunks(w io.Writer) {
+	st := h.Stats()
+	fmt.Fprintf(w, "---------------------------------------\n")
+	fmt.Fprintf(w, "  Total free chunks: %d\n", st.FreeChunks)
+	fmt.Fprintf(w, "  Total free pages : %d\n", st.FreeSpace/h.pageSize)
+}
@@ -0,0 +1,65 @@
+package balloc
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ErrReadOnly is returned by the allocations of a ReadOnlyAllocator
+var ErrReadOnly = errors.New("Memory is read-only")
+
+// ReadOnlyAllocator reads a buffer mapped read-only, which other processes
+// may be writing to. It allocates and frees nothing, and the users of the
+// buffer are expected to check IsReadOnly and not write to it, not even the
+// reference counts it holds.
+type ReadOnlyAllocator struct {
+	*BufferAllocator
+}
+
+// NewReadOnlyAllocator reads the buffer whose allocator header is at
+// firstFree. Headers of versions before listsVersion need UpgradeHeader,
+// which writes to the buffer, so they fail.
+func NewReadOnlyAllocator(bufPtr unsafe.Pointer, bufSize uint64, firstFree uint64) (*ReadOnlyAllocator, error) {
+	h := (*header)(unsafe.Pointer(uintptr(bufPtr) + uintptr(alignSize(firstFree))))
+	if h.magic != magic {
+		return nil, fmt.Errorf("No allocator header")
+	}
+	if h.Version < listsVersion {
+		return nil, fmt.Errorf("Allocator header version %d needs an upgrade", h.Version)
+	}
+
+	return &ReadOnlyAllocator{
+		BufferAllocator: &BufferAllocator{
+			bufferPtr:  bufPtr,
+			bufferSize: bufSize,
+			header:     h,
+		},
+	}, nil
+}
+
+// IsReadOnly tells if mm is a ReadOnlyAllocator
+func IsReadOnly(mm MemoryManager) bool {
+	_, ok := mm.(*ReadOnlyAllocator)
+	return ok
+}
+
+func (r *ReadOnlyAllocator) Allocate(size uint64, zero bool) (uint64, error) {
+	return 0, ErrReadOnly
+}
+
+func (r *ReadOnlyAllocator) AllocateNode(size uint64) (uint64, error) {
+	return 0, ErrReadOnly
+}
+
+func (r *ReadOnlyAllocator) Deallocate(pos, size uint64) error {
+	return ErrReadOnly
+}
+
+func (r *ReadOnlyAllocator) DeallocateNode(pos, size uint64) error {
+	return ErrReadOnly
+}
+
+// Flush does nothing, as nothing is freed
+func (r *ReadOnlyAllocator) Flush() {
+}
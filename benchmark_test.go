@@ -181,7 +181,7 @@ func maxInt(a int, b int) int {
 func doRead(b *testing.B, db *ebakusdb.DB, g keyGenerator, allowNotFound bool) {
 	for i := 0; i < b.N; i++ {
 		//println("========================================Getting", string(g.Key(i)))
-		_, found := db.Get(g.Key(i))
+		_, found, _ := db.Get(g.Key(i))
 		if !allowNotFound && !found {
 			b.Fatalf("db get error: Key not found\n")
 		}
@@ -208,7 +208,7 @@ func doDelete(N int, db *ebakusdb.Snapshot, k int, g keyGenerator) {
 	}
 }
 
-func createDB() (*ebakusdb.DB, string) {
+func createDB(options *ebakusdb.Options) (*ebakusdb.DB, string) {
 	f, err := ioutil.TempFile("/tmp", "ebakus-benchmark-")
 	if err != nil {
 		panic(err)
@@ -220,15 +220,15 @@ func createDB() (*ebakusdb.DB, string) {
 		panic(err)
 	}
 	fname := f.Name()
-	db, err := ebakusdb.Open(fname, 0, nil)
+	db, err := ebakusdb.Open(fname, 0, options)
 	if err != nil {
 		panic(fmt.Errorf("create db %q error: %s\n", fname, err))
 	}
 	return db, fname
 }
 
-func newDB(b *testing.B) string {
-	db, dir := createDB()
+func newDB(b *testing.B, options *ebakusdb.Options) string {
+	db, dir := createDB(options)
 	defer runtime.GC()
 	defer func() {
 		if db != nil {
@@ -254,9 +254,13 @@ func openDB(dir string, b *testing.B) *ebakusdb.DB {
 }
 
 func openFullDB(b *testing.B) (*ebakusdb.DB, func()) {
+	return openFullDBWithOptions(b, nil)
+}
+
+func openFullDBWithOptions(b *testing.B, options *ebakusdb.Options) (*ebakusdb.DB, func()) {
 	defer runtime.GC()
 	defer b.ResetTimer()
-	dir := newDB(b)
+	dir := newDB(b, options)
 	ok := false
 	defer func() {
 		if !ok {
@@ -269,8 +273,12 @@ func openFullDB(b *testing.B) (*ebakusdb.DB, func()) {
 }
 
 func openEmptyDB(b *testing.B) (*ebakusdb.DB, func()) {
+	return openEmptyDBWithOptions(b, nil)
+}
+
+func openEmptyDBWithOptions(b *testing.B, options *ebakusdb.Options) (*ebakusdb.DB, func()) {
 	defer b.ResetTimer()
-	db, dir := createDB()
+	db, dir := createDB(options)
 	return db, func() { db.Close(); os.RemoveAll(dir) }
 }
 
@@ -280,7 +288,7 @@ func BenchmarkOpen(b *testing.B) {
 	}(b.N)
 	n := b.N
 	b.N = *openDBSize / *valueSize
-	dir := newDB(b)
+	dir := newDB(b, nil)
 	b.N = n
 	defer os.Remove(dir)
 
@@ -316,6 +324,13 @@ func BenchmarkReadRandom(b *testing.B) {
 	doRead(b, db, g, false)
 }
 
+func BenchmarkReadRandomRadix256(b *testing.B) {
+	db, cleanup := openFullDBWithOptions(b, &ebakusdb.Options{Radix: ebakusdb.Radix256})
+	defer cleanup()
+	g := newRandomKeyGenerator(b.N)
+	doRead(b, db, g, false)
+}
+
 func BenchmarkReadMissing(b *testing.B) {
 	db, cleanup := openFullDB(b)
 	defer cleanup()
@@ -351,6 +366,19 @@ func BenchmarkReadSequential(b *testing.B) {
 	}
 }
 
+func BenchmarkReadSequentialOmitLeafKeys(b *testing.B) {
+	db, cleanup := openFullDBWithOptions(b, &ebakusdb.Options{OmitLeafKeys: true})
+	defer cleanup()
+	it := db.Iter()
+
+	for {
+		_, _, found := it.Next()
+		if found == false {
+			break
+		}
+	}
+}
+
 func BenchmarkWriteRandom(b *testing.B) {
 	db, cleanup := openEmptyDB(b)
 	defer cleanup()
@@ -373,6 +401,35 @@ func BenchmarkWriteSequential(b *testing.B) {
 	snap.Release()
 }
 
+// BenchmarkWriteRandomMemory reports the space used per inserted key
+func BenchmarkWriteRandomMemory(b *testing.B) {
+	doWriteRandomMemory(b, nil)
+}
+
+func BenchmarkWriteRandomMemoryRadix256(b *testing.B) {
+	doWriteRandomMemory(b, &ebakusdb.Options{Radix: ebakusdb.Radix256})
+}
+
+func BenchmarkWriteRandomMemoryOmitLeafKeys(b *testing.B) {
+	doWriteRandomMemory(b, &ebakusdb.Options{OmitLeafKeys: true})
+}
+
+func doWriteRandomMemory(b *testing.B, options *ebakusdb.Options) {
+	db, cleanup := openEmptyDBWithOptions(b, options)
+	defer cleanup()
+	g := newFullRandomEntryGenerator(0, b.N)
+	used := db.GetInfo().TotalUsed
+	nodes := ebakusdb.GetNodeCount()
+	b.ResetTimer()
+	snap := db.GetRootSnapshot()
+	doWrite(b.N, snap, maxInt(*batchCount, 1), g)
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	b.StopTimer()
+	b.ReportMetric(float64(db.GetInfo().TotalUsed-used)/float64(b.N), "bytes/key")
+	b.ReportMetric(float64(ebakusdb.GetNodeCount()-nodes)/float64(b.N), "nodes/key")
+}
+
 func BenchmarkConcurrentWriteRandom(b *testing.B) {
 	db, cleanup := openEmptyDB(b)
 	defer cleanup()
@@ -1,8 +1,10 @@
 package ebakusdb
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"sync/atomic"
 	"unsafe"
 
@@ -15,10 +17,30 @@ var (
 
 const maxDataSize = 0x9C4000
 
+// maxInlineSize is the largest array stored inside the ByteArray itself
+const maxInlineSize = uint32(unsafe.Sizeof(uint64(0)))
+
+// Arrays larger than overflowSegmentSize are split in segments that are
+// allocated separately. The Offset of an overflow array points to the
+// segment table, a reference count followed by the segment offsets.
+const overflowSegmentSize = 1024 * 1024
+
+// maxValueSize is the largest array that can be stored
+const maxValueSize = 256 * overflowSegmentSize
+
+// bytesPreambleSize is the space before the data of an array, its int32
+// reference count padded to 8 bytes
+const bytesPreambleSize = 8
+
 var bytesCount int
 
 func newBytes(mm balloc.MemoryManager, size uint32) (*ByteArray, []byte, error) {
-	offset, err := mm.Allocate(uint64(unsafe.Sizeof(int(0))+uintptr(size)), false)
+	if size <= maxInlineSize {
+		aPtr := &ByteArray{Size: size, flags: byteArrayInline}
+		return aPtr, aPtr.getBytes(mm), nil
+	}
+
+	offset, err := mm.Allocate(bytesPreambleSize+uint64(size), false)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -30,17 +52,66 @@ func newBytes(mm balloc.MemoryManager, size uint32) (*ByteArray, []byte, error)
 	return aPtr, a, nil
 }
 
+func newOverflowBytes(mm balloc.MemoryManager, data []byte) (*ByteArray, error) {
+	count := (len(data) + overflowSegmentSize - 1) / overflowSegmentSize
+	offset, err := mm.Allocate(bytesPreambleSize+uint64(count)*8, true)
+	if err != nil {
+		return nil, err
+	}
+	aPtr := &ByteArray{Offset: offset, Size: uint32(len(data)), flags: byteArrayOverflow}
+	*aPtr.getBytesRefCount(mm) = 1
+
+	for i := 0; i < count; i++ {
+		segment := data[i*overflowSegmentSize:]
+		if len(segment) > overflowSegmentSize {
+			segment = segment[:overflowSegmentSize]
+		}
+
+		sOffset, err := mm.Allocate(uint64(len(segment)), false)
+		if err != nil {
+			aPtr.Release(mm)
+			return nil, err
+		}
+		aPtr.segments(mm)[i] = sOffset
+		copy(aPtr.segment(mm, i), segment)
+	}
+
+	return aPtr, nil
+}
+
 func newBytesFromSlice(mm balloc.MemoryManager, data []byte) *ByteArray {
-	aPtr, a, err := newBytes(mm, uint32(len(data)))
+	aPtr, err := allocBytes(mm, data)
 	if err != nil {
 		panic(fmt.Sprintf("%s (allocating: %d bytes, used: %d, free: %d)", err, len(data), mm.GetUsed(), mm.GetFree()))
 	}
+	return aPtr
+}
+
+// allocBytes stores a copy of data, returning an error when it can not be
+// allocated
+func allocBytes(mm balloc.MemoryManager, data []byte) (*ByteArray, error) {
+	if len(data) > overflowSegmentSize {
+		return newOverflowBytes(mm, data)
+	}
+
+	aPtr, a, err := newBytes(mm, uint32(len(data)))
+	if err != nil {
+		return nil, err
+	}
 	copy(a, data)
 
-	return aPtr
+	return aPtr, nil
 }
 
 func (bPtr *ByteArray) cloneBytes(mm balloc.MemoryManager) (*ByteArray, error) {
+	if bPtr.isInline() {
+		newBPtr := *bPtr
+		return &newBPtr, nil
+	}
+	if bPtr.isOverflow() {
+		return newOverflowBytes(mm, bPtr.getBytes(mm))
+	}
+
 	newBPtr, newB, err := newBytes(mm, bPtr.Size)
 	if err != nil {
 		return nil, err
@@ -54,32 +125,106 @@ func (bPtr *ByteArray) cloneBytes(mm balloc.MemoryManager) (*ByteArray, error) {
 }
 
 func checkBytesLength(data []byte) error {
-	if uint64(unsafe.Sizeof(int(0))+uintptr(len(data))) > maxDataSize {
-		// if len(data) > maxDataSize {
+	if len(data) > maxValueSize {
 		return ErrInvalidSize
 	}
 	return nil
 }
 
 func (b *ByteArray) checkBytesLength() error {
-	if uint64(unsafe.Sizeof(int(0))+uintptr(b.Size)) > maxDataSize {
-		// if len(data) > maxDataSize {
+	if b.Size > maxValueSize {
 		return ErrInvalidSize
 	}
 	return nil
 }
 
+// segments returns the segment offsets of an overflow array
+func (b *ByteArray) segments(mm balloc.MemoryManager) []uint64 {
+	count := (int(b.Size) + overflowSegmentSize - 1) / overflowSegmentSize
+	return (*[maxValueSize / overflowSegmentSize]uint64)(mm.GetPtr(b.Offset + bytesPreambleSize))[:count:count]
+}
+
+// segment returns the bytes of the i-th segment of an overflow array
+func (b *ByteArray) segment(mm balloc.MemoryManager, i int) []byte {
+	size := int(b.Size) - i*overflowSegmentSize
+	if size > overflowSegmentSize {
+		size = overflowSegmentSize
+	}
+	return (*[overflowSegmentSize]byte)(mm.GetPtr(b.segments(mm)[i]))[:size:size]
+}
+
+// readAt copies the bytes starting at off to p, reading at most one
+// overflow segment
+func (b *ByteArray) readAt(mm balloc.MemoryManager, p []byte, off uint32) int {
+	if b.isOverflow() {
+		i := int(off) / overflowSegmentSize
+		return copy(p, b.segment(mm, i)[int(off)-i*overflowSegmentSize:])
+	}
+	return copy(p, b.getBytes(mm)[off:])
+}
+
+// getBytes returns the bytes of the array, in place unless it is an
+// overflow array, which is assembled in a new slice
 func (b *ByteArray) getBytes(mm balloc.MemoryManager) []byte {
-	//println("getBytes", b.Offset, "of count", *b.getBytesRefCount(mm), "value:", string((*[0x7fffff]byte)(mm.GetPtr(b.Offset + uint64(unsafe.Sizeof(int(0)))))[:b.Size]))
-	return (*[maxDataSize]byte)(mm.GetPtr(b.Offset + uint64(unsafe.Sizeof(int(0)))))[:b.Size]
+	if b.isInline() {
+		return (*[maxInlineSize]byte)(unsafe.Pointer(&b.Offset))[:b.Size:b.Size]
+	}
+	if b.isOverflow() {
+		data := make([]byte, b.Size)
+		for i := range b.segments(mm) {
+			copy(data[i*overflowSegmentSize:], b.segment(mm, i))
+		}
+		return data
+	}
+	//println("getBytes", b.Offset, "of count", *b.getBytesRefCount(mm), "value:", string((*[0x7fffff]byte)(mm.GetPtr(b.Offset + bytesPreambleSize))[:b.Size]))
+	return (*[maxDataSize]byte)(mm.GetPtr(b.Offset + bytesPreambleSize))[:b.Size]
+}
+
+// commonPrefix returns the length of the common prefix of the array and s,
+// comparing overflow arrays in place one segment at a time
+func (b *ByteArray) commonPrefix(mm balloc.MemoryManager, s []byte) int {
+	if !b.isOverflow() {
+		return longestPrefix(s, b.getBytes(mm))
+	}
+	n := 0
+	for i := range b.segments(mm) {
+		segment := b.segment(mm, i)
+		l := longestPrefix(s[n:], segment)
+		n += l
+		if l < len(segment) {
+			break
+		}
+	}
+	return n
+}
+
+// isPrefixOf reports whether s begins with the array
+func (b *ByteArray) isPrefixOf(mm balloc.MemoryManager, s []byte) bool {
+	if !b.isOverflow() {
+		return bytes.HasPrefix(s, b.getBytes(mm))
+	}
+	return int(b.Size) <= len(s) && b.commonPrefix(mm, s) == int(b.Size)
+}
+
+// hasPrefix reports whether the array begins with p
+func (b *ByteArray) hasPrefix(mm balloc.MemoryManager, p []byte) bool {
+	return len(p) <= int(b.Size) && b.commonPrefix(mm, p) == len(p)
 }
 
 func (b *ByteArray) getBytesRefCount(mm balloc.MemoryManager) *int32 {
 	return (*int32)(mm.GetPtr(b.Offset))
 }
 
+// refCount returns the reference count, inline arrays are not shared
+func (b *ByteArray) refCount(mm balloc.MemoryManager) int32 {
+	if b.isInline() {
+		return 1
+	}
+	return *b.getBytesRefCount(mm)
+}
+
 func (b *ByteArray) Retain(mm balloc.MemoryManager) {
-	if b.Offset == 0 {
+	if b.Offset == 0 || b.isInline() || balloc.IsReadOnly(mm) {
 		return
 	}
 	//println("Retain", b.Offset, "of count", *b.getBytesRefCount(mm), string(b.getBytes(mm)))
@@ -90,14 +235,24 @@ func (b *ByteArray) Retain(mm balloc.MemoryManager) {
 }
 
 func (b *ByteArray) Release(mm balloc.MemoryManager) {
+	if b.isInline() {
+		*b = ByteArray{}
+		return
+	}
 	if b.Offset == 0 {
 		return
 	}
+	if balloc.IsReadOnly(mm) {
+		*b = ByteArray{}
+		return
+	}
 
 	count := b.getBytesRefCount(mm)
 
 	if atomic.AddInt32(count, -1) == 0 {
-		if err := mm.Deallocate(b.Offset, uint64(b.Size)+uint64(unsafe.Sizeof(int(0)))); err != nil {
+		if b.isOverflow() {
+			b.releaseSegments(mm)
+		} else if err := mm.Deallocate(b.Offset, uint64(b.Size)+bytesPreambleSize); err != nil {
 			panic(err)
 		}
 		//bytesCount--
@@ -106,4 +261,58 @@ func (b *ByteArray) Release(mm balloc.MemoryManager) {
 
 	b.Offset = 0
 	b.Size = 0
+	b.flags = 0
+}
+
+func (b *ByteArray) releaseSegments(mm balloc.MemoryManager) {
+	segments := b.segments(mm)
+	for i, sOffset := range segments {
+		if sOffset == 0 {
+			continue
+		}
+		if err := mm.Deallocate(sOffset, uint64(len(b.segment(mm, i)))); err != nil {
+			panic(err)
+		}
+	}
+	if err := mm.Deallocate(b.Offset, bytesPreambleSize+uint64(len(segments))*8); err != nil {
+		panic(err)
+	}
+}
+
+// byteArrayReader streams the bytes of an array. It holds a reference to the
+// array until it is closed, or to the root of its snapshot when the array
+// can not be retained, as in read-only mappings.
+type byteArrayReader struct {
+	mm   balloc.MemoryManager
+	b    ByteArray
+	pos  uint32
+	snap *Snapshot
+}
+
+func (r *byteArrayReader) Read(p []byte) (int, error) {
+	r.mm.Lock()
+	defer r.mm.Unlock()
+
+	if r.pos >= r.b.Size {
+		return 0, io.EOF
+	}
+
+	n := r.b.readAt(r.mm, p, r.pos)
+	r.pos += uint32(n)
+
+	return n, nil
+}
+
+// Close releases the array, reading after it returns io.EOF
+func (r *byteArrayReader) Close() error {
+	r.mm.Lock()
+	r.b.Release(r.mm)
+	r.pos = 0
+	r.mm.Unlock()
+
+	if r.snap != nil {
+		r.snap.Release()
+		r.snap = nil
+	}
+	return nil
 }
@@ -1,16 +1,62 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/ebakus/ebakusdb"
 	"github.com/urfave/cli/altsrc"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
+// newCipher creates a cipher from a hex encoded key
+func newCipher(hexKey string) (*ebakusdb.Cipher, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key: %s", err)
+	}
+	return ebakusdb.NewCipher(key)
+}
+
+func dbOptions(c *cli.Context) (*ebakusdb.Options, error) {
+	options := *ebakusdb.DefaultOptions
+	if key := c.String("key"); key != "" {
+		cipher, err := newCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		options.Cipher = cipher
+	}
+	return &options, nil
+}
+
+func openDB(c *cli.Context) (*ebakusdb.DB, error) {
+	options, err := dbOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return ebakusdb.Open(c.String("dbpath"), 0, options)
+}
+
+// inspectDB opens the database read-only and as it is, without upgrading
+// older files or taking the lock of the writer
+func inspectDB(c *cli.Context) (*ebakusdb.DB, error) {
+	options, err := dbOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	options.ReadOnly = true
+	options.NoUpgrade = true
+
+	return ebakusdb.Open(c.String("dbpath"), 0, options)
+}
+
 func infoCmd(c *cli.Context) error {
-	db, err := ebakusdb.Open(c.String("dbpath"), 0, nil)
+	db, err := inspectDB(c)
 	if err != nil || db == nil {
 		return err
 	}
@@ -18,16 +64,102 @@ func infoCmd(c *cli.Context) error {
 
 	i := db.GetInfo()
 
+	if c.Bool("json") {
+		out, err := json.MarshalIndent(i, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	s := i.Allocator
+
 	fmt.Println("  DB Info ")
 	fmt.Println("=================================")
 	fmt.Printf(" Path       : %s\n", i.Path)
+	fmt.Printf(" Version    : %d\n", i.Version)
+	fmt.Printf(" Features   : %s\n", strings.Join(i.Features, ", "))
 	fmt.Printf(" Capacity   : %d\n", i.TotalCapacity)
 	fmt.Printf(" Used       : %d (%.1f%%)\n", i.TotalUsed, float64(i.TotalUsed)/float64(i.TotalCapacity)*100.0)
+	fmt.Printf("   Nodes    : %d (%d nodes)\n", s.NodesUsed, i.Nodes)
+	fmt.Printf("   Data     : %d\n", s.DataUsed)
 	fmt.Printf(" Watermark  : %d (%.1f%%)\n", i.Watermark, float64(i.Watermark)/float64(i.TotalCapacity)*100.0)
 	fmt.Printf(" Page size  : %d\n", i.PageSize)
+	fmt.Printf(" Fragmented : %.1f%%\n", i.Fragmentation*100.0)
 	fmt.Println("=================================")
+	fmt.Printf(" Free chunks: %d\n", s.FreeChunks)
+	fmt.Printf(" Free space : %d\n", s.FreeSpace)
+	fmt.Printf(" Largest run: %d\n", s.LargestFreeRun)
+	fmt.Printf(" Reclaimable: %d\n", s.Reclaimable)
+	for p, count := range s.FreeHistogram {
+		if count != 0 {
+			fmt.Printf("   %6d+ pages: %d\n", 1<<uint(p), count)
+		}
+	}
+	fmt.Println("=================================")
+
+	return nil
+}
+
+func rekeyCmd(c *cli.Context) error {
+	var next *ebakusdb.Cipher
+	if key := c.String("newkey"); key != "" {
+		var err error
+		if next, err = newCipher(key); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(c)
+	if err != nil || db == nil {
+		return err
+	}
+	defer db.Close()
 
-	db.PrintFreeChunks()
+	if err := db.Rekey(next); err != nil {
+		return err
+	}
+
+	if next == nil {
+		fmt.Println("Database decrypted")
+	} else {
+		fmt.Println("Database encrypted with the new key")
+	}
+
+	return nil
+}
+
+func upgradeCmd(c *cli.Context) error {
+	options, err := dbOptions(c)
+	if err != nil {
+		return err
+	}
+	options.NoUpgrade = true
+
+	db, err := ebakusdb.Open(c.String("dbpath"), 0, options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	steps, err := db.Upgrade(c.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+
+	if len(steps) == 0 {
+		fmt.Println("Database is up to date")
+		return nil
+	}
+	for _, s := range steps {
+		fmt.Printf(" %d -> %d: %s\n", s.From, s.To, s.Description)
+	}
+	if c.Bool("dry-run") {
+		fmt.Println("Database not changed")
+	} else {
+		fmt.Println("Database upgraded")
+	}
 
 	return nil
 }
@@ -55,16 +187,55 @@ func main() {
 			Name:  "dbhost",
 			Value: "localhost",
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "key",
+			Usage: "Hex encoded AES key of an encrypted database",
+			Value: "",
+		}),
 	}
 
+	infoFlags := append(genericFlags,
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the information as JSON",
+		}),
+	)
+
+	rekeyFlags := append(genericFlags,
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "newkey",
+			Usage: "Hex encoded AES key to encrypt with, empty to decrypt",
+			Value: "",
+		}),
+	)
+
+	upgradeFlags := append(genericFlags,
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the upgrade steps without changing the database",
+		}),
+	)
+
 	app.Commands = []cli.Command{
 		{
 			Name:    "info",
 			Aliases: []string{"i"},
 			Usage:   "Print db information",
-			Flags:   genericFlags,
+			Flags:   infoFlags,
 			Action:  infoCmd,
 		},
+		{
+			Name:   "rekey",
+			Usage:  "Encrypt the database with a new key",
+			Flags:  rekeyFlags,
+			Action: rekeyCmd,
+		},
+		{
+			Name:   "upgrade",
+			Usage:  "Upgrade the database to the current file format",
+			Flags:  upgradeFlags,
+			Action: upgradeCmd,
+		},
 	}
 
 	app.Run(os.Args)
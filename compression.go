@@ -0,0 +1,162 @@
+package ebakusdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+)
+
+// Compressor compresses values before they are stored. The id of the
+// compressor is stored with every value it compressed, so it has to stay the
+// same across versions. Id 0 means uncompressed data.
+type Compressor interface {
+	ID() uint8
+	Compress(src []byte) []byte
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	compressorsMux sync.RWMutex
+	compressors    = make(map[uint8]Compressor)
+)
+
+// RegisterCompressor makes a compressor available for reading the values it
+// compressed. Compressors passed in the options or to tables are registered
+// automatically. Compressors of the same type share their id, any of them
+// decompresses what the others compressed.
+func RegisterCompressor(c Compressor) error {
+	if c.ID() == 0 {
+		return fmt.Errorf("Compressor id 0 is reserved")
+	}
+
+	compressorsMux.Lock()
+	defer compressorsMux.Unlock()
+
+	if old, ok := compressors[c.ID()]; ok {
+		if reflect.TypeOf(old) != reflect.TypeOf(c) {
+			return fmt.Errorf("Compressor id %d already registered", c.ID())
+		}
+		return nil
+	}
+	compressors[c.ID()] = c
+
+	return nil
+}
+
+func getCompressor(id uint8) (Compressor, error) {
+	compressorsMux.RLock()
+	defer compressorsMux.RUnlock()
+
+	c, ok := compressors[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compressor id %d", id)
+	}
+	return c, nil
+}
+
+// FlateCompressor compresses with DEFLATE at the best speed level
+var FlateCompressor Compressor = flateCompressor{}
+
+type flateCompressor struct{}
+
+func (flateCompressor) ID() uint8 {
+	return 1
+}
+
+func (flateCompressor) Compress(src []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (flateCompressor) Decompress(src []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(src)))
+}
+
+func init() {
+	RegisterCompressor(FlateCompressor)
+}
+
+// compressorFor returns the compressor of the longest matching prefix
+// configured in the options, or nil
+func (db *DB) compressorFor(k []byte) Compressor {
+	var c Compressor
+	longest := -1
+	for prefix, pc := range db.compression {
+		if len(prefix) > longest && bytes.HasPrefix(k, []byte(prefix)) {
+			c = pc
+			longest = len(prefix)
+		}
+	}
+	return c
+}
+
+// setFlag sets a header flag under the write lock, as writers holding the
+// read lock may be reading the flags
+func (db *DB) setFlag(flag uint32) {
+	db.allocator.WLock()
+	db.header.flags |= flag
+	db.allocator.WUnlock()
+}
+
+// newValue stores a value, compressed when c is set and it saves space and
+// encrypted when the database has a cipher
+func (db *DB) newValue(data []byte, c Compressor) (*ByteArray, error) {
+	return db.newCipherValue(db.cipher, data, c)
+}
+
+// newCipherValue is newValue encrypting with cipher, which differs from the
+// cipher of the database while it is rekeyed
+func (db *DB) newCipherValue(cipher *Cipher, data []byte, c Compressor) (*ByteArray, error) {
+	var codec uint8
+	if c != nil {
+		if compressed := c.Compress(data); len(compressed) < len(data) {
+			data = compressed
+			codec = c.ID()
+		}
+	}
+
+	if cipher != nil {
+		data = encryptValue(cipher, data)
+	}
+
+	b, err := allocBytes(db.allocator, data)
+	if err != nil {
+		return nil, err
+	}
+	b.setCodec(codec)
+	b.setEncrypted(cipher != nil)
+	return b, nil
+}
+
+// getValue returns the bytes of a value, decrypting and decompressing them
+// if needed. Values written with another key or corrupted in the file fail.
+func (db *DB) getValue(b *ByteArray) ([]byte, error) {
+	data := b.getBytes(db.allocator)
+
+	var err error
+	if b.isEncrypted() {
+		if data, err = decryptValue(db.cipher, data); err != nil {
+			return nil, fmt.Errorf("Failed to decrypt value: %s", err)
+		}
+	}
+
+	if b.codec() == 0 {
+		return data, nil
+	}
+
+	c, err := getCompressor(b.codec())
+	if err != nil {
+		return nil, err
+	}
+	data, err = c.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress value: %s", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,455 @@
+package ebakusdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrRootsInUse is returned by Rekey while snapshots or followers use roots
+// of the database that it would leave with the old cipher
+var ErrRootsInUse = errors.New("Rekey needs all the snapshots released and no followers")
+
+// Cipher encrypts a database. The values are sealed with AES-GCM and the
+// keys, when they are encrypted, with a secret, both derived from the key
+// given to NewCipher.
+type Cipher struct {
+	aead   cipher.AEAD
+	secret []byte
+}
+
+// NewCipher creates a cipher from a key of 16, 24 or 32 bytes
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(hkdf(key, "ebakusdb values", len(key)))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{
+		aead:   aead,
+		secret: hkdf(key, "ebakusdb keys", sha256.Size),
+	}, nil
+}
+
+// hkdf derives size bytes for info from key, by HKDF with SHA-256 and no
+// salt (RFC 5869)
+func hkdf(key []byte, info string, size int) []byte {
+	mac := hmac.New(sha256.New, make([]byte, sha256.Size))
+	mac.Write(key)
+	prk := mac.Sum(nil)
+
+	var out, t []byte
+	for i := byte(1); len(out) < size; i++ {
+		mac = hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write([]byte(info))
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:size]
+}
+
+// cipherCheck identifies the cipher in the header, to detect wrong keys
+func cipherCheck(secret []byte) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("ebakusdb cipher check"))
+	return binary.LittleEndian.Uint64(mac.Sum(nil))
+}
+
+// cryptKey encrypts or decrypts a key one byte at a time. Every byte is
+// mapped to two by a strictly increasing function, which is drawn from
+// a pad derived from the plain bytes before it. Keys with a common prefix
+// have a common encrypted prefix and encrypted keys sort like the plain
+// ones, so lookups, SeekPrefix and ordered iteration keep working. Equal
+// keys, common prefixes and the order of the keys are visible in the
+// file, as well as a rough idea of every byte value.
+func cryptKey(secret, k []byte, decrypt bool) []byte {
+	n := len(k)
+	if decrypt {
+		n = len(k) / 2
+	}
+	plain := make([]byte, n)
+	enc := make([]byte, n*2)
+	if decrypt {
+		copy(enc, k)
+	} else {
+		copy(plain, k)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	pad := mac.Sum(nil)
+	for i := 0; i < n; i++ {
+		if decrypt {
+			plain[i] = keyPlain(pad, binary.BigEndian.Uint16(enc[i*2:]))
+		} else {
+			binary.BigEndian.PutUint16(enc[i*2:], keyCode(pad, plain[i]))
+		}
+
+		next := sha256.Sum256(append(pad, 'k', plain[i]))
+		pad = next[:]
+	}
+
+	if decrypt {
+		return plain
+	}
+	return enc
+}
+
+// keyCode returns the code of byte b after pad. The codes are the sums of
+// the gaps 1 to 256 drawn from the pad, minus one, so they increase with b
+// and fit in 16 bits.
+func keyCode(pad []byte, b byte) uint16 {
+	var code uint16
+	keyGaps(pad, func(i int, c uint16) bool {
+		code = c
+		return i < int(b)
+	})
+	return code
+}
+
+// keyPlain returns the byte of code c after pad, the smallest one whose
+// code is not below c
+func keyPlain(pad []byte, c uint16) byte {
+	var b byte
+	keyGaps(pad, func(i int, code uint16) bool {
+		b = byte(i)
+		return code < c
+	})
+	return b
+}
+
+// keyGaps calls fn with the codes of the bytes after pad, from byte 0 up,
+// while it returns true
+func keyGaps(pad []byte, fn func(i int, code uint16) bool) {
+	var in [sha256.Size + 2]byte
+	var block [sha256.Size]byte
+	copy(in[:], pad)
+	in[sha256.Size] = 'g'
+
+	code := uint16(0xffff)
+	for i := 0; i < 256; i++ {
+		if i%sha256.Size == 0 {
+			in[sha256.Size+1] = byte(i / sha256.Size)
+			block = sha256.Sum256(in[:])
+		}
+		code += 1 + uint16(block[i%sha256.Size])
+		if !fn(i, code) {
+			return
+		}
+	}
+}
+
+func (db *DB) encryptKey(k []byte) []byte {
+	if db.keySecret == nil {
+		return k
+	}
+	return cryptKey(db.keySecret, k, false)
+}
+
+func (db *DB) decryptKey(k []byte) []byte {
+	if db.keySecret == nil {
+		return k
+	}
+	return cryptKey(db.keySecret, k, true)
+}
+
+// rootKey converts a key of the root trie to its edge labels
+func (db *DB) rootKey(k []byte) []byte {
+	return db.encodeKey(db.encryptKey(k))
+}
+
+// tableKey converts a row or index key of a table to its edge labels. They
+// are encrypted like the keys of the root trie, whose scheme keeps the
+// order the indexes need.
+func (db *DB) tableKey(k []byte) []byte {
+	return db.encodeKey(db.encryptKey(k))
+}
+
+// encryptValue seals data with a random nonce, which is stored before it
+func encryptValue(c *Cipher, data []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return c.aead.Seal(nonce, nonce, data, nil)
+}
+
+func decryptValue(c *Cipher, data []byte) ([]byte, error) {
+	if c == nil {
+		return nil, ErrCipherRequired
+	}
+	if len(data) < c.aead.NonceSize() {
+		return nil, ErrWrongCipher
+	}
+	return c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], nil)
+}
+
+// initCipher checks the cipher against the header and enables encryption of
+// new values
+func (db *DB) initCipher() error {
+	if db.cipher == nil {
+		if db.header.flags&(flagEncryption|flagEncryptedKeys) != 0 {
+			return ErrCipherRequired
+		}
+		return nil
+	}
+
+	secret := db.cipher.secret
+	check := cipherCheck(secret)
+	if db.header.flags&flagEncryption != 0 && db.header.cipherCheck != check {
+		return ErrWrongCipher
+	}
+	if !db.readOnly {
+		db.header.flags |= flagEncryption
+		db.header.cipherCheck = check
+	}
+
+	if db.header.flags&flagEncryptedKeys != 0 {
+		db.keySecret = secret
+	}
+
+	return nil
+}
+
+// Rekey encrypts the database with a new cipher, or decrypts it when c is
+// nil. Databases with encrypted keys always need a cipher. The tries of the
+// root, the tables and the indexes are built again under a new root, with
+// the values encrypted again and the keys too when they are encrypted, and
+// the old root is only released once all of it is written, so a failure
+// leaves the database with its old cipher. Nothing else may use the
+// database while it runs, and it fails with ErrRootsInUse while snapshots
+// or followers use other roots.
+func (db *DB) Rekey(c *Cipher) error {
+	if c == nil && db.keySecret != nil {
+		return fmt.Errorf("Database with encrypted keys needs a cipher")
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := db.growFor(db.allocator.GetUsed()); err != nil {
+		return err
+	}
+
+	mm := db.allocator
+	mm.Lock()
+	defer mm.Unlock()
+
+	if !db.onlyRoot() {
+		return ErrRootsInUse
+	}
+
+	// The values are encrypted again into new arrays, the old ones are
+	// left untouched for the database to keep its old cipher on failure
+	reencrypt := func(b *ByteArray) (ByteArray, error) {
+		if b.isNull() {
+			return *b, nil
+		}
+
+		data := b.getBytes(mm)
+		if b.isEncrypted() {
+			var err error
+			if data, err = decryptValue(db.cipher, data); err != nil {
+				return ByteArray{}, err
+			}
+		}
+		if c != nil {
+			data = encryptValue(c, data)
+		}
+
+		nb, err := allocBytes(mm, data)
+		if err != nil {
+			return ByteArray{}, err
+		}
+		nb.setCodec(b.codec())
+		nb.setEncrypted(c != nil)
+		return *nb, nil
+	}
+
+	// The entries of every trie, the root and those of the tables and
+	// indexes, by the pointer of the trie
+	type trieEntry struct {
+		key  []byte
+		leaf *nodeLeaf
+	}
+	entries := make(map[Ptr][]trieEntry)
+
+	visited := make(map[Ptr]bool)
+	var walk func(nPtr Ptr, key []byte, trie Ptr)
+	walk = func(nPtr Ptr, key []byte, trie Ptr) {
+		if nPtr.isNull() || visited[nPtr] {
+			return
+		}
+		visited[nPtr] = true
+
+		n := nPtr.getNode(mm)
+		key = concat(key, n.prefixPtr.getBytes(mm))
+
+		if n.isLeaf() {
+			l := n.leaf()
+			walk(l.nodePtr, nil, l.nodePtr)
+			entries[trie] = append(entries[trie], trieEntry{key: key, leaf: l})
+		}
+
+		for _, e := range n.edgeList() {
+			walk(e.node, key, trie)
+		}
+	}
+	walk(db.header.root, nil, db.header.root)
+
+	var secret []byte
+	if c != nil {
+		secret = c.secret
+	}
+
+	// Encrypted keys change with the secret, plain keys are kept
+	oldSecret := db.keySecret
+	var newSecret []byte
+	if oldSecret != nil {
+		newSecret = secret
+	}
+
+	// The tries are built again under a new root, those of the tables and
+	// indexes first, as their values hold the roots of their tries
+	var rebuild func(trie Ptr) (Ptr, error)
+	rebuild = func(trie Ptr) (Ptr, error) {
+		rootPtr, _, err := newNode(mm, nodeKind0)
+		if err != nil {
+			return 0, err
+		}
+		s := &Snapshot{db: db, root: *rootPtr}
+
+		for _, e := range entries[trie] {
+			k := db.decodeKey(e.key)
+			if oldSecret != nil {
+				k = cryptKey(oldSecret, k, true)
+			}
+			ek := k
+			if newSecret != nil {
+				ek = cryptKey(newSecret, k, false)
+			}
+			ek = db.encodeKey(ek)
+
+			var val ByteArray
+			sub := e.leaf.nodePtr
+			if sub.isNull() {
+				val, err = reencrypt(&e.leaf.valPtr)
+			} else {
+				if sub, err = rebuild(sub); err != nil {
+					s.root.NodeRelease(mm)
+					return 0, err
+				}
+				var v []byte
+				var b *ByteArray
+				if v, err = db.getValue(&e.leaf.valPtr); err == nil {
+					if b, err = db.trieValue(k, v, sub, c); err == nil {
+						val = *b
+					}
+				}
+			}
+			if err != nil {
+				if !sub.isNull() {
+					sub.NodeRelease(mm)
+				}
+				s.root.NodeRelease(mm)
+				return 0, err
+			}
+
+			newRoot, _, _, err := s.insert(&s.root, ek, ek, val, sub)
+			val.Release(mm)
+			if !sub.isNull() {
+				sub.NodeRelease(mm)
+			}
+			if err != nil {
+				s.root.NodeRelease(mm)
+				return 0, err
+			}
+			if newRoot != nil {
+				s.root.NodeRelease(mm)
+				s.root = *newRoot
+			}
+		}
+
+		return s.root, nil
+	}
+
+	root, err := rebuild(db.header.root)
+	if err != nil {
+		return err
+	}
+
+	db.header.root.NodeRelease(mm)
+	db.header.root = root
+
+	db.cipher = c
+	db.keySecret = newSecret
+	if c != nil {
+		db.header.flags |= flagEncryption
+		db.header.cipherCheck = cipherCheck(secret)
+	} else {
+		db.header.flags &^= flagEncryption
+		db.header.cipherCheck = 0
+	}
+
+	return nil
+}
+
+// trieValue returns a new value encrypted with c for the table or index of
+// key k, whose value was v, with root as the root of its trie
+func (db *DB) trieValue(k, v []byte, root Ptr, c *Cipher) (*ByteArray, error) {
+	var data []byte
+	var err error
+	if bytes.HasPrefix(k, getTableKey("")) {
+		var tbl Table
+		if err = db.decode(v, &tbl); err != nil {
+			return nil, err
+		}
+		tbl.Node = root
+		data, err = db.encode(tbl)
+	} else {
+		data, err = db.encode(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db.newCipherValue(c, data, db.compressorFor(k))
+}
+
+// onlyRoot tells if the root of the header is the only root in use: no
+// snapshot retains it, no follower leases a root and all the nodes are
+// reachable from it, so no other root was retained, even by an earlier
+// process
+func (db *DB) onlyRoot() bool {
+	mm := db.allocator
+
+	if db.header.root.getNode(mm).refCount != 1 {
+		return false
+	}
+	if t := db.leases(); t != nil {
+		if t.retired != 0 {
+			return false
+		}
+		for i := range t.leases {
+			if atomic.LoadUint64(&t.leases[i].root) != 0 {
+				return false
+			}
+		}
+	}
+
+	var space uint64
+	db.walkNodes(func(nPtr Ptr, n *Node) {
+		space += mm.NodeSpace(uint64(nPtr), n.kind.size())
+	})
+	return space == mm.Stats().NodesUsed
+}
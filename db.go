@@ -4,7 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/ebakus/ebakusdb/balloc"
@@ -12,54 +17,279 @@ import (
 
 var (
 	ErrFailedToCreateDB = errors.New("Failed to create database")
-	ErrDirtyDB          = errors.New("Dirty database found")
+	ErrLocked           = errors.New("Database is locked by another process")
+
+	// Deprecated: ErrDirtyDB is no longer returned, databases are locked
+	// instead of guarded by a file
+	ErrDirtyDB        = errors.New("Dirty database found")
+	ErrCipherRequired = errors.New("Database is encrypted, a cipher is required")
+	ErrWrongCipher    = errors.New("Cipher does not match the database")
+	ErrDatabaseFull   = errors.New("Database reached its maximum size")
+	ErrReadOnly       = errors.New("Database is read-only")
+)
+
+// RadixMode selects how keys are split into trie edges
+type RadixMode uint8
+
+const (
+	// Radix16 splits every key byte in two nibbles, nodes have up to 16 edges
+	Radix16 RadixMode = iota
+	// Radix256 uses the key bytes as they are, nodes have up to 256 edges
+	Radix256
+)
+
+// MmapAdvice is the access pattern the kernel is advised of for the mapping
+// of a database file
+type MmapAdvice uint8
+
+const (
+	// AdviceRandom reads only the pages accessed, for lookups in large
+	// databases. Full scans advise sequential access while they run.
+	AdviceRandom MmapAdvice = iota
+	// AdviceNormal uses the read ahead of the kernel
+	AdviceNormal
+	// AdviceSequential reads ahead aggressively
+	AdviceSequential
+	// AdviceWillNeed reads the whole file in the background when mapped
+	AdviceWillNeed
 )
 
 type Options struct {
-	// Open database in read-only mode.
+	// Open database in read-only mode. The file is mapped read-only and
+	// locked shared, so it can be read by many processes while none writes
+	// to it. Changes fail with ErrReadOnly.
 	ReadOnly bool
+
+	// Follow opens the database read-only while a writer in another
+	// process, opened with Followers, changes it. Snapshots see the root
+	// the writer last set, and what they read is kept until released. The
+	// file is not locked and has to be writable, for the snapshots to
+	// lease their roots.
+	Follow bool
+
+	// Followers keeps a table of the roots leased by processes opening the
+	// database with Follow, whose roots are not freed while leased. Leases
+	// need locks only Linux has, elsewhere both fail with
+	// ErrLeasesUnsupported.
+	Followers bool
+
+	// NoUpgrade opens files of older versions without converting them, so
+	// that DB.Upgrade can list the steps it takes before running them.
+	// Until it runs nothing but Upgrade and Close may be used.
+	NoUpgrade bool
+
+	// LockTimeout is how long Open waits for other processes to release
+	// the lock of the file before failing with ErrLocked. Zero fails at
+	// once and negative waits indefinitely.
+	LockTimeout time.Duration
+
+	// Radix of the trie, only used when creating a new database.
+	Radix RadixMode
+
+	// Do not store the full key in leaf nodes, iterators rebuild it from
+	// the node prefixes. Only used when creating a new database.
+	OmitLeafKeys bool
+
+	// Compress the values of keys starting with the given prefixes, the
+	// longest matching prefix is used. Tables are configured when created.
+	Compression map[string]Compressor
+
+	// Encrypt the values with the cipher, see NewCipher. Values written
+	// before a cipher was used stay readable, DB.Rekey encrypts them.
+	Cipher *Cipher
+
+	// Encrypt the keys, with the rows and index entries of the tables,
+	// deterministically and keeping their order, so that lookups,
+	// SeekPrefix, iteration and the indexes keep working. The order of
+	// the keys, their common prefixes and roughly their byte values stay
+	// visible in the file, and keys take twice the space. Needs a Cipher
+	// and is only used when creating a new database.
+	EncryptKeys bool
+
+	// SegmentSize makes OpenInMemory keep the database in segments of this
+	// size on the heap, which are added as it grows instead of copying it
+	// to a larger buffer. Values and nodes can not be larger than a segment.
+	SegmentSize uint64
+
+	// MapSize is the address space reserved when mapping a database file.
+	// The file grows in it without being mapped again, so readers are not
+	// stopped. Zero reserves MaxSize, or 64GB when it is not limited.
+	MapSize uint64
+
+	// MmapAdvice is the access pattern advised for the mapping of a file
+	MmapAdvice MmapAdvice
+
+	// InitialSize is the size of a new database, rounded up to a kilobyte.
+	// Zero creates files of 1MB and in memory databases of 16MB.
+	InitialSize uint64
+
+	// GrowthFunc returns the size a database of the given capacity grows
+	// to. It is called again until enough space is free. Nil doubles the
+	// size up to 1GB and then adds 1GB at a time.
+	GrowthFunc func(capacity uint64) uint64
+
+	// MaxSize limits the size of the database. Changes which do not fit
+	// fail with ErrDatabaseFull. Zero does not limit it.
+	MaxSize uint64
+
+	// GrowThreshold is the share of the database kept free, it grows when
+	// an allocation would leave less. Zero keeps 30% free.
+	GrowThreshold float64
+
+	// Logger receives the diagnostics of the database, nil discards them
+	Logger Logger
+
+	// Metrics receives the measurements of the database, nil measures
+	// nothing
+	Metrics Metrics
 }
 
 // DefaultOptions for the DB
 var DefaultOptions = &Options{
 	ReadOnly: false,
+	Radix:    Radix16,
 }
 
 type DBEncoder func(val interface{}) ([]byte, error)
 type DBDecoder func(b []byte, val interface{}) error
 
 type DB struct {
-	readOnly bool
+	readOnly     bool
+	noUpgrade    bool
+	followers    bool
+	radix        RadixMode
+	omitLeafKeys bool
+	compression  map[string]Compressor
+	cipher       *Cipher
+	encryptKeys  bool
+	keySecret    []byte
 
 	path string
 	file *os.File
 
+	// mapping is the whole mapping of the file, of which the buffer is the
+	// part within the file
+	mapping  []byte
+	mapSize  uint64
+	growLock sync.Mutex
+
+	// advice is the advice of the mapping, sequential while scans run
+	advice MmapAdvice
+	scans  int
+
+	// follow is set for followers of a writer, which lease the roots of
+	// their snapshots in the lease table mapped at leaseMapping
+	follow       bool
+	leaseMapping []byte
+	leaseLock    sync.Mutex
+	leased       map[Ptr]*localLease
+
+	initialSize   uint64
+	growthFunc    func(capacity uint64) uint64
+	maxSize       uint64
+	growThreshold float64
+
+	// bufferRef and bufferSize change when the buffer grows in place, so
+	// once the database is open they are read under growLock
 	bufferRef  []byte
 	buffer     *[0x9000000000]byte
 	bufferSize uint64
 	header     *header
-	allocator  *balloc.BufferAllocator
+	allocator  allocator
 
 	encode DBEncoder
 	decode DBDecoder
+
+	log     Logger
+	metrics Metrics
+}
+
+// allocator is the memory manager of a database, a balloc.BufferAllocator
+// for files or a balloc.HeapAllocator for segmented in memory databases
+type allocator interface {
+	balloc.MemoryManager
+
+	WLock()
+	WUnlock()
+	GetCapacity() uint64
+	Flush()
+	Stats() balloc.Stats
+	NodeCount() int64
+	NodeSpace(pos, size uint64) uint64
+	FprintFreeChunks(w io.Writer)
+}
+
+// resizableAllocator is an allocator working in the buffer of the
+// database, which is given the new buffer when the database grows
+type resizableAllocator interface {
+	SetBuffer(bufPtr unsafe.Pointer, bufSize uint64, firstFree uint64)
+	Extend(bufSize uint64)
 }
 
 type DBInfo struct {
 	Path          string
+	Version       uint32
+	Features      []string
 	BufferStart   uint32
 	PageSize      uint16
 	Watermark     uint64
 	TotalUsed     uint64
 	TotalCapacity uint64
+
+	// Fragmentation is the share of the space below the watermark that is
+	// free
+	Fragmentation float64
+
+	// Nodes is the number of nodes of the database, kept by the allocator
+	// and counted once when its header is upgraded
+	Nodes int64
+
+	Allocator balloc.Stats
 }
 
 const magic uint32 = 0xff01cf11
-const version uint32 = 1
+const version uint32 = 4
+
+// pageSize is the allocation unit of the buffer allocator
+const pageSize uint16 = 16
+
+// Header flags
+const (
+	flagRadix256 uint32 = 1 << iota
+	flagOmitLeafKeys
+	flagCompression
+	flagEncryption
+	flagEncryptedKeys
+
+	knownFlags = flagRadix256 | flagOmitLeafKeys | flagCompression | flagEncryption | flagEncryptedKeys
+)
+
+// Optional header flags, of features older versions can open files without
+const (
+	compatLeases uint32 = 1 << iota
+
+	knownCompatFlags = compatLeases
+)
 
+// header is the start of a database file, see format.go for its layout
 type header struct {
 	magic   uint32
 	version uint32
 	root    Ptr
+	flags   uint32
+	_       uint32
+
+	cipherCheck uint64
+
+	// Offset of the allocator header, zero when it follows this header
+	allocHeader uint64
+
+	// Offset of the lease table, zero when there is none
+	leases uint64
+
+	compatFlags uint32
+
+	_ [20]byte // reserved
 }
 
 func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
@@ -70,43 +300,87 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	if mode == 0 {
 		mode = 0666
 	}
+	if platformError != nil {
+		return nil, platformError
+	}
 
 	db := &DB{
-		readOnly: options.ReadOnly,
-		encode:   json.Marshal,
-		decode:   json.Unmarshal,
+		readOnly:     options.ReadOnly || options.Follow,
+		noUpgrade:    options.NoUpgrade,
+		follow:       options.Follow,
+		followers:    options.Followers,
+		radix:        options.Radix,
+		omitLeafKeys: options.OmitLeafKeys,
+		compression:  options.Compression,
+		cipher:       options.Cipher,
+		encryptKeys:  options.EncryptKeys,
+		mapSize:      options.MapSize,
+		advice:       options.MmapAdvice,
+		encode:       json.Marshal,
+		decode:       json.Unmarshal,
+		log:          optionsLogger(options),
+		metrics:      options.Metrics,
+	}
+
+	if err := db.setSizes(options, 1*megaByte); err != nil {
+		return nil, err
+	}
+
+	if db.mapSize == 0 {
+		db.mapSize = db.maxSize
+	}
+	if db.mapSize == 0 {
+		db.mapSize = defaultMapSize
+	}
+
+	if db.encryptKeys && db.cipher == nil {
+		return nil, ErrCipherRequired
+	}
+	if db.advice > AdviceWillNeed {
+		return nil, fmt.Errorf("Unknown mmap advice %d", db.advice)
+	}
+
+	for _, c := range options.Compression {
+		if err := RegisterCompressor(c); err != nil {
+			return nil, err
+		}
 	}
 
 	flag := os.O_RDWR
-	if db.readOnly {
+	if db.readOnly && !db.follow {
 		flag = os.O_RDONLY
 	}
 
 	db.path = path
 	var err error
-	var guardFile *os.File
 
-	if guardFile, err = os.OpenFile(db.path+"~", os.O_RDWR, mode); err == nil {
-		fmt.Println("Lock file in place. Database might be corrupted.", guardFile.Name())
-		return nil, ErrDirtyDB
+	if !db.readOnly {
+		flag |= os.O_CREATE
 	}
-
-	if guardFile, err = os.OpenFile(db.path+"~", os.O_CREATE, mode); err != nil {
-		fmt.Println("Failed to create guard file", guardFile.Name())
-		return nil, ErrFailedToCreateDB
+	if db.file, err = os.OpenFile(db.path, flag, mode); err != nil {
+		return nil, err
 	}
 
-	if db.file, err = os.OpenFile(db.path, flag|os.O_CREATE, mode); err != nil {
-		fmt.Println(err)
-		db.Close()
-		return nil, err
+	// Writers lock the file exclusively and readers shared, the lock is
+	// released when the file is closed, even by a killed process. Followers
+	// read it while it is written.
+	if !db.follow {
+		if err := db.flock(options.LockTimeout); err != nil {
+			db.file.Close()
+			return nil, err
+		}
 	}
 
 	info, err := db.file.Stat()
 	if err != nil {
+		db.file.Close()
 		return nil, err
 	}
 	if info.Size() == 0 {
+		if db.readOnly {
+			db.file.Close()
+			return nil, fmt.Errorf("Empty database can not be opened read-only")
+		}
 		db.initNewDBFile()
 	}
 
@@ -114,55 +388,236 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.mmap(int(info.Size()))
+	if err := db.mmap(int(info.Size())); err != nil {
+		db.file.Close()
+		return nil, fmt.Errorf("Failed to map memory error: %s", err)
+	}
 
 	if err := db.init(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	//fmt.Printf("Inited EbakusDB with %d MB of storage\n", info.Size()/megaByte)
+	if db.follow {
+		err = db.initFollower()
+	} else if !db.readOnly && db.allocator != nil {
+		err = db.initLeases(options.Followers)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	db.log.Info("Opened database", "path", db.path, "size", info.Size(), "version", db.header.version, "readonly", db.readOnly)
 
 	return db, nil
 }
 
 func OpenInMemory(options *Options) (*DB, error) {
+	return openInMemory(options, nil)
+}
+
+// OpenInMemoryFrom loads the database file at path to memory. Changes are
+// not written back to it, DB.SaveTo writes them to a file. Snapshot ids
+// stay the same.
+func OpenInMemoryFrom(path string, options *Options) (*DB, error) {
+	image, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(image) == 0 {
+		return nil, fmt.Errorf("Empty database file")
+	}
+	return openInMemory(options, image)
+}
+
+// OpenFromBytes opens the database image b, the contents of a database file
+// or of DB.SaveTo. Read-only databases read b in place, so it must not change
+// while they are open. Otherwise b is copied and changes stay in memory.
+func OpenFromBytes(b []byte, options *Options) (*DB, error) {
 	if options == nil {
 		options = DefaultOptions
 	}
 
+	if err := checkImage(b); err != nil {
+		return nil, err
+	}
+
+	// Images not aligned for the atomic access of the header are copied
+	if !options.ReadOnly || uintptr(unsafe.Pointer(&b[0]))%8 != 0 {
+		b = append([]byte(nil), b...)
+	}
+
+	return openInMemory(options, b)
+}
+
+// OpenReaderAt opens read-only the database image of size bytes read from
+// r, which is read whole to memory
+func OpenReaderAt(r io.ReaderAt, size int64, options *Options) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+
+	if size < 0 {
+		return nil, ErrInvalidSize
+	}
+
+	b := make([]byte, size)
+	n, err := r.ReadAt(b, 0)
+	if int64(n) != size {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("Failed to read database image: %s", err)
+	}
+
+	ro := *options
+	ro.ReadOnly = true
+	return OpenFromBytes(b, &ro)
+}
+
+// checkImage checks that b can be a database image
+func checkImage(b []byte) error {
+	if uint64(len(b)) < uint64(unsafe.Sizeof(header{}))+balloc.HeaderSize || len(b)%8 != 0 {
+		return ErrInvalidSize
+	}
+
+	h := (*header)(unsafe.Pointer(&b[0]))
+	if h.magic != magic {
+		return fmt.Errorf("Not an EbakusDB file")
+	}
+	if h.version == 0 || h.version > version {
+		return fmt.Errorf("EbakusDB file version %d needs a newer EbakusDB, version %d is supported", h.version, version)
+	}
+	if uint64(h.root) >= uint64(len(b)) || h.allocHeader >= uint64(len(b)) {
+		return fmt.Errorf("Corrupted EbakusDB file")
+	}
+
+	return nil
+}
+
+// openInMemory opens a database in memory, from a file image if given
+func openInMemory(options *Options, image []byte) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	if platformError != nil {
+		return nil, platformError
+	}
+
 	db := &DB{
-		readOnly: options.ReadOnly,
-		encode:   json.Marshal,
-		decode:   json.Unmarshal,
+		readOnly:     options.ReadOnly,
+		noUpgrade:    options.NoUpgrade,
+		radix:        options.Radix,
+		omitLeafKeys: options.OmitLeafKeys,
+		compression:  options.Compression,
+		cipher:       options.Cipher,
+		encryptKeys:  options.EncryptKeys,
+		encode:       json.Marshal,
+		decode:       json.Unmarshal,
+		log:          optionsLogger(options),
+		metrics:      options.Metrics,
+	}
+
+	if err := db.setSizes(options, 16*megaByte); err != nil {
+		return nil, err
+	}
+
+	if db.encryptKeys && db.cipher == nil {
+		return nil, ErrCipherRequired
+	}
+
+	for _, c := range options.Compression {
+		if err := RegisterCompressor(c); err != nil {
+			return nil, err
+		}
 	}
 
 	db.path = "memory_buffer"
-	db.initNewDBMemory()
+	if image != nil {
+		if options.SegmentSize != 0 {
+			return nil, fmt.Errorf("Database files can not be loaded to segments")
+		}
+		db.bufferRef = image
+		db.buffer = (*[0x9000000000]byte)(unsafe.Pointer(&image[0]))
+		db.bufferSize = uint64(len(image))
+	} else if options.SegmentSize != 0 {
+		if err := db.initNewDBHeap(options.SegmentSize); err != nil {
+			return nil, err
+		}
+	} else {
+		db.initNewDBMemory()
+	}
 
 	if err := db.init(); err != nil {
 		return nil, err
 	}
 
-	//fmt.Printf("Inited EbakusDB with %d MB of storage\n", info.Size()/megaByte)
+	db.log.Debug("Opened in memory database", "size", db.allocator.GetCapacity())
 
 	return db, nil
 }
 
+// minInitialSize is the smallest size of a new database
+const minInitialSize = 64 * kiloByte
+
+// setSizes sets the size options of the database, with defaultSize as the
+// initial size unless given
+func (db *DB) setSizes(options *Options, defaultSize uint64) error {
+	db.initialSize = options.InitialSize
+	db.growthFunc = options.GrowthFunc
+	db.maxSize = options.MaxSize
+	db.growThreshold = options.GrowThreshold
+
+	if db.initialSize == 0 {
+		db.initialSize = defaultSize
+		if db.maxSize != 0 && db.maxSize < defaultSize {
+			db.initialSize = db.maxSize
+		}
+	}
+	db.initialSize = (db.initialSize + kiloByte - 1) / kiloByte * kiloByte
+
+	if db.initialSize < minInitialSize {
+		return fmt.Errorf("Initial size is smaller than %d bytes", minInitialSize)
+	}
+	if db.maxSize != 0 && db.initialSize > db.maxSize {
+		return fmt.Errorf("Initial size is larger than the maximum size")
+	}
+	if db.growThreshold < 0 || db.growThreshold >= 1 {
+		return fmt.Errorf("Grow threshold must be between 0 and 1")
+	}
+	if db.growThreshold == 0 {
+		db.growThreshold = 0.3
+	}
+
+	return nil
+}
+
 func (db *DB) SetCustomEncoder(encode DBEncoder, decode DBDecoder) {
 	db.encode = encode
 	db.decode = decode
 }
 
 func (db *DB) GetInfo() DBInfo {
-	h := db.allocator.GetHeader()
-	return DBInfo{
+	st := db.allocator.Stats()
+	info := DBInfo{
 		Path:          db.path,
-		BufferStart:   h.BufferStart,
-		PageSize:      h.PageSize,
-		Watermark:     h.DataWatermark,
-		TotalUsed:     h.TotalUsed,
-		TotalCapacity: db.allocator.GetCapacity(),
+		Version:       db.header.version,
+		Features:      db.features(),
+		BufferStart:   uint32(st.Start),
+		PageSize:      st.PageSize,
+		Watermark:     st.Watermark,
+		TotalUsed:     st.Used,
+		TotalCapacity: st.Capacity,
+		Nodes:         db.allocator.NodeCount(),
+		Allocator:     st,
 	}
+
+	if span := info.Watermark - uint64(info.BufferStart); span > 0 && span > info.TotalUsed {
+		info.Fragmentation = float64(span-info.TotalUsed) / float64(span)
+	}
+
+	return info
 }
 
 func (db *DB) GetPath() string {
@@ -170,25 +625,53 @@ func (db *DB) GetPath() string {
 }
 
 func (db *DB) init() error {
-	headerSize := unsafe.Sizeof(header{})
-	db.header = (*header)(unsafe.Pointer(&db.bufferRef[0]))
+	if db.allocator == nil {
+		db.header = (*header)(unsafe.Pointer(&db.bufferRef[0]))
+	}
 	if db.header.magic != magic {
 		return fmt.Errorf("Not an EbakusDB file")
 	}
-	if db.header.version != version {
-		return fmt.Errorf("Unsupported EbakusDB file version")
+	if db.header.version == 0 || db.header.version > version {
+		return fmt.Errorf("EbakusDB file version %d needs a newer EbakusDB, version %d is supported", db.header.version, version)
+	}
+	// Version 1 headers end before the flags
+	if db.header.version > 1 && db.header.flags&^knownFlags != 0 {
+		return fmt.Errorf("EbakusDB file needs features %#x of a newer EbakusDB", db.header.flags&^knownFlags)
 	}
 
-	psize := uint16(unsafe.Sizeof(Node{}))
-	allocator, err := balloc.NewBufferAllocator(unsafe.Pointer(&db.bufferRef[0]), uint64(len(db.bufferRef)), uint64(headerSize), psize)
-	if err != nil {
+	if db.header.version < version {
+		if db.readOnly {
+			return fmt.Errorf("EbakusDB file version %d needs an upgrade to version %d, it can not be opened read-only", db.header.version, version)
+		}
+		if db.noUpgrade {
+			return nil
+		}
+		if err := db.upgradeFormat(); err != nil {
+			return err
+		}
+	}
+
+	db.radix = Radix16
+	if db.header.flags&flagRadix256 != 0 {
+		db.radix = Radix256
+	}
+	db.omitLeafKeys = db.header.flags&flagOmitLeafKeys != 0
+
+	if err := db.initCipher(); err != nil {
 		return err
 	}
 
-	db.allocator = allocator
+	if db.allocator == nil {
+		if err := db.initBufferAllocator(); err != nil {
+			return err
+		}
+	}
 
 	if db.header.root.isNull() {
-		root, _, err := newNode(db.allocator)
+		if db.readOnly {
+			return fmt.Errorf("Database has no root, it can not be opened read-only")
+		}
+		root, _, err := newNode(db.allocator, nodeKind0)
 		if err != nil {
 			return err
 		}
@@ -196,16 +679,77 @@ func (db *DB) init() error {
 		db.header.root = *root
 	}
 
+	// Writers only take the read lock, so the flag is set before any value
+	// can be compressed
+	if !db.readOnly && len(db.compression) != 0 {
+		db.header.flags |= flagCompression
+	}
+
+	return nil
+}
+
+// initBufferAllocator creates the allocator of the buffer, upgrading its
+// header if needed
+func (db *DB) initBufferAllocator() error {
+	if db.readOnly {
+		allocator, err := balloc.NewReadOnlyAllocator(unsafe.Pointer(&db.bufferRef[0]), uint64(len(db.bufferRef)), db.allocatorOffset())
+		if err != nil {
+			return err
+		}
+		db.allocator = allocator
+		return nil
+	}
+
+	allocator, err := balloc.NewBufferAllocator(unsafe.Pointer(&db.bufferRef[0]), uint64(len(db.bufferRef)), db.allocatorOffset(), pageSize)
+	if err != nil {
+		return err
+	}
+
+	offset, err := allocator.UpgradeHeader()
+	if err != nil {
+		return fmt.Errorf("No room for the allocator header: %s", err)
+	}
+	if offset != db.allocatorOffset() {
+		db.header.allocHeader = offset
+	}
+
+	db.allocator = allocator
+
+	if allocator.GetHeader().NodesUsed == 0 && !db.header.root.isNull() {
+		db.countNodes(allocator)
+	}
+
+	return nil
+}
+
+// initNewDBHeap creates a database in segments on the heap
+func (db *DB) initNewDBHeap(segmentSize uint64) error {
+	allocator, err := balloc.NewHeapAllocator(segmentSize, uint64(unsafe.Sizeof(header{})), pageSize)
+	if err != nil {
+		return err
+	}
+	if db.maxSize != 0 {
+		allocator.SetLimit(db.maxSize)
+	}
+	db.allocator = allocator
+
+	h := (*header)(allocator.GetPtr(0))
+	h.magic = magic
+	h.version = version
+	h.flags = db.headerFlags()
+	db.header = h
+
 	return nil
 }
 
 func (db *DB) initNewDBMemory() {
-	db.bufferSize = 16 * megaByte
+	db.bufferSize = db.initialSize
 	db.bufferRef = make([]byte, db.bufferSize)
 	db.buffer = (*[0x9000000000]byte)(unsafe.Pointer(&db.bufferRef[0]))
 	h := (*header)(unsafe.Pointer(&db.bufferRef[0]))
 	h.magic = magic
 	h.version = version
+	h.flags = db.headerFlags()
 }
 
 func (db *DB) initNewDBFile() error {
@@ -214,41 +758,202 @@ func (db *DB) initNewDBFile() error {
 	h = (*header)(unsafe.Pointer(&buf[0]))
 	h.magic = magic
 	h.version = version
+	h.flags = db.headerFlags()
 
 	count, err := db.file.Write(buf)
 	if count != int(unsafe.Sizeof(*h)) {
 		return ErrFailedToCreateDB
 	}
 
-	if err := db.file.Truncate(1 * megaByte); err != nil {
+	if err := db.file.Truncate(int64(db.initialSize)); err != nil {
 		return fmt.Errorf("file resize error: %s", err)
 	}
 
 	return err
 }
 
+// allocatorOffset returns the offset of the allocator header in the buffer
+func (db *DB) allocatorOffset() uint64 {
+	if db.header.allocHeader != 0 {
+		return db.header.allocHeader
+	}
+	return uint64(unsafe.Sizeof(header{}))
+}
+
+// headerFlags returns the header flags of a new database
+func (db *DB) headerFlags() uint32 {
+	var flags uint32
+	if db.radix == Radix256 {
+		flags |= flagRadix256
+	}
+	if db.omitLeafKeys {
+		flags |= flagOmitLeafKeys
+	}
+	if db.encryptKeys {
+		flags |= flagEncryptedKeys
+	}
+	return flags
+}
+
+// newLeafKey returns the key stored in a leaf, which is null when the
+// database omits leaf keys
+func (db *DB) newLeafKey(k []byte) (ByteArray, error) {
+	if db.omitLeafKeys {
+		return ByteArray{}, nil
+	}
+	b, err := allocBytes(db.allocator, k)
+	if err != nil {
+		return ByteArray{}, err
+	}
+	return *b, nil
+}
+
 const kiloByte = 1024
 const megaByte = 1024 * kiloByte
 const gigaByte = 1024 * megaByte
 
+// defaultMapSize is the address space reserved for database files
+const defaultMapSize = 64 * gigaByte
+
 func (db *DB) Grow() error {
-	if float32(db.allocator.GetFree()) > float32(db.allocator.GetCapacity())*0.3 {
-		return nil
+	return db.growFor(0)
+}
+
+// defaultGrowth doubles the size up to 1GB and then adds 1GB
+func defaultGrowth(capacity uint64) uint64 {
+	if capacity < gigaByte {
+		return capacity * 2
+	}
+	return capacity + gigaByte
+}
+
+// growSize returns the size the buffer should grow to so that after
+// allocating size bytes more than the grow threshold of it is still free,
+// or zero when it does not need to grow. Up to the maximum size it grows as
+// much as it can, it fails with ErrDatabaseFull only when size bytes do not
+// fit.
+func (db *DB) growSize(size uint64) (uint64, error) {
+	free := db.allocator.GetFree()
+	capacity := db.allocator.GetCapacity()
+	if free > size && float64(free-size) > float64(capacity)*db.growThreshold {
+		return 0, nil
+	}
+
+	growth := db.growthFunc
+	if growth == nil {
+		growth = defaultGrowth
+	}
+
+	var newSize = capacity
+
+	for {
+		next := growth(newSize)
+		if db.maxSize != 0 && next > db.maxSize {
+			next = db.maxSize
+		}
+		next &^= bufferAlignment - 1
+		if next <= newSize {
+			break
+		}
+		newSize = next
+
+		if free+newSize-capacity > size && float64(free+newSize-capacity-size) > float64(newSize)*db.growThreshold {
+			break
+		}
+	}
+
+	if free+newSize-capacity <= size {
+		return 0, ErrDatabaseFull
 	}
+	if newSize == capacity {
+		return 0, nil
+	}
+
+	return newSize, nil
+}
 
-	var newSize = db.allocator.GetCapacity()
+// bufferAlignment is the alignment of the buffer size the allocator needs
+const bufferAlignment = 8
 
-	if newSize < gigaByte {
-		newSize *= 2
-	} else if newSize >= gigaByte {
-		newSize += gigaByte
+// fullError reports allocations failing in a database limited by MaxSize
+// with ErrDatabaseFull
+func (db *DB) fullError(err error) error {
+	if err == balloc.ErrOutOfMemory && db.maxSize != 0 {
+		return ErrDatabaseFull
+	}
+	return err
+}
+
+// growInPlace grows a file within the address space reserved by its
+// mapping. The buffer does not move, so readers holding the lock are not
+// waited for. It returns false when the buffer has to be mapped again.
+func (db *DB) growInPlace(size uint64) (bool, error) {
+	if db.readOnly {
+		return true, ErrReadOnly
 	}
 
-	//fmt.Printf("Will grow to %d MB\n", newSize/megaByte)
+	// Heap allocators add segments by themselves
+	ra, ok := db.allocator.(resizableAllocator)
+	if !ok {
+		return true, nil
+	}
+
+	db.growLock.Lock()
+	defer db.growLock.Unlock()
+
+	newSize, err := db.growSize(size)
+	if newSize == 0 {
+		return true, err
+	}
+	if db.file == nil || newSize > uint64(len(db.mapping)) {
+		return false, nil
+	}
+
+	start := db.opStart()
+	if err := db.file.Truncate(int64(newSize)); err != nil {
+		return true, fmt.Errorf("file resize error: %s", err)
+	}
+	if err := db.file.Sync(); err != nil {
+		return true, fmt.Errorf("file sync error: %s", err)
+	}
+
+	db.log.Debug("Growing database in place", "from", db.bufferSize, "to", newSize)
+
+	oldSize := db.bufferSize
+	db.bufferRef = db.mapping[:newSize]
+	db.bufferSize = newSize
+	ra.Extend(newSize)
+	db.adviseGrowth(oldSize)
+
+	db.opEnd(MetricGrow, MetricGrowTime, start)
+	db.reportMemory()
+
+	return true, nil
+}
+
+// growFor grows the buffer so that after allocating size bytes more than
+// Options.GrowThreshold of it is still free. When it can not grow in place
+// it is mapped again or copied, waiting for all readers to release the lock.
+func (db *DB) growFor(size uint64) error {
+	if grown, err := db.growInPlace(size); grown || err != nil {
+		return err
+	}
 
 	db.allocator.WLock()
 	defer db.allocator.WUnlock()
 
+	db.growLock.Lock()
+	defer db.growLock.Unlock()
+
+	// Another writer may have grown it meanwhile
+	newSize, err := db.growSize(size)
+	if newSize == 0 {
+		return err
+	}
+
+	db.log.Info("Growing database", "from", db.allocator.GetCapacity(), "to", newSize)
+	start := db.opStart()
+
 	// Handle in memory case
 	if db.file != nil {
 		if err := db.munmap(); err != nil {
@@ -273,23 +978,37 @@ func (db *DB) Grow() error {
 		db.bufferSize = newSize
 	}
 
-	headerSize := unsafe.Sizeof(header{})
 	db.header = (*header)(unsafe.Pointer(&db.bufferRef[0]))
-	db.allocator.SetBuffer(unsafe.Pointer(&db.buffer[0]), newSize, uint64(headerSize))
+	db.allocator.(resizableAllocator).SetBuffer(unsafe.Pointer(&db.buffer[0]), newSize, db.allocatorOffset())
+
+	db.opEnd(MetricGrow, MetricGrowTime, start)
+	db.reportMemory()
 
 	return nil
 }
 
 func (db *DB) Close() error {
+	if db.allocator != nil {
+		db.allocator.Flush()
+	}
+
+	if db.follow {
+		db.leaseLock.Lock()
+		for root, l := range db.leased {
+			db.unleaseSlot(l.slot)
+			delete(db.leased, root)
+		}
+		db.leaseLock.Unlock()
+	}
+	if err := db.munmapLeases(); err != nil {
+		return fmt.Errorf("Failed to unmap leases error: %s", err)
+	}
 	if err := db.munmap(); err != nil {
 		return fmt.Errorf("Failed to unmap memory error: %s", err)
 	}
 	if err := db.file.Close(); err != nil {
 		return fmt.Errorf("file close error: %s", err)
 	}
-	if err := os.Remove(db.GetPath() + "~"); err != nil {
-		return fmt.Errorf("Guard removeal error: %s", err)
-	}
 	db.bufferRef = nil
 	db.buffer = nil
 	db.bufferSize = 0
@@ -297,6 +1016,82 @@ func (db *DB) Close() error {
 	return nil
 }
 
+// SaveTo writes the database to a new file at path, replacing it once it is
+// written whole. The file holds the buffer as it is, so snapshot ids stay the
+// same. Segmented in memory databases can not be saved.
+func (db *DB) SaveTo(path string) error {
+	db.allocator.WLock()
+	defer db.allocator.WUnlock()
+
+	// Writers may still grow the buffer in place, which does not wait for
+	// the allocator lock
+	db.growLock.Lock()
+	buffer := db.bufferRef
+	db.growLock.Unlock()
+
+	if buffer == nil {
+		return fmt.Errorf("Segmented in memory databases can not be saved")
+	}
+
+	db.prefetch(0, uint64(len(buffer)))
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buffer); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("file write error: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("file sync error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("file close error: %s", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// warmupDepth is the number of levels of the trie Warmup reads
+const warmupDepth = 4
+
+// Warmup reads the top levels of the trie of a database file to memory, so
+// that the first lookups after opening it do not wait for them. The nodes
+// of each level are read ahead together before they are accessed.
+func (db *DB) Warmup() {
+	if db.file == nil {
+		return
+	}
+
+	snap := db.GetRootSnapshot()
+	defer snap.Release()
+
+	mm := db.allocator
+	mm.Lock()
+	defer mm.Unlock()
+
+	level := []Ptr{snap.root}
+	for depth := 0; depth < warmupDepth && len(level) != 0; depth++ {
+		for _, nPtr := range level {
+			db.prefetch(uint64(nPtr), 1)
+		}
+
+		var next []Ptr
+		for _, nPtr := range level {
+			for _, e := range nPtr.getNode(mm).edgeList() {
+				next = append(next, e.node)
+			}
+		}
+		level = next
+	}
+}
+
 func longestPrefix(k1, k2 []byte) int {
 	max := len(k1)
 	if l := len(k2); l < max {
@@ -340,6 +1135,28 @@ func decodeKey(key []byte) []byte {
 	return ret
 }
 
+// encodeKey converts a key to the trie edge labels of the database radix
+func (db *DB) encodeKey(key []byte) []byte {
+	if db.radix == Radix256 {
+		return key
+	}
+	return encodeKey(key)
+}
+
+func (db *DB) decodeKey(key []byte) []byte {
+	if db.radix == Radix256 {
+		return key
+	}
+	return decodeKey(key)
+}
+
+func (db *DB) safeStringFromEncoded(key []byte) string {
+	if db.radix == Radix256 {
+		return string(key)
+	}
+	return safeStringFromEncoded(key)
+}
+
 func safeStringFromEncoded(key []byte) string {
 	if len(key)&1 == 1 {
 		key = append(key, 0)
@@ -357,16 +1174,30 @@ func safeStringFromEncoded(key []byte) string {
 	return string(ret)
 }
 
-func (db *DB) Get(k []byte) (*[]byte, bool) {
-	k = encodeKey(k)
+func (db *DB) Get(k []byte) (*[]byte, bool, error) {
+	if db.follow {
+		s, err := db.followSnapshot(0)
+		if err != nil {
+			return nil, false, err
+		}
+		defer s.Release()
+		return s.Get(k)
+	}
+
+	defer db.opEnd(MetricGet, MetricGetTime, db.opStart())
+
+	k = db.rootKey(k)
 	db.allocator.Lock()
 	defer db.allocator.Unlock()
 	return db.header.root.getNode(db.allocator).Get(db, k)
 }
 
 func (db *DB) CreateTable(table string, obj interface{}) error {
-	snap := db.GetRootSnapshot()
-	err := snap.CreateTable(table, obj)
+	snap, err := db.rootSnapshot()
+	if err != nil {
+		return err
+	}
+	err = snap.CreateTable(table, obj)
 	if err != nil {
 		snap.Release()
 		return err
@@ -376,8 +1207,11 @@ func (db *DB) CreateTable(table string, obj interface{}) error {
 }
 
 func (db *DB) CreateIndex(index IndexField) error {
-	snap := db.GetRootSnapshot()
-	err := snap.CreateIndex(index)
+	snap, err := db.rootSnapshot()
+	if err != nil {
+		return err
+	}
+	err = snap.CreateIndex(index)
 	if err != nil {
 		snap.Release()
 		return err
@@ -387,23 +1221,50 @@ func (db *DB) CreateIndex(index IndexField) error {
 }
 
 func (db *DB) HasTable(table string) bool {
-	snap := db.GetRootSnapshot()
+	snap, err := db.rootSnapshot()
+	if err != nil {
+		return false
+	}
 	exists := snap.HasTable(table)
 	snap.Release()
 	return exists
 }
 
+// Iter returns an iterator of the root. Iterators of followers lease the
+// root until they are released, and fail with the error of leasing it.
 func (db *DB) Iter() *Iterator {
-	iter := db.header.root.getNodeIterator(db.allocator)
-	return iter
+	if db.follow {
+		s, err := db.followSnapshot(0)
+		if err != nil {
+			return &Iterator{db: db, mm: db.allocator, err: err}
+		}
+		iter := s.Iter()
+		iter.snap = s
+		return iter
+	}
+	return db.header.root.getNodeIterator(db)
 }
 
+// Snapshot returns a snapshot of the root with the given id, or of the
+// current root when it is zero. Followers can only take snapshots of the
+// current root and of the roots of their snapshots, as the writer may have
+// released the others, and return nil when they fail to, logging why.
 func (db *DB) Snapshot(id uint64) *Snapshot {
+	if db.follow {
+		s, err := db.followSnapshot(Ptr(id))
+		if err != nil {
+			db.log.Error("Failed to follow a snapshot", "id", id, "err", err)
+		}
+		return s
+	}
+
 	db.allocator.Lock()
 	defer db.allocator.Unlock()
 
+	db.count(MetricSnapshotRetain, 1)
+
 	if id == 0 {
-		db.header.root.getNode(db.allocator).Retain()
+		db.header.root.NodeRetain(db.allocator)
 
 		return &Snapshot{
 			db:   db,
@@ -412,7 +1273,7 @@ func (db *DB) Snapshot(id uint64) *Snapshot {
 	}
 
 	ptr := Ptr(id)
-	ptr.getNode(db.allocator).Retain()
+	ptr.NodeRetain(db.allocator)
 
 	return &Snapshot{
 		db:   db,
@@ -420,11 +1281,23 @@ func (db *DB) Snapshot(id uint64) *Snapshot {
 	}
 }
 
+// GetRootSnapshot returns a snapshot of the current root. Followers return
+// nil when they fail to lease it or to map the file the writer grew,
+// logging why.
 func (db *DB) GetRootSnapshot() *Snapshot {
+	if db.follow {
+		s, err := db.followSnapshot(0)
+		if err != nil {
+			db.log.Error("Failed to follow the root", "err", err)
+		}
+		return s
+	}
+
 	db.allocator.Lock()
 	defer db.allocator.Unlock()
 
-	db.header.root.getNode(db.allocator).Retain()
+	db.header.root.NodeRetain(db.allocator)
+	db.count(MetricSnapshotRetain, 1)
 
 	return &Snapshot{
 		db:   db,
@@ -432,23 +1305,63 @@ func (db *DB) GetRootSnapshot() *Snapshot {
 	}
 }
 
+// rootSnapshot is GetRootSnapshot returning the errors of followers
+func (db *DB) rootSnapshot() (*Snapshot, error) {
+	if db.follow {
+		return db.followSnapshot(0)
+	}
+	return db.GetRootSnapshot(), nil
+}
+
+// SetRootSnapshot makes s the root of the database. Read-only databases are
+// left as they are.
 func (db *DB) SetRootSnapshot(s *Snapshot) {
-	db.allocator.Lock()
-	defer db.allocator.Unlock()
+	if db.readOnly {
+		return
+	}
 
-	db.header.root.NodeRelease(db.allocator)
-	db.header.root = *s.Root()
-	db.header.root.getNode(db.allocator).Retain()
+	mm := db.allocator
+	mm.Lock()
+	defer mm.Unlock()
+
+	root := *s.Root()
+	root.NodeRetain(mm)
+	old := db.header.root
+	atomic.StoreUint64((*uint64)(&db.header.root), uint64(root))
+	db.retire(old)
+
+	// Nodes under the root are never changed in place, as followers may be
+	// reading them
+	s.writable = nil
+
+	db.reportMemory()
 }
 
 func (db *DB) PrintTree() {
+	db.FprintTree(os.Stdout)
+}
+
+// FprintTree writes the nodes of the root snapshot to w
+func (db *DB) FprintTree(w io.Writer) {
+	s, err := db.rootSnapshot()
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+	defer s.Release()
+
 	db.allocator.Lock()
 	defer db.allocator.Unlock()
 
-	fmt.Println("<>")
-	db.header.root.getNode(db.allocator).printTree(db.allocator, 0, "", false)
+	fmt.Fprintln(w, "<>")
+	s.root.getNode(db.allocator).printTree(w, db, 0, "", false)
 }
 
 func (db *DB) PrintFreeChunks() {
-	db.allocator.PrintFreeChunks()
+	db.FprintFreeChunks(os.Stdout)
+}
+
+// FprintFreeChunks writes the free chunks of the allocator to w
+func (db *DB) FprintFreeChunks(w io.Writer) {
+	db.allocator.FprintFreeChunks(w)
 }
@@ -2,14 +2,21 @@ package ebakusdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"math/rand"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/ebakus/go-ebakus/common"
 )
@@ -68,8 +75,13 @@ func Test_Guard(t *testing.T) {
 	}
 
 	_, err = Open("/tmp/ebakus-guard.db", 0, nil)
-	if err == nil {
-		t.Fatal("Opened dirty db")
+	if err != ErrLocked {
+		t.Fatal("Opened locked db", err)
+	}
+
+	_, err = Open("/tmp/ebakus-guard.db", 0, &Options{ReadOnly: true})
+	if err != ErrLocked {
+		t.Fatal("Opened locked db read-only", err)
 	}
 
 	db.Close()
@@ -77,26 +89,74 @@ func Test_Guard(t *testing.T) {
 
 func Test_GuardRemoval(t *testing.T) {
 	path := "/tmp/ebakus-guard.db"
+
+	// Guard files of older versions are ignored
+	guardFile, err := os.OpenFile(path+"~", os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal("Failed to create the guard file", err)
+	}
+	guardFile.Close()
+	defer os.Remove(path + "~")
+
 	db, err := Open(path, 0, nil)
 	if err != nil || db == nil {
 		t.Fatal("Failed to open db", err)
 		return
 	}
+	db.Close()
 
-	var guardFile *os.File
-	if guardFile, err = os.OpenFile(path+"~", os.O_RDWR, 0666); err != nil {
-		t.Fatal("Failed to find the guard file", err)
+	// The lock is released on close
+	db, err = Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Lock not released", err)
 		return
 	}
-	guardFile.Close()
+	db.Close()
+}
+
+func Test_LockTimeout(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	start := time.Now()
+	if _, err := Open(path, 0, &Options{LockTimeout: 100 * time.Millisecond}); err != ErrLocked {
+		t.Fatal("Opened locked db", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("Lock not waited for")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.Close()
+	}()
 
+	db, err = Open(path, 0, &Options{LockTimeout: 5 * time.Second})
+	if err != nil || db == nil {
+		t.Fatal("Failed to wait for the lock", err)
+	}
 	db.Close()
 
-	if guardFile, err = os.OpenFile(path+"~", os.O_RDWR, 0666); err == nil {
-		t.Fatal("Guard file not removed", err)
-		return
+	// Readers share the lock
+	r1, err := Open(path, 0, &Options{ReadOnly: true})
+	if err != nil || r1 == nil {
+		t.Fatal("Failed to open db read-only", err)
+	}
+	defer r1.Close()
+	r2, err := Open(path, 0, &Options{ReadOnly: true})
+	if err != nil || r2 == nil {
+		t.Fatal("Failed to open db read-only twice", err)
+	}
+	defer r2.Close()
+
+	if _, err := Open(path, 0, nil); err != ErrLocked {
+		t.Fatal("Opened db being read", err)
 	}
-	guardFile.Close()
 }
 
 func Test_LargeDataSizeError(test *testing.T) {
@@ -106,11 +166,13 @@ func Test_LargeDataSizeError(test *testing.T) {
 		test.Fatal("Failed to open db")
 	}
 
-	inputDataSize := maxDataSize + 10
-	longString := RandomString(inputDataSize)
+	inputDataSize := maxValueSize + 10
 	t := db.GetRootSnapshot()
-	if old, _ := t.Insert([]byte("key"), []byte(longString)); old != nil {
-		test.Fatal("Test failed, huge amount of data passed in:", inputDataSize, "expected:", maxDataSize)
+	if old, _ := t.Insert([]byte("key"), make([]byte, inputDataSize)); old != nil {
+		test.Fatal("Test failed, huge amount of data passed in:", inputDataSize, "expected:", maxValueSize)
+	}
+	if _, found, _ := t.Get([]byte("key")); found {
+		test.Fatal("Test failed, huge amount of data inserted:", inputDataSize, "expected:", maxValueSize)
 	}
 }
 
@@ -138,18 +200,18 @@ func Test_Snap(test *testing.T) {
 		test.Fatal("Update failed")
 	}
 
-	if v, _ := t.Get([]byte("key")); string(*v) != "va" {
+	if v, _, _ := t.Get([]byte("key")); string(*v) != "va" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
 	db.SetRootSnapshot(t)
 	t.Release()
 
-	if v, _ := db.Get([]byte("key")); string(*v) != "va" {
+	if v, _, _ := db.Get([]byte("key")); string(*v) != "va" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
-	if v, _ := db.Get([]byte("harry")); string(*v) != "kalogirou" {
+	if v, _, _ := db.Get([]byte("harry")); string(*v) != "kalogirou" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
@@ -160,7 +222,7 @@ func Test_Snap(test *testing.T) {
 	}
 
 	// Change should not be visible outside the transaction
-	if v, _ := db.Get([]byte("harry")); string(*v) != "kalogirou" {
+	if v, _, _ := db.Get([]byte("harry")); string(*v) != "kalogirou" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
@@ -168,7 +230,7 @@ func Test_Snap(test *testing.T) {
 	t.Release()
 
 	// Change should not be visible outside the transaction
-	if v, _ := db.Get([]byte("harry")); string(*v) != "Kal" {
+	if v, _, _ := db.Get([]byte("harry")); string(*v) != "Kal" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 }
@@ -191,14 +253,14 @@ func Test_WriterCrash(test *testing.T) {
 		test.Fatal("Update failed")
 	}
 
-	if v, _ := t.Get([]byte{1}); string(*v) != "kalogirou" {
+	if v, _, _ := t.Get([]byte{1}); string(*v) != "kalogirou" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
 	db.SetRootSnapshot(t)
 	t.Release()
 
-	if db.allocator.GetUsed() != 2112 {
+	if db.allocator.GetUsed() != 384 {
 		test.Fatal("incorrect used memory at end", db.allocator.GetUsed())
 	}
 }
@@ -232,7 +294,7 @@ func Test_SnapshotTnx(test *testing.T) {
 		test.Fatal("Insert failed")
 	}
 
-	if v, _ := db.Get([]byte("harry")); v == nil || string(*v) != "kalogirou" {
+	if v, _, _ := db.Get([]byte("harry")); v == nil || string(*v) != "kalogirou" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
@@ -241,17 +303,17 @@ func Test_SnapshotTnx(test *testing.T) {
 
 	tnx := snapshot
 
-	if v, _ := tnx.Get([]byte("key")); string(*v) != "value" {
+	if v, _, _ := tnx.Get([]byte("key")); string(*v) != "value" {
 		test.Fatalf("Get failed (got '%s')", string(*v))
 	}
 
 	// Change should not be visible on this snapshot
-	if v, _ := tnx.Get([]byte("harry")); string(*v) != "kalogirou" {
+	if v, _, _ := tnx.Get([]byte("harry")); string(*v) != "kalogirou" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
 	// But should be visible here
-	if v, _ := db.Get([]byte("harry")); string(*v) != "Kal" {
+	if v, _, _ := db.Get([]byte("harry")); string(*v) != "Kal" {
 		test.Fatalf("Get failed (got %v)", v)
 	}
 
@@ -353,11 +415,11 @@ func Test_Get_KeySubset(test *testing.T) {
 	db.SetRootSnapshot(t)
 	t.Release()
 
-	if v, _ := db.Get([]byte("key_long")); string(*v) != "value" {
+	if v, _, _ := db.Get([]byte("key_long")); string(*v) != "value" {
 		test.Fatal("Get failed")
 	}
 
-	if v, _ := db.Get([]byte("key")); string(*v) != "value2" {
+	if v, _, _ := db.Get([]byte("key")); string(*v) != "value2" {
 		test.Fatal("Get failed")
 	}
 
@@ -414,7 +476,7 @@ func Test_InsertGet(t *testing.T) {
 
 	for i, k := range keys {
 		v := values[i]
-		dv, found := db.Get([]byte(k))
+		dv, found, _ := db.Get([]byte(k))
 		if found == false || string(*dv) != string(v) {
 			t.Fatal("Failed", k)
 		}
@@ -430,7 +492,7 @@ func Test_InsertGet(t *testing.T) {
 
 	for i, k := range keys {
 		v := values[i]
-		dv, found := db.Get([]byte(k))
+		dv, found, _ := db.Get([]byte(k))
 		if found == false || string(*dv) != string(v) {
 			t.Fatalf("Failed %d\n %v\n %s\n (%v)\n", i, dv, string(v), found)
 		}
@@ -458,7 +520,7 @@ func Test_LargeValue(t *testing.T) {
 
 	s.Insert(key, value)
 
-	v, f := s.Get(key)
+	v, f, _ := s.Get(key)
 	if f != true {
 		t.Fatalf("Failed to find key")
 	}
@@ -470,6 +532,163 @@ func Test_LargeValue(t *testing.T) {
 	s.Release()
 }
 
+func Test_OverflowValue(t *testing.T) {
+	fname := tempfile()
+	db, err := Open(fname, 0, nil)
+	defer os.Remove(fname)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db")
+	}
+
+	used := db.allocator.GetUsed()
+
+	s := db.GetRootSnapshot()
+
+	key := []byte("key")
+	value := []byte(RandomString(maxDataSize + overflowSegmentSize/2))
+
+	s.Insert(key, value)
+	s.Insert([]byte("small"), []byte("value"))
+
+	v, f, _ := s.Get(key)
+	if f != true {
+		t.Fatalf("Failed to find key")
+	}
+	if !bytes.Equal(*v, value) {
+		t.Fatalf("Failed to get proper value")
+	}
+
+	db.SetRootSnapshot(s)
+	s.Release()
+	db.Close()
+
+	db, err = Open(fname, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to reopen db")
+	}
+	defer db.Close()
+
+	s = db.GetRootSnapshot()
+
+	r, f, _ := s.GetReader(key)
+	if f != true {
+		t.Fatalf("Failed to find key")
+	}
+	buf := make([]byte, 1000)
+	var read []byte
+	for {
+		n, err := r.Read(buf)
+		read = append(read, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if n == 0 || err != nil {
+			t.Fatal("Failed to read value", err)
+		}
+	}
+	if !bytes.Equal(read, value) {
+		t.Fatalf("Failed to read proper value")
+	}
+	r.Close()
+
+	r, _, _ = s.GetReader([]byte("small"))
+	if read, err := ioutil.ReadAll(r); err != nil || string(read) != "value" {
+		t.Fatal("Failed to read proper value", string(read), err)
+	}
+	r.Close()
+
+	// Readers closed before the end release the value too
+	r, _, _ = s.GetReader(key)
+	r.Read(buf)
+	r.Close()
+
+	if _, f, _ := s.GetReader([]byte("missing")); f {
+		t.Fatal("Found missing key")
+	}
+
+	// The reader keeps the value alive after it is deleted
+	r, _, _ = s.GetReader(key)
+	s.Delete(key)
+	if read, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(read, value) {
+		t.Fatal("Failed to read deleted value", err)
+	}
+	r.Close()
+
+	s.Delete([]byte("small"))
+	db.SetRootSnapshot(s)
+	s.Release()
+
+	// Only the root node is left, using the 4 edges layout
+	if db.allocator.GetUsed() != used+112-64 {
+		t.Fatal("incorrect used memory at end", db.allocator.GetUsed(), used)
+	}
+}
+
+func Test_OverflowPrefix(t *testing.T) {
+	fname := tempfile()
+	db, err := Open(fname, 0, &Options{InitialSize: 32 * megaByte})
+	defer os.Remove(fname)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db")
+	}
+	defer db.Close()
+
+	mm := db.allocator
+	data := []byte(RandomString(overflowSegmentSize + 100))
+	b := newBytesFromSlice(mm, data)
+	defer b.Release(mm)
+
+	differ := func(i int) []byte {
+		s := append([]byte{}, data...)
+		s[i]++
+		return s
+	}
+	cases := [][]byte{
+		data,
+		data[:10],
+		data[:overflowSegmentSize+50],
+		append(append([]byte{}, data...), "more"...),
+		differ(5),
+		differ(overflowSegmentSize - 1),
+		differ(overflowSegmentSize + 10),
+		nil,
+	}
+	for i, s := range cases {
+		if n := b.commonPrefix(mm, s); n != longestPrefix(s, data) {
+			t.Fatal("Incorrect common prefix", i, n)
+		}
+		if b.isPrefixOf(mm, s) != bytes.HasPrefix(s, data) {
+			t.Fatal("Incorrect prefix of", i)
+		}
+		if b.hasPrefix(mm, s) != bytes.HasPrefix(data, s) {
+			t.Fatal("Incorrect prefix", i)
+		}
+	}
+
+	// Keys sharing overflow prefixes are found and deleted in the trie
+	s := db.GetRootSnapshot()
+	defer s.Release()
+	keys := [][]byte{data, differ(overflowSegmentSize + 10), data[:overflowSegmentSize+50]}
+	for i, k := range keys {
+		s.Insert(k, []byte{byte(i)})
+	}
+	for i, k := range keys {
+		if v, ok, _ := s.Get(k); !ok || !bytes.Equal(*v, []byte{byte(i)}) {
+			t.Fatal("Key not found", i)
+		}
+	}
+	if _, ok, _ := s.Get(differ(overflowSegmentSize + 20)); ok {
+		t.Fatal("Found missing key")
+	}
+	s.Delete(keys[0])
+	if _, ok, _ := s.Get(keys[0]); ok {
+		t.Fatal("Found deleted key")
+	}
+	if _, ok, _ := s.Get(keys[1]); !ok {
+		t.Fatal("Key not found after delete")
+	}
+}
+
 func Test_Tables(t *testing.T) {
 	db, err := Open(tempfile(), 0, nil)
 	defer os.Remove(db.GetPath())
@@ -524,18 +743,18 @@ func Test_Tables(t *testing.T) {
 		t.Fatal("Failed to insert row error:", err)
 	}
 
-	if _, f := db.Get([]byte("t_PhoneBook")); f != false {
+	if _, f, _ := db.Get([]byte("t_PhoneBook")); f != false {
 		t.Fatal("Get failed")
 	}
 
-	if _, f := txn.Get([]byte("t_PhoneBook")); f != true {
+	if _, f, _ := txn.Get([]byte("t_PhoneBook")); f != true {
 		t.Fatal("Get failed")
 	}
 
 	db.SetRootSnapshot(txn)
 	txn.Release()
 
-	if _, f := db.Get([]byte("t_PhoneBook")); f != true {
+	if _, f, _ := db.Get([]byte("t_PhoneBook")); f != true {
 		t.Fatal("Get failed")
 	}
 
@@ -1553,7 +1772,7 @@ func Test_InsertLookupPrefixAfterMergeOnParentTableNode(t *testing.T) {
 	fmt.Print("\n\n")
 
 	mm := db.allocator
-	tPtrMarshaled, _ := snap.Get([]byte("t_" + DelegationsTable))
+	tPtrMarshaled, _, _ := snap.Get([]byte("t_" + DelegationsTable))
 	var tbl Table
 	db.decode(*tPtrMarshaled, &tbl)
 	tNode := tbl.Node.getNode(mm)
@@ -1573,15 +1792,15 @@ func Test_InsertLookupPrefixAfterMergeOnParentTableNode(t *testing.T) {
 	}
 
 	p2NodePrefix := encodeKey(p2[2:])
-	p2Node := child.edges[p2NodePrefix[0]].getNode(mm)
-	p2NodeKey := p2Node.keyPtr.getBytes(mm)
+	p2Node := child.edgeRef(p2NodePrefix[0]).getNode(mm)
+	p2NodeKey := p2Node.leaf().keyPtr.getBytes(mm)
 	if !bytes.Equal(p2NodeKey, encodeKey(p2[:])) {
 		t.Fatal("p2 node is wrong:", p2NodeKey)
 	}
 
 	p3NodePrefix := encodeKey(p3[2:])
-	p3Node := child.edges[p3NodePrefix[0]].getNode(mm)
-	p3NodeKey := p3Node.keyPtr.getBytes(mm)
+	p3Node := child.edgeRef(p3NodePrefix[0]).getNode(mm)
+	p3NodeKey := p3Node.leaf().keyPtr.getBytes(mm)
 	if !bytes.Equal(p3NodeKey, encodeKey(p3[:])) {
 		t.Fatal("p3 node is wrong:", p3NodeKey)
 	}
@@ -1662,7 +1881,7 @@ func Test_InsertLookupPrefixAfterMergeOnParentTableNodeForEmptyIdValue(t *testin
 	fmt.Println("------ Check prefix p1")
 
 	mm := db.allocator
-	tPtrMarshaled, _ := snap.Get([]byte("t_" + DelegationsTable))
+	tPtrMarshaled, _, _ := snap.Get([]byte("t_" + DelegationsTable))
 	var tbl Table
 	db.decode(*tPtrMarshaled, &tbl)
 	tNode := tbl.Node.getNode(mm)
@@ -1673,8 +1892,8 @@ func Test_InsertLookupPrefixAfterMergeOnParentTableNodeForEmptyIdValue(t *testin
 	}
 
 	p1NodePrefix := encodeKey(p1)
-	p1Node := tNode.edges[p1NodePrefix[0]].getNode(mm)
-	p1NodeKey := p1Node.keyPtr.getBytes(mm)
+	p1Node := tNode.edgeRef(p1NodePrefix[0]).getNode(mm)
+	p1NodeKey := p1Node.leaf().keyPtr.getBytes(mm)
 	if !bytes.Equal(p1NodeKey, encodeKey(p1[:])) {
 		t.Fatal("p1 node is wrong:", p1NodeKey)
 	}
@@ -1689,13 +1908,13 @@ func Test_InsertLookupPrefixAfterMergeOnParentTableNodeForEmptyIdValue(t *testin
 
 	fmt.Println("------ Check prefix p3")
 
-	tPtrMarshaled, _ = snap.Get([]byte("t_" + DelegationsTable))
+	tPtrMarshaled, _, _ = snap.Get([]byte("t_" + DelegationsTable))
 	db.decode(*tPtrMarshaled, &tbl)
 	tNode = tbl.Node.getNode(mm)
 
 	p3NodePrefix := encodeKey(p3)
-	p3Node := tNode.edges[p3NodePrefix[0]].getNode(mm)
-	p3NodeKey := p3Node.keyPtr.getBytes(mm)
+	p3Node := tNode.edgeRef(p3NodePrefix[0]).getNode(mm)
+	p3NodeKey := p3Node.leaf().keyPtr.getBytes(mm)
 	if !bytes.Equal(p3NodeKey, encodeKey(p3[:])) {
 		t.Fatal("p3 node is wrong:", p3NodeKey)
 	}
@@ -1721,7 +1940,7 @@ func Test_InsertLookupPrefixAfterMergeOnParentTableNodeForEmptyIdValue(t *testin
 
 	snap.Release()
 
-	if db.allocator.GetUsed() != 192 {
+	if db.allocator.GetUsed() != 64 {
 		t.Fatal("incorrect used memory at end", db.allocator.GetUsed())
 	}
 }
@@ -1776,7 +1995,7 @@ func Test_DeleteLookupPrefixAfterMerge(t *testing.T) {
 
 	snap.Release()
 
-	if db.allocator.GetUsed() != 192 {
+	if db.allocator.GetUsed() != 64 {
 		t.Fatal("incorrect used memory at end", db.allocator.GetUsed())
 	}
 }
@@ -1862,7 +2081,7 @@ func Test_TablesDeleteIndexesWithSameValue(t *testing.T) {
 
 	snap.Release()
 
-	if db.allocator.GetUsed() != 192 {
+	if db.allocator.GetUsed() != 64 {
 		t.Fatal("incorrect used memory at end", db.allocator.GetUsed())
 	}
 }
@@ -1934,7 +2153,7 @@ func Test_TablesUpdateIndexesWithSameValue(t *testing.T) {
 
 	snap.Release()
 
-	if db.allocator.GetUsed() != 192 {
+	if db.allocator.GetUsed() != 64 {
 		t.Fatal("incorrect used memory at end", db.allocator.GetUsed())
 	}
 }
@@ -1971,11 +2190,11 @@ func Test_SnapshotResetTo(t *testing.T) {
 		t.Fatal("Failed to insert row error:", err)
 	}
 
-	if _, f := db.Get([]byte("t_PhoneBook")); f != false {
+	if _, f, _ := db.Get([]byte("t_PhoneBook")); f != false {
 		t.Fatal("Get failed")
 	}
 
-	if _, f := txn.Get([]byte("t_PhoneBook")); f != true {
+	if _, f, _ := txn.Get([]byte("t_PhoneBook")); f != true {
 		t.Fatal("Get failed")
 	}
 
@@ -1983,7 +2202,7 @@ func Test_SnapshotResetTo(t *testing.T) {
 	db.SetRootSnapshot(txn)
 	txn.Release()
 
-	if _, f := db.Get([]byte("t_PhoneBook")); f != true {
+	if _, f, _ := db.Get([]byte("t_PhoneBook")); f != true {
 		t.Fatal("Get failed")
 	}
 
@@ -2030,7 +2249,7 @@ func Test_SnapshotResetTo(t *testing.T) {
 	// db.SetRootSnapshot(txn2)
 	txn2.Release()
 
-	if _, f := db.Get([]byte("t_PhoneBook")); f != true {
+	if _, f, _ := db.Get([]byte("t_PhoneBook")); f != true {
 		t.Fatal("Get failed")
 	}
 
@@ -2333,6 +2552,88 @@ func Test_ByteArrayRefCounting(t *testing.T) {
 	}
 }
 
+func Test_ByteArrayInline(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db")
+	}
+	mm := db.allocator
+
+	used := db.allocator.GetUsed()
+
+	bPtr, b, err := newBytes(mm, 8)
+	if err != nil || bPtr == nil || !bPtr.isInline() || bPtr.isNull() {
+		t.Fatal("Failed to create inline byte array")
+	}
+	copy(b, []byte("12345678"))
+
+	b2Ptr, err := bPtr.cloneBytes(mm)
+	if err != nil || string(b2Ptr.getBytes(mm)) != "12345678" {
+		t.Fatal("Data corruption")
+	}
+
+	bPtr.Retain(mm)
+	bPtr.Release(mm)
+	b2Ptr.Release(mm)
+	if db.allocator.GetUsed() != used {
+		t.Fatal("Inline byte arrays allocated memory", db.allocator.GetUsed(), used)
+	}
+
+	if ePtr := newBytesFromSlice(mm, []byte{}); ePtr.isNull() {
+		t.Fatal("Empty byte array is null")
+	}
+
+	snap := db.GetRootSnapshot()
+	for i := 0; i < 100; i++ {
+		snap.Insert([]byte{byte(i)}, []byte(fmt.Sprintf("v%d", i)))
+	}
+	snap.Insert([]byte{200}, []byte("not inline value"))
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	db.Close()
+
+	db, err = Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to reopen db", err)
+	}
+	defer db.Close()
+
+	snap = db.GetRootSnapshot()
+	for i := 0; i < 100; i++ {
+		if v, found, _ := snap.Get([]byte{byte(i)}); !found || string(*v) != fmt.Sprintf("v%d", i) {
+			t.Fatal("Get failed", i, v)
+		}
+	}
+
+	iter := snap.Iter()
+	for i := 0; i < 100; i++ {
+		k, v, ok := iter.Next()
+		if !ok || k[0] != byte(i) || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatal("Iterated wrong key", k, v, ok)
+		}
+	}
+
+	if v, found, _ := snap.Get([]byte{200}); !found || string(*v) != "not inline value" {
+		t.Fatal("Get failed", v)
+	}
+
+	for i := 0; i < 100; i++ {
+		snap.Delete([]byte{byte(i)})
+	}
+	snap.Delete([]byte{200})
+	db.SetRootSnapshot(snap)
+	snap.Release()
+
+	// Only the root node is left, it keeps the 16 edges layout it was
+	// copied with before the deletes
+	if db.allocator.GetUsed() != 192 {
+		t.Fatal("incorrect used memory at end", db.allocator.GetUsed())
+	}
+}
+
 func Test_Iterator(test *testing.T) {
 	db, err := Open(tempfile(), 0, nil)
 	defer os.Remove(db.GetPath())
@@ -2355,7 +2656,7 @@ func Test_Iterator(test *testing.T) {
 	db.SetRootSnapshot(t)
 	t.Release()
 
-	if v, _ := db.Get([]byte("Kalogirou")); string(*v) != "this is a last name" {
+	if v, _, _ := db.Get([]byte("Kalogirou")); string(*v) != "this is a last name" {
 		test.Fatal("Get failed")
 	}
 
@@ -2437,16 +2738,2105 @@ func Test_GobEncoderTablesZeroValues(t *testing.T) {
 	}
 }
 
-func tempfile() string {
-	f, err := ioutil.TempFile("/tmp", "ebakusdb-")
+func Test_NodeLayouts(t *testing.T) {
+	db, err := OpenInMemory(nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	mm := db.allocator
+
+	snap := db.GetRootSnapshot()
+	snap.Insert([]byte{0x10}, []byte("v"))
+
+	child := snap.RootNode().edgeRef(1).getNode(mm)
+	if child.kind != nodeKind0 {
+		t.Fatal("Leaf node has edges layout", child.kind)
+	}
+
+	for i := byte(1); i < 4; i++ {
+		snap.Insert([]byte{0x10 + i}, []byte("v"))
+	}
+
+	child = snap.RootNode().edgeRef(1).getNode(mm)
+	if child.kind != nodeKind4 || child.edgeCount() != 4 {
+		t.Fatal("Expected a 4 edges node", child.kind, child.edgeCount())
+	}
+
+	for i := byte(4); i < 16; i++ {
+		snap.Insert([]byte{0x10 + i}, []byte("v"))
+	}
+
+	child = snap.RootNode().edgeRef(1).getNode(mm)
+	if child.kind != nodeKind16 || child.edgeCount() != 16 {
+		t.Fatal("Expected a 16 edges node", child.kind, child.edgeCount())
+	}
+
+	iter := snap.Iter()
+	for i := byte(0); i < 16; i++ {
+		k, _, ok := iter.Next()
+		if !ok || !bytes.Equal(k, []byte{0x10 + i}) {
+			t.Fatal("Iterated wrong key", k, ok)
+		}
+	}
+	iter = snap.Iter()
+	for i := byte(15); i < 16; i-- {
+		k, _, ok := iter.Prev()
+		if !ok || !bytes.Equal(k, []byte{0x10 + i}) {
+			t.Fatal("Iterated wrong key", k, ok)
+		}
+	}
+
+	for i := byte(0); i < 15; i++ {
+		if !snap.Delete([]byte{0x10 + i}) {
+			t.Fatal("Failed to delete key", i)
+		}
+	}
+
+	child = snap.RootNode().edgeRef(1).getNode(mm)
+	if child.kind != nodeKind0 || !child.isLeaf() {
+		t.Fatal("Expected the last key merged into a leaf", child.kind)
+	}
+
+	if v, found, _ := snap.Get([]byte{0x1f}); !found || string(*v) != "v" {
+		t.Fatal("Get failed", v)
+	}
+
+	snap.Delete([]byte{0x1f})
+	db.SetRootSnapshot(snap)
+	snap.Release()
+
+	// Only the root node is left, using the 4 edges layout
+	if db.allocator.GetUsed() != 112 {
+		t.Fatal("incorrect used memory at end", db.allocator.GetUsed())
+	}
+}
+
+func Test_UpgradeFromV1(t *testing.T) {
+	path := tempfile()
+	fixture, err := ioutil.ReadFile("testdata/v1.db")
 	if err != nil {
-		panic(err)
+		t.Fatal("Failed to read fixture", err)
 	}
-	if err := f.Close(); err != nil {
-		panic(err)
+	if err := ioutil.WriteFile(path, fixture, 0666); err != nil {
+		t.Fatal("Failed to write database", err)
 	}
-	if err := os.Remove(f.Name()); err != nil {
-		panic(err)
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open version 1 db", err)
+	}
+
+	if db.header.version != version || db.GetInfo().PageSize != pageSize {
+		t.Fatal("Database not upgraded", db.header.version, db.GetInfo().PageSize)
+	}
+	if s := db.GetInfo().Allocator; s.NodesUsed == 0 || s.NodesUsed > s.Used {
+		t.Fatal("Space of the nodes not counted", s)
+	}
+
+	type Witness struct {
+		Id    uint64
+		Stake uint64
+	}
+
+	snap := db.GetRootSnapshot()
+	for i := 0; i < 50; i++ {
+		v, found, _ := snap.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if i == 10 || i == 11 {
+			if found {
+				t.Fatal("Found deleted key", i)
+			}
+			continue
+		}
+		if !found || string(*v) != fmt.Sprintf("value%03d", i) {
+			t.Fatal("Get failed", i, v)
+		}
+	}
+
+	orderClause, _ := snap.OrderParser([]byte("Stake ASC"))
+	iter, err := snap.Select("Witnesses", nil, orderClause)
+	if err != nil {
+		t.Fatal("Failed to create iterator", err)
+	}
+	var w Witness
+	for i := 9; i >= 0; i-- {
+		if !iter.Next(&w) || w.Id != uint64(i) {
+			t.Fatal("Returned wrong row", w)
+		}
+	}
+
+	// Replace the version 1 data and make sure everything is freed
+	for i := 0; i < 50; i++ {
+		snap.Delete([]byte(fmt.Sprintf("key%03d", i)))
+		snap.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("new"))
+	}
+	for i := 0; i < 50; i++ {
+		snap.Delete([]byte(fmt.Sprintf("key%03d", i)))
+	}
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	db.Close()
+
+	db, err = Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to reopen upgraded db", err)
+	}
+	defer db.Close()
+
+	if _, found, _ := db.Get([]byte("key001")); found {
+		t.Fatal("Found deleted key")
+	}
+	if v, found, _ := db.Get([]byte("t_Witnesses")); !found || v == nil {
+		t.Fatal("Table lost after upgrade")
+	}
+}
+
+func Test_Upgrade(t *testing.T) {
+	path := tempfile()
+	fixture, err := ioutil.ReadFile("testdata/v1.db")
+	if err != nil {
+		t.Fatal("Failed to read fixture", err)
+	}
+	if err := ioutil.WriteFile(path, fixture, 0666); err != nil {
+		t.Fatal("Failed to write database", err)
+	}
+	defer os.Remove(path)
+
+	if _, err := Open(path, 0, &Options{ReadOnly: true}); err == nil || !strings.Contains(err.Error(), "version 1 needs an upgrade to version 4") {
+		t.Fatal("Old version opened read-only", err)
+	}
+
+	db, err := Open(path, 0, &Options{NoUpgrade: true})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open version 1 db", err)
+	}
+
+	steps, err := db.Upgrade(true)
+	if err != nil {
+		t.Fatal("Dry run failed", err)
+	}
+	if len(steps) != 4 || steps[0].From != 1 || steps[2].To != version || steps[3].Description == "" {
+		t.Fatal("Wrong upgrade steps", steps)
+	}
+	if db.header.version != 1 {
+		t.Fatal("Dry run changed the database", db.header.version)
+	}
+
+	if _, err := db.Upgrade(false); err != nil {
+		t.Fatal("Upgrade failed", err)
+	}
+	if db.header.version != version || db.GetInfo().Version != version {
+		t.Fatal("Database not upgraded", db.header.version)
+	}
+	if v, found, _ := db.GetRootSnapshot().Get([]byte("key000")); !found || string(*v) != "value000" {
+		t.Fatal("Get failed after upgrade", v)
+	}
+	db.Close()
+
+	db, err = Open(path, 0, &Options{NoUpgrade: true})
+	if err != nil {
+		t.Fatal("Failed to reopen", err)
+	}
+	if steps, err := db.Upgrade(true); err != nil || len(steps) != 0 {
+		t.Fatal("Upgraded database has upgrade steps", steps, err)
+	}
+	db.Close()
+}
+
+func Test_FormatRefusal(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, &Options{Followers: true})
+	if err != nil {
+		t.Fatal("Failed to open", err)
+	}
+	if f := db.GetInfo().Features; len(f) != 1 || f[0] != "leases" {
+		t.Fatal("Wrong features", f)
+	}
+	db.Close()
+
+	setHeader := func(set func(h *header)) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal("Failed to read database", err)
+		}
+		set((*header)(unsafe.Pointer(&b[0])))
+		if err := ioutil.WriteFile(path, b, 0666); err != nil {
+			t.Fatal("Failed to write database", err)
+		}
+	}
+
+	// Optional features newer versions add are ignored
+	setHeader(func(h *header) { h.compatFlags |= 1 << 31 })
+	db, err = Open(path, 0, nil)
+	if err != nil {
+		t.Fatal("Unknown optional feature refused", err)
+	}
+	db.Close()
+
+	setHeader(func(h *header) { h.flags |= 1 << 31 })
+	if _, err := Open(path, 0, nil); err == nil || !strings.Contains(err.Error(), "newer EbakusDB") {
+		t.Fatal("Unknown required feature not refused", err)
+	}
+
+	setHeader(func(h *header) { h.flags &^= 1 << 31; h.version = 99 })
+	if _, err := Open(path, 0, nil); err == nil || !strings.Contains(err.Error(), "version 99 needs a newer EbakusDB, version 4 is supported") {
+		t.Fatal("Newer version not refused", err)
+	}
+}
+
+func Test_Layout(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		offset, expect uintptr
+	}{
+		{"header.root", unsafe.Offsetof(header{}.root), 8},
+		{"header.cipherCheck", unsafe.Offsetof(header{}.cipherCheck), 24},
+		{"header.compatFlags", unsafe.Offsetof(header{}.compatFlags), 48},
+		{"header", unsafe.Sizeof(header{}), 72},
+		{"Node.prefixPtr", unsafe.Offsetof(Node{}.prefixPtr), 8},
+		{"Node", unsafe.Sizeof(Node{}), 24},
+		{"nodeLeaf.nodePtr", unsafe.Offsetof(nodeLeaf{}.nodePtr), 32},
+		{"node4.edges", unsafe.Offsetof(node4{}.edges), 32},
+		{"node4.leaf", unsafe.Offsetof(node4{}.leaf), 64},
+		{"node16.leaf", unsafe.Offsetof(node16{}.leaf), 152},
+		{"node16Sparse.edges", unsafe.Offsetof(node16Sparse{}.edges), 40},
+		{"node48.edges", unsafe.Offsetof(node48{}.edges), 280},
+		{"node256.leaf", unsafe.Offsetof(node256{}.leaf), 2072},
+		{"ByteArray.flags", unsafe.Offsetof(ByteArray{}.flags), 12},
+		{"leaseTable.roots", unsafe.Offsetof(leaseTable{}.roots), 8},
+		{"leaseTable.leases", unsafe.Offsetof(leaseTable{}.leases), 2056},
+		{"lease", unsafe.Sizeof(lease{}), 16},
+	} {
+		if c.offset != c.expect {
+			t.Fatal("Wrong layout of", c.name, c.offset, c.expect)
+		}
+	}
+}
+
+// Test_FileFormat decodes testdata/v4.db by the layout of format.go alone
+func Test_FileFormat(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/v4.db")
+	if err != nil {
+		t.Fatal("Failed to read fixture", err)
+	}
+	le := binary.LittleEndian
+
+	if le.Uint32(b[0:]) != 0xff01cf11 || le.Uint32(b[4:]) != 4 || le.Uint32(b[16:]) != 0 {
+		t.Fatal("Wrong header", b[:24])
+	}
+	a := b[72:]
+	if le.Uint32(a[0:]) != 0xca01af01 || le.Uint16(a[8:]) != pageSize || le.Uint16(a[10:]) != 3 {
+		t.Fatal("Wrong allocator header", a[:16])
+	}
+
+	bytesAt := func(ref []byte) []byte {
+		size := le.Uint32(ref[8:])
+		if le.Uint32(ref[12:])&byteArrayInline != 0 {
+			return ref[:size]
+		}
+		offset := le.Uint64(ref[0:])
+		if offset == 0 {
+			return nil
+		}
+		return b[offset+8 : offset+8+uint64(size)]
+	}
+
+	found := make(map[string]string)
+	var walk func(offset uint64)
+	walk = func(offset uint64) {
+		if offset == 0 {
+			return
+		}
+		n := b[offset:]
+		var edges []byte
+		var leaf uint64
+		switch n[4] {
+		case 0:
+			edges, leaf = n[24:152], 152
+		case 1:
+			leaf = 24
+		case 2:
+			edges, leaf = n[32:32+8*uint64(n[5])], 64
+		case 3:
+			edges, leaf = n[40:40+8*uint64(n[5])], 168
+		case 4:
+			edges, leaf = n[280:664], 664
+		case 5:
+			edges, leaf = n[24:2072], 2072
+		default:
+			t.Fatal("Unknown node kind", n[4])
+		}
+		if nibbles := bytesAt(n[leaf:]); nibbles != nil {
+			key := make([]byte, len(nibbles)/2)
+			for i := range key {
+				key[i] = nibbles[2*i]<<4 | nibbles[2*i+1]
+			}
+			found[string(key)] = string(bytesAt(n[leaf+16:]))
+		}
+		for i := 0; i < len(edges); i += 8 {
+			walk(le.Uint64(edges[i:]))
+		}
+	}
+	walk(le.Uint64(b[8:]))
+
+	if len(found) != 31 || found["tiny"] != "inline" {
+		t.Fatal("Wrong entries decoded", len(found), found["tiny"])
+	}
+	for i := 0; i < 30; i++ {
+		if v := found[fmt.Sprintf("key%03d", i)]; v != fmt.Sprintf("value %03d of the fixture", i) {
+			t.Fatal("Wrong value decoded", i, v)
+		}
+	}
+
+	// And the database reads the same
+	db, err := OpenFromBytes(b, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal("Failed to open fixture", err)
+	}
+	defer db.Close()
+	snap := db.GetRootSnapshot()
+	defer snap.Release()
+	for k, v := range found {
+		if got, ok, _ := snap.Get([]byte(k)); !ok || string(*got) != v {
+			t.Fatal("Get failed", k, got)
+		}
+	}
+}
+
+func Test_Radix256(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, &Options{Radix: Radix256})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	mm := db.allocator
+
+	snap := db.GetRootSnapshot()
+	kinds := map[int]nodeKind{4: nodeKind4, 16: nodeKind16Sparse, 48: nodeKind48, 256: nodeKind256}
+	for i := 0; i < 256; i++ {
+		snap.Insert([]byte{'k', byte(i)}, []byte{byte(i)})
+
+		if kind, ok := kinds[i+1]; ok {
+			child := snap.RootNode().edgeRef('k').getNode(mm)
+			if child.kind != kind || child.edgeCount() != i+1 {
+				t.Fatal("Wrong node layout", i+1, child.kind, child.edgeCount())
+			}
+		}
+	}
+
+	iter := snap.Iter()
+	for i := 0; i < 256; i++ {
+		k, v, ok := iter.Next()
+		if !ok || !bytes.Equal(k, []byte{'k', byte(i)}) || v[0] != byte(i) {
+			t.Fatal("Iterated wrong key", k, ok)
+		}
+	}
+	iter = snap.Iter()
+	for i := 255; i >= 0; i-- {
+		k, _, ok := iter.Prev()
+		if !ok || !bytes.Equal(k, []byte{'k', byte(i)}) {
+			t.Fatal("Iterated wrong key", k, ok)
+		}
+	}
+
+	type Witness struct {
+		Id    uint64
+		Stake uint64
+	}
+
+	snap.CreateTable("Witnesses", &Witness{})
+	snap.CreateIndex(IndexField{
+		Table: "Witnesses",
+		Field: "Stake",
+	})
+	for i := 0; i < 10; i++ {
+		snap.InsertObj("Witnesses", &Witness{Id: uint64(i), Stake: uint64(100 - i)})
+	}
+
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	db.Close()
+
+	db, err = Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to reopen db", err)
+	}
+	defer db.Close()
+	mm = db.allocator
+
+	if db.radix != Radix256 {
+		t.Fatal("Radix mode not persisted")
+	}
+
+	snap = db.GetRootSnapshot()
+	orderClause, _ := snap.OrderParser([]byte("Stake ASC"))
+	resIter, err := snap.Select("Witnesses", nil, orderClause)
+	if err != nil {
+		t.Fatal("Failed to create iterator", err)
+	}
+	var w Witness
+	for i := 9; i >= 0; i-- {
+		if !resIter.Next(&w) || w.Id != uint64(i) {
+			t.Fatal("Returned wrong row", w)
+		}
+	}
+
+	for i := 0; i < 255; i++ {
+		if !snap.Delete([]byte{'k', byte(i)}) {
+			t.Fatal("Failed to delete key", i)
+		}
+	}
+
+	child := snap.RootNode().edgeRef('k').getNode(mm)
+	if child.kind != nodeKind0 || !child.isLeaf() {
+		t.Fatal("Expected the last key merged into a leaf", child.kind)
+	}
+
+	if v, found, _ := snap.Get([]byte{'k', 0xff}); !found || (*v)[0] != 0xff {
+		t.Fatal("Get failed", v)
+	}
+	snap.Release()
+}
+
+func Test_OmitLeafKeys(t *testing.T) {
+	keys := []string{"a", "ab", "abc", "abd", "b", "ba", "bab", "key", "key1", "key10", "key2", "z"}
+
+	for _, radix := range []RadixMode{Radix16, Radix256} {
+		path := tempfile()
+		defer os.Remove(path)
+
+		db, err := Open(path, 0, &Options{Radix: radix, OmitLeafKeys: true})
+		if err != nil || db == nil {
+			t.Fatal("Failed to open db", err)
+		}
+
+		snap := db.GetRootSnapshot()
+		for _, k := range keys {
+			snap.Insert([]byte(k), []byte("value of "+k))
+		}
+		if !snap.RootNode().edgeRef(db.encodeKey([]byte("z"))[0]).getNode(db.allocator).leaf().keyPtr.isNull() {
+			t.Fatal("Leaf key stored")
+		}
+		db.SetRootSnapshot(snap)
+		snap.Release()
+		db.Close()
+
+		db, err = Open(path, 0, nil)
+		if err != nil || db == nil {
+			t.Fatal("Failed to reopen db", err)
+		}
+		if !db.omitLeafKeys {
+			t.Fatal("Leaf keys mode not persisted")
+		}
+
+		snap = db.GetRootSnapshot()
+		iter := snap.Iter()
+		for _, k := range keys {
+			key, v, ok := iter.Next()
+			if !ok || string(key) != k || string(v) != "value of "+k {
+				t.Fatal("Iterated wrong key", string(key), k)
+			}
+		}
+		if _, _, ok := iter.Next(); ok {
+			t.Fatal("Iterated past the last key")
+		}
+
+		// Prev visits a node before its children, compare with a database
+		// that stores the leaf keys
+		ref, _ := OpenInMemory(&Options{Radix: radix})
+		refSnap := ref.GetRootSnapshot()
+		for _, k := range keys {
+			refSnap.Insert([]byte(k), []byte("value of "+k))
+		}
+		refIter := refSnap.Iter()
+		iter = snap.Iter()
+		for range keys {
+			key, _, ok := iter.Prev()
+			refKey, _, _ := refIter.Prev()
+			if !ok || !bytes.Equal(key, refKey) {
+				t.Fatal("Iterated wrong key", string(key), string(refKey))
+			}
+		}
+		refSnap.Release()
+		ref.Close()
+
+		iter = snap.Iter()
+		iter.SeekPrefix([]byte("ke"))
+		for _, k := range []string{"key", "key1", "key10", "key2"} {
+			key, _, ok := iter.Next()
+			if !ok || string(key) != k {
+				t.Fatal("Iterated wrong key after seek", string(key), k)
+			}
+		}
+
+		iter = snap.Iter()
+		iter.SeekPrefix([]byte("ab"))
+		iter.SeekPrefix([]byte("d"))
+		if key, _, ok := iter.Next(); !ok || string(key) != "abd" {
+			t.Fatal("Iterated wrong key after second seek", string(key))
+		}
+
+		snap.Delete([]byte("ab"))
+		snap.Delete([]byte("key1"))
+
+		iter = snap.Iter()
+		for _, k := range keys {
+			if k == "ab" || k == "key1" {
+				continue
+			}
+			if key, _, ok := iter.Next(); !ok || string(key) != k {
+				t.Fatal("Iterated wrong key after delete", string(key), k)
+			}
+		}
+
+		snap.Release()
+		db.Close()
+	}
+}
+
+type testCompressor struct{}
+
+func (testCompressor) ID() uint8 { return 1 }
+
+func (testCompressor) Compress(src []byte) []byte { return src }
+
+func (testCompressor) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+func Test_Compression(t *testing.T) {
+	db, err := OpenInMemory(&Options{Compression: map[string]Compressor{"c_": FlateCompressor}})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	mm := db.allocator
+
+	if err := RegisterCompressor(testCompressor{}); err == nil {
+		t.Fatal("Registered compressor with a used id")
+	}
+
+	compressible := bytes.Repeat([]byte("compressible "), 100)
+	random := []byte(RandomString(100))
+
+	snap := db.GetRootSnapshot()
+	snap.Insert([]byte("c_1"), compressible)
+	snap.Insert([]byte("c_2"), random)
+	snap.Insert([]byte("p_1"), compressible)
+
+	for _, c := range []struct {
+		key   string
+		value []byte
+		codec uint8
+	}{
+		{"c_1", compressible, FlateCompressor.ID()},
+		{"c_2", random, 0},
+		{"p_1", compressible, 0},
+	} {
+		l := snap.RootNode().getLeaf(db, db.encodeKey([]byte(c.key)))
+		if l.valPtr.codec() != c.codec {
+			t.Fatal("Stored with wrong compressor", c.key, l.valPtr.codec())
+		}
+		if c.codec != 0 && l.valPtr.Size >= uint32(len(c.value)) {
+			t.Fatal("Value not compressed", c.key, l.valPtr.Size)
+		}
+
+		if v, found, _ := snap.Get([]byte(c.key)); !found || !bytes.Equal(*v, c.value) {
+			t.Fatal("Get failed", c.key)
+		}
+
+		r, _, _ := snap.GetReader([]byte(c.key))
+		if v, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(v, c.value) {
+			t.Fatal("GetReader failed", c.key, err)
+		}
+		r.Close()
+	}
+
+	if db.header.flags&flagCompression == 0 {
+		t.Fatal("Compression header flag not set")
+	}
+
+	iter := snap.Iter()
+	for _, v := range [][]byte{compressible, random, compressible} {
+		if _, value, ok := iter.Next(); !ok || !bytes.Equal(value, v) {
+			t.Fatal("Iterated wrong value")
+		}
+	}
+
+	if old, _ := snap.Insert([]byte("c_1"), []byte("new")); old == nil || !bytes.Equal(*old, compressible) {
+		t.Fatal("Wrong old value returned")
+	}
+
+	type Phone struct {
+		Id    uint64
+		Name  string
+		Phone string
+	}
+
+	if err := snap.CreateCompressedTable("PhoneBook", &Phone{}, FlateCompressor); err != nil {
+		t.Fatal("Failed to create table", err)
+	}
+	snap.CreateIndex(IndexField{
+		Table: "PhoneBook",
+		Field: "Phone",
+	})
+
+	name := string(bytes.Repeat([]byte("Harry "), 50))
+	for i := 0; i < 10; i++ {
+		if err := snap.InsertObj("PhoneBook", &Phone{Id: uint64(i), Name: name, Phone: fmt.Sprintf("555-%d", 9-i)}); err != nil {
+			t.Fatal("Failed to insert row error:", err)
+		}
+	}
+
+	// Updating has to decompress the old row to fix the index
+	if err := snap.InsertObj("PhoneBook", &Phone{Id: 0, Name: "Natasa", Phone: "555-99"}); err != nil {
+		t.Fatal("Failed to update row error:", err)
+	}
+
+	if err := snap.DeleteObj("PhoneBook", uint64(5)); err != nil {
+		t.Fatal("Failed to delete row error:", err)
+	}
+
+	orderClause, _ := snap.OrderParser([]byte("Phone"))
+	resIter, err := snap.Select("PhoneBook", nil, orderClause)
+	if err != nil {
+		t.Fatal("Failed to create iterator error:", err)
+	}
+
+	var p Phone
+	for _, id := range []uint64{9, 8, 7, 6, 4, 3, 2, 1, 0} {
+		if !resIter.Next(&p) || p.Id != id {
+			t.Fatal("Returned wrong row", p.Id, id)
+		}
+		if id != 0 && p.Name != name {
+			t.Fatal("Returned wrong name", p.Name)
+		}
+	}
+	if p.Name != "Natasa" {
+		t.Fatal("Row not updated", p.Name)
+	}
+
+	mm.Lock()
+	tbl, _, _ := snap.get(getTableKey("PhoneBook"))
+	mm.Unlock()
+	var table Table
+	db.decode(*tbl, &table)
+	if table.Codec != FlateCompressor.ID() {
+		t.Fatal("Table compressor not recorded", table.Codec)
+	}
+
+	snap.Release()
+}
+
+// magicCompressor prefixes the values it compresses, failing to decompress
+// values without the prefix. Its slice field makes it not comparable.
+type magicCompressor struct {
+	magic []byte
+}
+
+func (magicCompressor) ID() uint8 { return 200 }
+
+func (c magicCompressor) Compress(src []byte) []byte {
+	return append(append([]byte{}, c.magic...), FlateCompressor.Compress(src)...)
+}
+
+func (c magicCompressor) Decompress(src []byte) ([]byte, error) {
+	if !bytes.HasPrefix(src, c.magic) {
+		return nil, fmt.Errorf("Missing magic")
+	}
+	return FlateCompressor.Decompress(src[len(c.magic):])
+}
+
+func Test_CorruptValue(t *testing.T) {
+	c := magicCompressor{magic: []byte("magic")}
+	if err := RegisterCompressor(c); err != nil {
+		t.Fatal("Failed to register compressor", err)
+	}
+	if err := RegisterCompressor(magicCompressor{magic: []byte("magic")}); err != nil {
+		t.Fatal("Failed to register compressor of the same type", err)
+	}
+
+	db, err := OpenInMemory(&Options{Compression: map[string]Compressor{"m_": c}})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	snap := db.GetRootSnapshot()
+	defer snap.Release()
+	snap.Insert([]byte("m_1"), value)
+
+	l := snap.RootNode().getLeaf(db, db.encodeKey([]byte("m_1")))
+	if l.valPtr.codec() != c.ID() {
+		t.Fatal("Stored with wrong compressor", l.valPtr.codec())
+	}
+	l.valPtr.getBytes(db.allocator)[0] ^= 0xff
+
+	if _, found, err := snap.Get([]byte("m_1")); !found || err == nil {
+		t.Fatal("Corrupt value read", found, err)
+	}
+	if _, found, err := snap.GetReader([]byte("m_1")); !found || err == nil {
+		t.Fatal("Corrupt value streamed", found, err)
+	}
+
+	iter := snap.Iter()
+	if _, _, ok := iter.Next(); ok || iter.Err() == nil {
+		t.Fatal("Corrupt value iterated", iter.Err())
+	}
+	iter.Release()
+
+	if old, _ := snap.Insert([]byte("m_1"), []byte("new")); old != nil {
+		t.Fatal("Corrupt old value returned")
+	}
+	if v, found, err := snap.Get([]byte("m_1")); !found || err != nil || string(*v) != "new" {
+		t.Fatal("Corrupt value not replaced", err)
+	}
+}
+
+func newTestCipher(t *testing.T, key byte) *Cipher {
+	c, err := NewCipher(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_Encryption(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	if _, err := Open(path, 0, &Options{EncryptKeys: true}); err != ErrCipherRequired {
+		t.Fatal("Opened with encrypted keys and no cipher", err)
+	}
+
+	db, err := Open(path, 0, &Options{Cipher: newTestCipher(t, 1), EncryptKeys: true})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	type Witness struct {
+		Id    uint64
+		Stake uint64
+		Name  string
+	}
+
+	snap := db.GetRootSnapshot()
+	keys := []string{"secretkey1", "secretkey2", "secretkey10", "other"}
+	for _, k := range keys {
+		snap.Insert([]byte(k), []byte("secretvalue of "+k))
+	}
+	snap.CreateTable("Witnesses", &Witness{})
+	snap.CreateIndex(IndexField{
+		Table: "Witnesses",
+		Field: "Stake",
+	})
+	for i := 0; i < 10; i++ {
+		snap.InsertObj("Witnesses", &Witness{Id: uint64(i), Stake: uint64(100 - i), Name: "secretname"})
+	}
+
+	// The primary keys are also the values of the index entries
+	type Account struct {
+		Id    string
+		Owner string
+	}
+	snap.CreateTable("Accounts", &Account{})
+	snap.CreateIndex(IndexField{
+		Table: "Accounts",
+		Field: "Owner",
+	})
+	snap.InsertObj("Accounts", &Account{Id: "secretaccount", Owner: "owner"})
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	db.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	for _, s := range []string{"secretkey", "secretvalue", "secretname", "secretaccount", "Witnesses"} {
+		if bytes.Contains(data, []byte(s)) {
+			t.Fatal("Plain text found in the file", s)
+		}
+	}
+	if pk, _ := db.encode([]byte("secretaccount")); bytes.Contains(data, pk) {
+		t.Fatal("Primary key found in the file")
+	}
+
+	if _, err := Open(path, 0, nil); err != ErrCipherRequired {
+		t.Fatal("Opened encrypted db without cipher", err)
+	}
+	if _, err := Open(path, 0, &Options{Cipher: newTestCipher(t, 2)}); err != ErrWrongCipher {
+		t.Fatal("Opened encrypted db with wrong cipher", err)
+	}
+
+	check := func(db *DB) {
+		snap := db.GetRootSnapshot()
+		defer snap.Release()
+
+		for _, k := range keys {
+			if v, found, _ := snap.Get([]byte(k)); !found || string(*v) != "secretvalue of "+k {
+				t.Fatal("Get failed", k, v)
+			}
+		}
+
+		found := make(map[string]bool)
+		iter := snap.Iter()
+		iter.SeekPrefix([]byte("secretkey1"))
+		for {
+			k, v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if string(v) != "secretvalue of "+string(k) {
+				t.Fatal("Iterated wrong value", string(k), string(v))
+			}
+			found[string(k)] = true
+		}
+		if len(found) != 2 || !found["secretkey1"] || !found["secretkey10"] {
+			t.Fatal("SeekPrefix returned wrong keys", found)
+		}
+
+		var last []byte
+		iter = snap.Iter()
+		for {
+			k, _, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if bytes.Compare(k, last) <= 0 {
+				t.Fatal("Iterated out of order", string(last), string(k))
+			}
+			last = k
+		}
+
+		orderClause, _ := snap.OrderParser([]byte("Stake ASC"))
+		resIter, err := snap.Select("Witnesses", nil, orderClause)
+		if err != nil {
+			t.Fatal("Failed to create iterator", err)
+		}
+		var w Witness
+		for i := 9; i >= 0; i-- {
+			if !resIter.Next(&w) || w.Id != uint64(i) || w.Name != "secretname" {
+				t.Fatal("Returned wrong row", w)
+			}
+		}
+	}
+
+	db, err = Open(path, 0, &Options{Cipher: newTestCipher(t, 1)})
+	if err != nil || db == nil {
+		t.Fatal("Failed to reopen db", err)
+	}
+	check(db)
+
+	if err := db.Rekey(nil); err == nil {
+		t.Fatal("Decrypted db with encrypted keys")
+	}
+
+	// Roots retained apart from the root would keep the old cipher
+	snap = db.GetRootSnapshot()
+	if err := db.Rekey(newTestCipher(t, 1)); err != ErrRootsInUse {
+		t.Fatal("Rekeyed a retained root", err)
+	}
+	old := snap.Snapshot()
+	snap.Insert([]byte("other"), []byte("secretvalue of other"))
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	if err := db.Rekey(newTestCipher(t, 1)); err != ErrRootsInUse {
+		t.Fatal("Rekeyed with an old root retained", err)
+	}
+	old.Release()
+
+	// The rebuilt root trie depends on the keys, so compare the memory used
+	// after rekeying twice to the same cipher
+	if err := db.Rekey(newTestCipher(t, 1)); err != nil {
+		t.Fatal("Failed to rekey", err)
+	}
+	used := db.allocator.GetUsed()
+	if err := db.Rekey(newTestCipher(t, 2)); err != nil {
+		t.Fatal("Failed to rekey", err)
+	}
+	check(db)
+	if err := db.Rekey(newTestCipher(t, 1)); err != nil {
+		t.Fatal("Failed to rekey", err)
+	}
+	if db.allocator.GetUsed() != used {
+		t.Fatal("Rekey leaked memory", db.allocator.GetUsed(), used)
+	}
+	if err := db.Rekey(newTestCipher(t, 2)); err != nil {
+		t.Fatal("Failed to rekey", err)
+	}
+	db.Close()
+
+	if _, err := Open(path, 0, &Options{Cipher: newTestCipher(t, 1)}); err != ErrWrongCipher {
+		t.Fatal("Opened with the old cipher", err)
+	}
+	db, err = Open(path, 0, &Options{Cipher: newTestCipher(t, 2)})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open with the new cipher", err)
+	}
+	check(db)
+	db.Close()
+}
+
+func Test_CryptKeyOrder(t *testing.T) {
+	secret := newTestCipher(t, 1).secret
+	r := rand.New(rand.NewSource(1))
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = make([]byte, r.Intn(8))
+		r.Read(keys[i])
+		if i > 0 && r.Intn(2) == 0 {
+			keys[i] = append(append([]byte{}, keys[i-1]...), keys[i]...)
+		}
+	}
+
+	for i, k := range keys {
+		ek := cryptKey(secret, k, false)
+		if len(ek) != len(k)*2 || !bytes.Equal(cryptKey(secret, ek, true), k) {
+			t.Fatal("Failed to decrypt", k, ek)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := cryptKey(secret, keys[i-1], false)
+		if bytes.Compare(prev, ek) != bytes.Compare(keys[i-1], k) {
+			t.Fatal("Order changed", keys[i-1], k)
+		}
+		if bytes.HasPrefix(k, keys[i-1]) != bytes.HasPrefix(ek, prev) {
+			t.Fatal("Prefix changed", keys[i-1], k)
+		}
+	}
+}
+
+func Test_HKDF(t *testing.T) {
+	// RFC 5869 test case 3
+	okm := hkdf(bytes.Repeat([]byte{0x0b}, 22), "", 42)
+	if hex.EncodeToString(okm) != "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8" {
+		t.Fatal("Wrong output", hex.EncodeToString(okm))
+	}
+}
+
+func Test_EncryptionExistingValues(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	snap := db.GetRootSnapshot()
+	snap.Insert([]byte("plain"), []byte("plain value"))
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	db.Close()
+
+	db, err = Open(path, 0, &Options{Cipher: newTestCipher(t, 1)})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db with cipher", err)
+	}
+	snap = db.GetRootSnapshot()
+	snap.Insert([]byte("encrypted"), []byte("encrypted value"))
+	for _, k := range []string{"plain", "encrypted"} {
+		if v, found, _ := snap.Get([]byte(k)); !found || string(*v) != k+" value" {
+			t.Fatal("Get failed", k, v)
+		}
+	}
+	db.SetRootSnapshot(snap)
+	snap.Release()
+
+	if err := db.Rekey(nil); err != nil {
+		t.Fatal("Failed to decrypt", err)
+	}
+	db.Close()
+
+	db, err = Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open decrypted db", err)
+	}
+	defer db.Close()
+	for _, k := range []string{"plain", "encrypted"} {
+		if v, found, _ := db.Get([]byte(k)); !found || string(*v) != k+" value" {
+			t.Fatal("Get failed", k, v)
+		}
+	}
+}
+
+func tempfile() string {
+	f, err := ioutil.TempFile("/tmp", "ebakusdb-")
+	if err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		panic(err)
+	}
+	return f.Name()
+}
+
+func Test_Fragmentation(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db")
+	}
+	defer db.Close()
+
+	if f := db.GetInfo().Fragmentation; f != 0 {
+		t.Fatal("New database should not be fragmented", f)
+	}
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 1000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	}
+	for i := 0; i < 1000; i += 2 {
+		txn.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+
+	f := db.GetInfo().Fragmentation
+	if f <= 0 || f >= 1 {
+		t.Fatal("Incorrect fragmentation", f)
+	}
+
+	// Freed values are reused for values of the same size
+	watermark := db.GetInfo().Watermark
+	for i := 0; i < 1000; i += 2 {
+		txn.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	}
+	if db.GetInfo().Watermark != watermark || db.GetInfo().Fragmentation >= f {
+		t.Fatal("Free space not reused", db.GetInfo())
+	}
+
+	s := db.GetInfo().Allocator
+	if s.NodesUsed == 0 || s.DataUsed < 1000*200 || s.NodesUsed+s.DataUsed != s.Used {
+		t.Fatal("Incorrect space of nodes and data", s)
+	}
+
+	txn.Release()
+}
+
+func Test_HeapMemory(t *testing.T) {
+	db, err := OpenInMemory(&Options{SegmentSize: 64 * 1024})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	if _, err := OpenInMemory(&Options{SegmentSize: 16}); err == nil {
+		t.Fatal("Segments smaller than the header should fail")
+	}
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 5000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	db.SetRootSnapshot(txn)
+
+	info := db.GetInfo()
+	if info.TotalCapacity <= 64*1024 || info.TotalUsed < 5000*100 {
+		t.Fatal("Segments not added", info)
+	}
+
+	for i := 0; i < 5000; i++ {
+		v, ok, _ := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if !ok || !bytes.Equal(*v, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatal("Incorrect value", i)
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		txn.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	db.SetRootSnapshot(txn)
+	txn.Release()
+
+	if s := db.GetInfo().Allocator; s.DataUsed != 0 {
+		t.Fatal("Values not freed", s)
+	}
+}
+
+func Test_GrowInPlace(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	buffer := &db.buffer[0]
+	capacity := db.allocator.GetCapacity()
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 20000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	}
+	db.SetRootSnapshot(txn)
+
+	if db.allocator.GetCapacity() <= capacity {
+		t.Fatal("Database did not grow")
+	}
+	if &db.buffer[0] != buffer {
+		t.Fatal("Database mapped again")
+	}
+	if fi, err := os.Stat(path); err != nil || uint64(fi.Size()) != db.allocator.GetCapacity() {
+		t.Fatal("Incorrect file size", err)
+	}
+
+	for i := 0; i < 20000; i++ {
+		v, ok, _ := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if !ok || !bytes.Equal(*v, bytes.Repeat([]byte{byte(i)}, 200)) {
+			t.Fatal("Incorrect value", i)
+		}
+	}
+	txn.Release()
+}
+
+func Test_GrowError(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	// The file can not be resized through a read-only descriptor
+	rf, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	file, threshold := db.file, db.growThreshold
+	db.file, db.growThreshold = rf, 0.9999
+
+	snap := db.GetRootSnapshot()
+	defer snap.Release()
+	if err := snap.CreateTable("Phones", &struct{ Id uint64 }{}); err == nil || err == ErrDatabaseFull {
+		t.Fatal("Growth error not returned", err)
+	}
+	snap.Insert([]byte("key"), []byte("value"))
+	if _, found, _ := snap.Get([]byte("key")); found {
+		t.Fatal("Inserted while failing to grow")
+	}
+
+	db.file, db.growThreshold = file, threshold
+	snap.Insert([]byte("key"), []byte("value"))
+	if _, found, _ := snap.Get([]byte("key")); !found {
+		t.Fatal("Failed to insert")
+	}
+}
+
+func Test_GrowWithReaders(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	// Readers holding the lock do not stop growth within the mapping
+	db.allocator.Lock()
+	done := make(chan error)
+	go func() {
+		done <- db.growFor(16 * megaByte)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Failed to grow", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Growth waited for readers")
+	}
+	db.allocator.Unlock()
+
+	if db.allocator.GetFree() <= 16*megaByte {
+		t.Fatal("Database did not grow")
+	}
+}
+
+func Test_SaveToWhileGrowing(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	copyPath := tempfile()
+	defer os.Remove(copyPath)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	done := make(chan error)
+	go func() {
+		for i := 1; i <= 4; i++ {
+			if err := db.growFor(uint64(i) * 4 * megaByte); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < 4; i++ {
+		if err := db.SaveTo(copyPath); err != nil {
+			t.Fatal("Failed to save", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Failed to grow", err)
+	}
+
+	c, err := Open(copyPath, 0, nil)
+	if err != nil || c == nil {
+		t.Fatal("Failed to open the copy", err)
+	}
+	c.Close()
+}
+
+func Test_GrowPastMapSize(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, &Options{MapSize: megaByte})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 20000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	}
+	db.SetRootSnapshot(txn)
+	txn.Release()
+
+	if db.allocator.GetCapacity() <= megaByte {
+		t.Fatal("Database did not grow")
+	}
+	db.Close()
+
+	db, err = Open(path, 0, &Options{MapSize: megaByte})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	txn = db.GetRootSnapshot()
+	for i := 0; i < 20000; i++ {
+		v, ok, _ := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if !ok || !bytes.Equal(*v, bytes.Repeat([]byte{byte(i)}, 200)) {
+			t.Fatal("Incorrect value", i)
+		}
+	}
+	txn.Release()
+}
+
+func Test_SizeOptions(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	if _, err := OpenInMemory(&Options{InitialSize: 1024}); err == nil {
+		t.Fatal("Initial size smaller than the minimum should fail")
+	}
+	if _, err := OpenInMemory(&Options{InitialSize: 2 * megaByte, MaxSize: megaByte}); err == nil {
+		t.Fatal("Initial size larger than the maximum should fail")
+	}
+	if _, err := OpenInMemory(&Options{GrowThreshold: 1.5}); err == nil {
+		t.Fatal("Grow threshold larger than 1 should fail")
+	}
+
+	var grown []uint64
+	growth := func(capacity uint64) uint64 {
+		grown = append(grown, capacity)
+		return capacity + 256*kiloByte
+	}
+
+	db, err := Open(path, 0, &Options{InitialSize: 100 * kiloByte, GrowthFunc: growth, GrowThreshold: 0.5})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 100*kiloByte {
+		t.Fatal("Incorrect initial size", err)
+	}
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 2000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	}
+	db.SetRootSnapshot(txn)
+	txn.Release()
+
+	capacity := db.allocator.GetCapacity()
+	if len(grown) == 0 || (capacity-100*kiloByte)%(256*kiloByte) != 0 {
+		t.Fatal("Growth function not used", capacity)
+	}
+	if float64(db.allocator.GetFree()) < float64(capacity)*0.5 {
+		t.Fatal("Grow threshold not kept", db.allocator.GetFree(), capacity)
+	}
+}
+
+func Test_MaxSize(t *testing.T) {
+	type Phone struct {
+		Id    uint64
+		Phone string
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+
+	fileDB, err := Open(path, 0, &Options{MaxSize: 2 * megaByte})
+	if err != nil || fileDB == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer fileDB.Close()
+
+	memoryDB, err := OpenInMemory(&Options{MaxSize: 2 * megaByte})
+	if err != nil || memoryDB == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	heapDB, err := OpenInMemory(&Options{MaxSize: 2 * megaByte, SegmentSize: 256 * kiloByte})
+	if err != nil || heapDB == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	for _, db := range []*DB{fileDB, memoryDB, heapDB} {
+		txn := db.GetRootSnapshot()
+		if err := txn.CreateTable("PhoneBook", &Phone{}); err != nil {
+			t.Fatal("Failed to create table", err)
+		}
+
+		var i uint64
+		for ; i < 100000; i++ {
+			err = txn.InsertObj("PhoneBook", &Phone{Id: i, Phone: string(bytes.Repeat([]byte{'5'}, 500))})
+			if err != nil {
+				break
+			}
+		}
+		if err != ErrDatabaseFull {
+			t.Fatal("Database not full", err)
+		}
+		if c := db.allocator.GetCapacity(); c > 2*megaByte {
+			t.Fatal("Database larger than the maximum", c)
+		}
+
+		// Deleting makes room again
+		if err := txn.DeleteObj("PhoneBook", i-1); err != nil {
+			t.Fatal("Failed to delete", err)
+		}
+		if err := txn.InsertObj("PhoneBook", &Phone{Id: i - 1, Phone: "555"}); err != nil {
+			t.Fatal("Failed to insert", err)
+		}
+
+		txn.Release()
+	}
+}
+
+func Test_ReadOnly(t *testing.T) {
+	type Phone struct {
+		Id    uint64
+		Phone string
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+
+	if _, err := Open(path, 0, &Options{ReadOnly: true}); err == nil {
+		t.Fatal("Missing database opened read-only")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Read-only open created the database")
+	}
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	txn := db.GetRootSnapshot()
+	txn.Insert([]byte("key"), []byte("value"))
+	txn.Insert([]byte("large"), bytes.Repeat([]byte("large"), 1000))
+	if err := txn.CreateTable("PhoneBook", &Phone{}); err != nil {
+		t.Fatal("Failed to create table", err)
+	}
+	txn.InsertObj("PhoneBook", &Phone{Id: 1, Phone: "555-1234"})
+	db.SetRootSnapshot(txn)
+	txn.Release()
+	db.Close()
+
+	rdb, err := Open(path, 0, &Options{ReadOnly: true})
+	if err != nil || rdb == nil {
+		t.Fatal("Failed to open db read-only", err)
+	}
+
+	rtxn := rdb.GetRootSnapshot()
+	if v, ok, _ := rtxn.Get([]byte("key")); !ok || string(*v) != "value" {
+		t.Fatal("Incorrect value")
+	}
+	r, ok, _ := rtxn.GetReader([]byte("large"))
+	if !ok {
+		t.Fatal("Value not found")
+	}
+	if v, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(v, bytes.Repeat([]byte("large"), 1000)) {
+		t.Fatal("Incorrect value read", err)
+	}
+	r.Close()
+	iter, err := rtxn.Select("PhoneBook")
+	if err != nil {
+		t.Fatal("Failed to select", err)
+	}
+	var p Phone
+	if !iter.Next(&p) || p.Phone != "555-1234" {
+		t.Fatal("Incorrect row", p)
+	}
+
+	if _, ok := rtxn.Insert([]byte("key2"), []byte("value")); ok {
+		t.Fatal("Read-only insert succeeded")
+	}
+	if rtxn.Delete([]byte("key")) {
+		t.Fatal("Read-only delete succeeded")
+	}
+	if err := rtxn.InsertObj("PhoneBook", &Phone{Id: 2}); err != ErrReadOnly {
+		t.Fatal("Read-only insert of object succeeded", err)
+	}
+	if err := rtxn.DeleteObj("PhoneBook", uint64(1)); err != ErrReadOnly {
+		t.Fatal("Read-only delete of object succeeded", err)
+	}
+	if err := rtxn.CreateTable("Other", &Phone{}); err != ErrReadOnly {
+		t.Fatal("Read-only table creation succeeded", err)
+	}
+	if err := rdb.Grow(); err != ErrReadOnly {
+		t.Fatal("Read-only growth succeeded", err)
+	}
+
+	// Reference counts are not changed by readers
+	if rc := rdb.header.root.getNode(rdb.allocator).refCount; rc != 1 {
+		t.Fatal("Reader changed the reference count", rc)
+	}
+	snap := rtxn.Snapshot()
+	snap.Release()
+	rtxn.Release()
+
+	if err := rdb.Close(); err != nil {
+		t.Fatal("Failed to close", err)
+	}
+}
+
+func Test_Follow(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, &Options{MapSize: megaByte})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	db.Close()
+
+	if _, err := Open(path, 0, &Options{Follow: true}); err == nil {
+		t.Fatal("Followed a writer without a lease table")
+	}
+
+	db, err = Open(path, 0, &Options{MapSize: megaByte, Followers: true})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	txn := db.GetRootSnapshot()
+	txn.Insert([]byte("key"), []byte("value"))
+	db.SetRootSnapshot(txn)
+
+	// Followers do not lock the file the writer has locked
+	f, err := Open(path, 0, &Options{Follow: true, MapSize: megaByte})
+	if err != nil || f == nil {
+		t.Fatal("Failed to follow db", err)
+	}
+	defer f.Close()
+
+	old := f.GetRootSnapshot()
+	if v, ok, _ := old.Get([]byte("key")); !ok || string(*v) != "value" {
+		t.Fatal("Incorrect value")
+	}
+
+	// The writer replaces the root, growing the file past the mapping of
+	// the follower, while the old root is leased
+	txn.Delete([]byte("key"))
+	for i := 0; i < 20000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	}
+	db.SetRootSnapshot(txn)
+
+	if v, ok, _ := old.Get([]byte("key")); !ok || string(*v) != "value" {
+		t.Fatal("Leased root changed")
+	}
+	if _, ok, _ := f.Get([]byte("key")); ok {
+		t.Fatal("Change of the writer not seen")
+	}
+
+	s := f.GetRootSnapshot()
+	for i := 0; i < 20000; i++ {
+		v, ok, _ := s.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if !ok || !bytes.Equal(*v, bytes.Repeat([]byte{byte(i)}, 200)) {
+			t.Fatal("Incorrect value", i)
+		}
+	}
+	s.Snapshot().Release()
+	s.Release()
+
+	if n := db.leases().retired; n != 1 {
+		t.Fatal("Leased root not retired", n)
+	}
+	old.Release()
+
+	txn.Insert([]byte("key"), []byte("value"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 0 {
+		t.Fatal("Retired root not released", n)
+	}
+
+	// Roots the writer released can not be leased again
+	if s := f.Snapshot(old.GetId()); s != nil {
+		t.Fatal("Snapshot of a released root")
+	}
+
+	// Iterators of followers lease their root until released
+	iter := f.Iter()
+	txn.Insert([]byte("key"), []byte("iterated"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 1 {
+		t.Fatal("Iterated root not retired", n)
+	}
+	if k, v, ok := iter.Next(); !ok || string(k) != "key" || string(v) != "value" {
+		t.Fatal("Iterated root changed", string(k), string(v))
+	}
+	iter.Release()
+	txn.Insert([]byte("key"), []byte("value"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 0 {
+		t.Fatal("Iterated root not released", n)
+	}
+
+	// Readers of followers lease the root of their snapshot until closed
+	s = f.GetRootSnapshot()
+	r, ok, _ := s.GetReader([]byte("key"))
+	if !ok {
+		t.Fatal("Value not found")
+	}
+	s.Release()
+	txn.Insert([]byte("key"), []byte("read"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 1 {
+		t.Fatal("Read root not retired", n)
+	}
+	if v, err := ioutil.ReadAll(r); err != nil || string(v) != "value" {
+		t.Fatal("Read root changed", string(v), err)
+	}
+	r.Close()
+	txn.Insert([]byte("key"), []byte("value"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 0 {
+		t.Fatal("Read root not released", n)
+	}
+
+	// Leases of readers that died, whose slot lock is gone with their open
+	// file, are ended by the writer, even if their pid is alive
+	l := &db.leases().leases[0]
+	l.pid = uint32(os.Getpid())
+	l.root = uint64(db.header.root)
+
+	txn.Insert([]byte("key"), []byte("value2"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 0 || l.pid != 0 {
+		t.Fatal("Lease of a dead reader kept", n)
+	}
+
+	// Closing the file of a follower ends its leases, as a killed one does
+	g, err := Open(path, 0, &Options{Follow: true, MapSize: megaByte})
+	if err != nil || g == nil {
+		t.Fatal("Failed to follow db", err)
+	}
+	g.GetRootSnapshot()
+	txn.Insert([]byte("key"), []byte("value3"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 1 {
+		t.Fatal("Leased root not retired", n)
+	}
+	// The mappings hold the open file as well
+	g.munmapLeases()
+	g.munmap()
+	g.file.Close()
+	txn.Insert([]byte("key"), []byte("value4"))
+	db.SetRootSnapshot(txn)
+	if n := db.leases().retired; n != 0 {
+		t.Fatal("Lease of a closed follower kept", n)
+	}
+	txn.Release()
+}
+
+func Test_SaveTo(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := OpenInMemory(nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 1000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	snap := txn.Snapshot()
+	id := snap.GetId()
+	for i := 0; i < 1000; i += 2 {
+		txn.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	db.SetRootSnapshot(txn)
+	txn.Release()
+
+	if err := db.SaveTo(path); err != nil {
+		t.Fatal("Failed to save db", err)
+	}
+
+	check := func(db *DB) {
+		s := db.GetRootSnapshot()
+		old := db.Snapshot(id)
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key%04d", i))
+			if v, ok, _ := old.Get(k); !ok || !bytes.Equal(*v, bytes.Repeat([]byte{byte(i)}, 100)) {
+				t.Fatal("Incorrect value of snapshot", i)
+			}
+			if _, ok, _ := s.Get(k); ok != (i%2 == 1) {
+				t.Fatal("Incorrect key", i)
+			}
+		}
+		old.Release()
+		s.Release()
+	}
+
+	fdb, err := Open(path, 0, nil)
+	if err != nil || fdb == nil {
+		t.Fatal("Failed to open saved db", err)
+	}
+	check(fdb)
+	fdb.Close()
+
+	mdb, err := OpenInMemoryFrom(path, nil)
+	if err != nil || mdb == nil {
+		t.Fatal("Failed to load db", err)
+	}
+	check(mdb)
+
+	// Changes in memory are not written to the file
+	txn = mdb.GetRootSnapshot()
+	txn.Insert([]byte("new"), []byte("value"))
+	mdb.SetRootSnapshot(txn)
+	txn.Release()
+
+	fdb, err = Open(path, 0, nil)
+	if err != nil || fdb == nil {
+		t.Fatal("Failed to open saved db", err)
+	}
+	if _, ok, _ := fdb.Get([]byte("new")); ok {
+		t.Fatal("Loaded database changed the file")
+	}
+	fdb.Close()
+
+	snap.Release()
+
+	heap, err := OpenInMemory(&Options{SegmentSize: 64 * kiloByte})
+	if err != nil || heap == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	if err := heap.SaveTo(path); err == nil {
+		t.Fatal("Saved segmented db")
+	}
+}
+
+func Test_OpenFromBytes(t *testing.T) {
+	type Phone struct {
+		Id    uint64
+		Phone string
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	txn := db.GetRootSnapshot()
+	if err := txn.CreateTable("PhoneBook", &Phone{}); err != nil {
+		t.Fatal("Failed to create table", err)
+	}
+	for i := uint64(0); i < 100; i++ {
+		txn.InsertObj("PhoneBook", &Phone{Id: i, Phone: fmt.Sprintf("555-%04d", i)})
+	}
+	db.SetRootSnapshot(txn)
+	txn.Release()
+	db.Close()
+
+	image, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed to read db", err)
+	}
+	original := append([]byte(nil), image...)
+
+	check := func(db *DB) {
+		s := db.GetRootSnapshot()
+		iter, err := s.Select("PhoneBook")
+		if err != nil {
+			t.Fatal("Failed to select", err)
+		}
+		var p Phone
+		var count uint64
+		for iter.Next(&p) {
+			if p.Id != count || p.Phone != fmt.Sprintf("555-%04d", count) {
+				t.Fatal("Incorrect row", p)
+			}
+			count++
+		}
+		if count != 100 {
+			t.Fatal("Incorrect number of rows", count)
+		}
+		s.Release()
+	}
+
+	rdb, err := OpenFromBytes(image, &Options{ReadOnly: true})
+	if err != nil || rdb == nil {
+		t.Fatal("Failed to open db from bytes", err)
+	}
+	check(rdb)
+	if err := rdb.GetRootSnapshot().InsertObj("PhoneBook", &Phone{Id: 100}); err != ErrReadOnly {
+		t.Fatal("Read-only insert succeeded", err)
+	}
+
+	wdb, err := OpenFromBytes(image, nil)
+	if err != nil || wdb == nil {
+		t.Fatal("Failed to open db from bytes", err)
+	}
+	check(wdb)
+	txn = wdb.GetRootSnapshot()
+	if err := txn.InsertObj("PhoneBook", &Phone{Id: 100}); err != nil {
+		t.Fatal("Failed to insert", err)
+	}
+	txn.Release()
+
+	if !bytes.Equal(image, original) {
+		t.Fatal("Image changed")
+	}
+
+	adb, err := OpenReaderAt(bytes.NewReader(image), int64(len(image)), nil)
+	if err != nil || adb == nil {
+		t.Fatal("Failed to open db from reader", err)
+	}
+	check(adb)
+	if !adb.readOnly {
+		t.Fatal("Database from reader not read-only")
+	}
+
+	if _, err := OpenFromBytes(image[:16], nil); err == nil {
+		t.Fatal("Opened truncated image")
+	}
+	if _, err := OpenReaderAt(bytes.NewReader(image[:len(image)-4096]), int64(len(image)), nil); err == nil {
+		t.Fatal("Opened short reader")
+	}
+	if _, err := OpenReaderAt(bytes.NewReader(image), -1, nil); err != ErrInvalidSize {
+		t.Fatal("Opened negative size", err)
+	}
+	bad := append([]byte(nil), image...)
+	bad[0] ^= 0xff
+	if _, err := OpenFromBytes(bad, nil); err == nil {
+		t.Fatal("Opened image with incorrect magic")
+	}
+}
+
+func Test_MmapAdvice(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	if _, err := Open(path, 0, &Options{MmapAdvice: 99}); err == nil {
+		t.Fatal("Opened with unknown advice")
+	}
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	type Witness struct {
+		Id    uint64
+		Stake uint64
+	}
+
+	snap := db.GetRootSnapshot()
+	snap.CreateTable("Witnesses", &Witness{})
+	for i := 0; i < 100; i++ {
+		snap.InsertObj("Witnesses", &Witness{Id: uint64(i), Stake: uint64(i)})
+	}
+	db.SetRootSnapshot(snap)
+
+	// Scans advise sequential access until they end or are released
+	iter, err := snap.Select("Witnesses")
+	if err != nil {
+		t.Fatal("Failed to create iterator", err)
+	}
+	iter2, _ := snap.Select("Witnesses")
+	if db.scans != 2 {
+		t.Fatal("Scans not counted", db.scans)
+	}
+
+	// Releasing the iterator under a scan ends it as well
+	iter3, _ := snap.Select("Witnesses")
+	iter3.iter.Release()
+	if db.scans != 2 {
+		t.Fatal("Scan of a released iterator not ended", db.scans)
+	}
+	iter3.Release()
+	if db.scans != 2 {
+		t.Fatal("Scan ended twice", db.scans)
+	}
+	var w Witness
+	count := 0
+	for iter.Next(&w) {
+		count++
+	}
+	if count != 100 || db.scans != 1 {
+		t.Fatal("Scan not ended", count, db.scans)
+	}
+	iter.Release()
+	iter2.Release()
+	if db.scans != 0 {
+		t.Fatal("Scans not ended", db.scans)
+	}
+	snap.Release()
+
+	db.Warmup()
+	db.Close()
+
+	for _, advice := range []MmapAdvice{AdviceNormal, AdviceSequential, AdviceWillNeed} {
+		db, err := Open(path, 0, &Options{MmapAdvice: advice})
+		if err != nil {
+			t.Fatal("Failed to open with advice", advice, err)
+		}
+		db.Warmup()
+		snap := db.GetRootSnapshot()
+		iter, _ := snap.Select("Witnesses")
+		if db.scans != 0 {
+			t.Fatal("Scan changed advice", advice)
+		}
+		iter.Release()
+		snap.Release()
+		db.Close()
+	}
+}
+
+func Test_Logger(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	var out bytes.Buffer
+	db, err := Open(path, 0, &Options{InitialSize: 64 * 1024, Logger: NewLogger(&out, LevelInfo)})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	snap := db.GetRootSnapshot()
+	for i := 0; i < 1000; i++ {
+		snap.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{1}, 100))
+	}
+	db.SetRootSnapshot(snap)
+	snap.Release()
+
+	log := out.String()
+	if !strings.Contains(log, "INFO  Opened database path="+path) || strings.Contains(log, "DEBUG") {
+		t.Fatal("Open not logged", log)
+	}
+
+	// The writer waits for the lock of the open database
+	if _, err := Open(path, 0, &Options{LockTimeout: 2 * lockRetryInterval, Logger: NewLogger(&out, LevelDebug)}); err != ErrLocked {
+		t.Fatal("Opened locked database", err)
+	}
+	if !strings.Contains(out.String(), "Waiting for another process") {
+		t.Fatal("Wait not logged", out.String())
+	}
+
+	var tree, chunks bytes.Buffer
+	db.FprintTree(&tree)
+	db.FprintFreeChunks(&chunks)
+	if !strings.HasPrefix(tree.String(), "<>\n") || !strings.Contains(tree.String(), "key0999") {
+		t.Fatal("Tree not written", tree.String())
+	}
+	if !strings.Contains(chunks.String(), "Total free chunks") {
+		t.Fatal("Free chunks not written", chunks.String())
+	}
+}
+
+// testMetrics records the metrics of a database
+type testMetrics struct {
+	lock       sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]int64
+	histograms map[string]int
+}
+
+func (m *testMetrics) Counter(name string, delta int64) {
+	m.lock.Lock()
+	m.counters[name] += delta
+	m.lock.Unlock()
+}
+
+func (m *testMetrics) Gauge(name string, value int64) {
+	m.lock.Lock()
+	m.gauges[name] = value
+	m.lock.Unlock()
+}
+
+func (m *testMetrics) Histogram(name string, value float64) {
+	m.lock.Lock()
+	m.histograms[name]++
+	m.lock.Unlock()
+}
+
+func Test_Metrics(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	m := &testMetrics{
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]int64),
+		histograms: make(map[string]int),
+	}
+	db, err := Open(path, 0, &Options{InitialSize: 64 * 1024, Metrics: m})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+
+	type Witness struct {
+		Id    uint64
+		Stake uint64
+	}
+
+	snap := db.GetRootSnapshot()
+	for i := 0; i < 1000; i++ {
+		snap.Insert([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{1}, 100))
+	}
+	for i := 0; i < 100; i++ {
+		snap.Get([]byte(fmt.Sprintf("key%04d", i)))
+		snap.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	snap.CreateTable("Witnesses", &Witness{})
+	snap.InsertObj("Witnesses", &Witness{Id: 1, Stake: 1})
+	iter, _ := snap.Select("Witnesses")
+	iter.Release()
+	db.SetRootSnapshot(snap)
+	old := snap.Snapshot()
+	old.Release()
+	snap.Release()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for name, count := range map[string]int64{
+		MetricInsert:          1001,
+		MetricGet:             100,
+		MetricDelete:          100,
+		MetricSelect:          1,
+		MetricSnapshotRetain:  2,
+		MetricSnapshotRelease: 2,
+	} {
+		// Creating the table inserts and gets its schema
+		if m.counters[name] < count || m.counters[name] > count+2 {
+			t.Fatal("Wrong counter", name, m.counters[name])
+		}
+	}
+	if m.histograms[MetricInsertTime] != int(m.counters[MetricInsert]) || m.histograms[MetricSelectTime] != 1 {
+		t.Fatal("Latencies not observed", m.histograms)
+	}
+	if m.counters[MetricGrow] == 0 || m.histograms[MetricGrowTime] != int(m.counters[MetricGrow]) {
+		t.Fatal("Growth not counted", m.counters[MetricGrow])
+	}
+
+	info := db.GetInfo()
+	if m.gauges[MetricNodes] != info.Nodes || info.Nodes <= 0 || m.gauges[MetricMemoryCapacity] != int64(info.TotalCapacity) || m.gauges[MetricMemoryUsed] == 0 {
+		t.Fatal("Wrong gauges", m.gauges, info.Nodes)
+	}
+}
+
+func Test_NodeCount(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	snap := db.GetRootSnapshot()
+	for i := 0; i < 500; i++ {
+		snap.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte("value"))
+	}
+	db.SetRootSnapshot(snap)
+	snap.Release()
+	nodes := db.GetInfo().Nodes
+	db.Close()
+
+	// The nodes written before opening are counted
+	db, err = Open(path, 0, nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+	defer db.Close()
+	if n := db.GetInfo().Nodes; n != nodes {
+		t.Fatal("Wrong node count after opening", n, nodes)
+	}
+
+	snap = db.GetRootSnapshot()
+	for i := 0; i < 500; i++ {
+		snap.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	db.SetRootSnapshot(snap)
+	snap.Release()
+
+	var walked int64
+	db.walkNodes(func(Ptr, *Node) { walked++ })
+	if n := db.GetInfo().Nodes; n <= 0 || n != walked {
+		t.Fatal("Wrong node count after deleting", n, walked)
+	}
+
+	// Files from before the count was kept are counted when upgraded
+	fixture, err := ioutil.ReadFile("testdata/v4.db")
+	if err != nil {
+		t.Fatal("Failed to read fixture", err)
+	}
+	old := tempfile()
+	defer os.Remove(old)
+	if err := ioutil.WriteFile(old, fixture, 0666); err != nil {
+		t.Fatal(err)
+	}
+	odb, err := Open(old, 0, nil)
+	if err != nil || odb == nil {
+		t.Fatal("Failed to open fixture", err)
+	}
+	defer odb.Close()
+	walked = 0
+	odb.walkNodes(func(Ptr, *Node) { walked++ })
+	if n := odb.GetInfo().Nodes; n <= 0 || n != walked {
+		t.Fatal("Wrong node count after upgrading", n, walked)
 	}
-	return f.Name()
 }
@@ -0,0 +1,362 @@
+package ebakusdb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/ebakus/ebakusdb/balloc"
+)
+
+// faultyAllocator fails allocations of a database through a FaultInjector
+type faultyAllocator struct {
+	allocator
+	faults *balloc.FaultInjector
+}
+
+func (a *faultyAllocator) Allocate(size uint64, zero bool) (uint64, error) {
+	return a.faults.Allocate(size, zero)
+}
+
+func (a *faultyAllocator) AllocateNode(size uint64) (uint64, error) {
+	return a.faults.AllocateNode(size)
+}
+
+func (a *faultyAllocator) SetBuffer(bufPtr unsafe.Pointer, bufSize uint64, firstFree uint64) {
+	a.allocator.(resizableAllocator).SetBuffer(bufPtr, bufSize, firstFree)
+}
+
+func (a *faultyAllocator) Extend(bufSize uint64) {
+	a.allocator.(resizableAllocator).Extend(bufSize)
+}
+
+func openFaulty(t *testing.T, seed int64) (*DB, *balloc.FaultInjector) {
+	db, err := OpenInMemory(nil)
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	faults := balloc.NewFaultInjector(db.allocator, seed)
+	db.allocator = &faultyAllocator{allocator: db.allocator, faults: faults}
+
+	return db, faults
+}
+
+// checkNoLeaks checks that the memory of the database is back to used
+func checkNoLeaks(t *testing.T, db *DB, used uint64) {
+	db.allocator.Flush()
+	if u := db.allocator.GetUsed(); u != used {
+		t.Fatalf("Leaked %d bytes", int64(u)-int64(used))
+	}
+	if rc := db.header.root.getNode(db.allocator).refCount; rc != 1 {
+		t.Fatal("Incorrect root refcount", rc)
+	}
+}
+
+// checkContents checks that txn holds exactly the keys of model
+func checkContents(t *testing.T, txn *Snapshot, model map[string][]byte) {
+	for k, v := range model {
+		got, found, _ := txn.Get([]byte(k))
+		if !found || !bytes.Equal(*got, v) {
+			t.Fatalf("Incorrect value of %s", k)
+		}
+	}
+
+	count := 0
+	iter := txn.Iter()
+	for _, _, ok := iter.Next(); ok; _, _, ok = iter.Next() {
+		count++
+	}
+	if count != len(model) {
+		t.Fatal("Incorrect number of keys", count, len(model))
+	}
+}
+
+func faultValue(r *rand.Rand) []byte {
+	sizes := []int{4, 30, 200, 3000}
+	v := make([]byte, sizes[r.Intn(len(sizes))])
+	r.Read(v)
+	return v
+}
+
+func Test_FaultInsertDelete(t *testing.T) {
+	for _, scribble := range []bool{false, true} {
+		db, faults := openFaulty(t, 1)
+		used := db.allocator.GetUsed()
+
+		r := rand.New(rand.NewSource(1))
+		model := make(map[string][]byte)
+
+		txn := db.GetRootSnapshot()
+		faults.FailRate(0.05)
+		faults.Scribble(scribble)
+
+		var snaps []*Snapshot
+		for i := 0; i < 5000; i++ {
+			k := fmt.Sprintf("key%d", r.Intn(500))
+			failures := faults.Failures()
+
+			if r.Intn(3) == 0 {
+				deleted := txn.Delete([]byte(k))
+				_, found, _ := txn.Get([]byte(k))
+				if found {
+					if deleted || faults.Failures() == failures {
+						t.Fatal("Key not deleted", k)
+					}
+				} else {
+					delete(model, k)
+				}
+			} else {
+				v := faultValue(r)
+				txn.Insert([]byte(k), v)
+				got, found, _ := txn.Get([]byte(k))
+				if found && bytes.Equal(*got, v) {
+					model[k] = v
+				} else if faults.Failures() == failures {
+					t.Fatal("Key not inserted", k)
+				} else if old, ok := model[k]; ok != found || ok && !bytes.Equal(*got, old) {
+					t.Fatal("Failed insert changed the value of", k)
+				}
+			}
+
+			// Snapshots make the next changes copy the nodes they write
+			if i%100 == 0 {
+				snaps = append(snaps, txn.Snapshot())
+			}
+		}
+
+		faults.FailRate(0)
+		if faults.Failures() == 0 {
+			t.Fatal("No allocation failed")
+		}
+
+		checkContents(t, txn, model)
+
+		for _, s := range snaps {
+			s.Release()
+		}
+		txn.Release()
+
+		checkNoLeaks(t, db, used)
+		db.Close()
+	}
+}
+
+// Test_FaultEveryAllocation fails each allocation of a change in turn
+func Test_FaultEveryAllocation(t *testing.T) {
+	db, faults := openFaulty(t, 1)
+	used := db.allocator.GetUsed()
+
+	model := make(map[string][]byte)
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 40; i++ {
+		k := fmt.Sprintf("key%d", i*7)
+		model[k] = bytes.Repeat([]byte{byte(i)}, i*10)
+		txn.Insert([]byte(k), model[k])
+	}
+
+	changes := []struct {
+		key   string
+		value []byte
+	}{
+		{"key1", []byte("new edge")},
+		{"ke", []byte("split with leaf")},
+		{"kez", []byte("split with edge")},
+		{"key70", bytes.Repeat([]byte("update"), 100)},
+		{"key7", nil},
+		{"key266", nil},
+	}
+
+	for _, c := range changes {
+		for n := uint64(1); ; n++ {
+			before := txn.Snapshot()
+
+			failures := faults.Failures()
+			faults.FailAt(n)
+			if c.value != nil {
+				txn.Insert([]byte(c.key), c.value)
+			} else {
+				txn.Delete([]byte(c.key))
+			}
+			faults.FailAt(0)
+
+			failed := faults.Failures() != failures
+			if failed {
+				// Changes are applied whole or not at all
+				got, found, _ := txn.Get([]byte(c.key))
+				if c.value != nil && found && bytes.Equal(*got, c.value) {
+					model[c.key] = c.value
+				} else if c.value == nil && !found {
+					delete(model, c.key)
+				}
+			} else if c.value != nil {
+				model[c.key] = c.value
+			} else {
+				delete(model, c.key)
+			}
+			checkContents(t, txn, model)
+
+			before.Release()
+			if !failed {
+				break
+			}
+		}
+	}
+
+	txn.Release()
+	checkNoLeaks(t, db, used)
+}
+
+func Test_FaultTables(t *testing.T) {
+	type Phone struct {
+		Id    uint64
+		Name  string
+		Phone string
+	}
+
+	db, faults := openFaulty(t, 2)
+	used := db.allocator.GetUsed()
+
+	txn := db.GetRootSnapshot()
+	if err := txn.CreateTable("PhoneBook", &Phone{}); err != nil {
+		t.Fatal("Failed to create table", err)
+	}
+	if err := txn.CreateIndex(IndexField{Table: "PhoneBook", Field: "Phone"}); err != nil {
+		t.Fatal("Failed to create index", err)
+	}
+
+	r := rand.New(rand.NewSource(2))
+	faults.FailRate(0.05)
+
+	var errors int
+	for i := 0; i < 3000; i++ {
+		id := uint64(r.Intn(200))
+
+		var err error
+		if r.Intn(3) == 0 {
+			err = txn.DeleteObj("PhoneBook", id)
+		} else {
+			err = txn.InsertObj("PhoneBook", &Phone{
+				Id:    id,
+				Name:  fmt.Sprintf("Name %d", r.Intn(1000)),
+				Phone: fmt.Sprintf("555-%04d", r.Intn(20)),
+			})
+		}
+		if err != nil {
+			errors++
+		}
+
+		if i%100 == 0 {
+			txn.Snapshot().Release()
+		}
+	}
+
+	faults.FailRate(0)
+	if errors == 0 {
+		t.Fatal("No change failed")
+	}
+
+	iter, err := txn.Select("PhoneBook")
+	if err != nil {
+		t.Fatal("Failed to select", err)
+	}
+	var p Phone
+	for iter.Next(&p) {
+	}
+
+	txn.Release()
+	checkNoLeaks(t, db, used)
+}
+
+func Test_FaultRekey(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := Open(path, 0, &Options{Cipher: newTestCipher(t, 1), EncryptKeys: true})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open db", err)
+	}
+
+	type Witness struct {
+		Id    uint64
+		Stake uint64
+	}
+
+	txn := db.GetRootSnapshot()
+	for i := 0; i < 20; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte{byte(i)}, i*10))
+	}
+	txn.CreateTable("Witnesses", &Witness{})
+	txn.CreateIndex(IndexField{Table: "Witnesses", Field: "Stake"})
+	for i := 0; i < 10; i++ {
+		txn.InsertObj("Witnesses", &Witness{Id: uint64(i), Stake: uint64(100 - i)})
+	}
+	db.SetRootSnapshot(txn)
+	txn.Release()
+
+	check := func(db *DB) {
+		txn := db.GetRootSnapshot()
+		defer txn.Release()
+
+		for i := 0; i < 20; i++ {
+			v, found, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			if err != nil || !found || !bytes.Equal(*v, bytes.Repeat([]byte{byte(i)}, i*10)) {
+				t.Fatal("Wrong value", i, err)
+			}
+		}
+
+		orderClause, _ := txn.OrderParser([]byte("Stake ASC"))
+		iter, err := txn.Select("Witnesses", nil, orderClause)
+		if err != nil {
+			t.Fatal("Failed to select", err)
+		}
+		var w Witness
+		for i := 9; i >= 0; i-- {
+			if !iter.Next(&w) || w.Id != uint64(i) {
+				t.Fatal("Wrong row", w)
+			}
+		}
+		iter.Release()
+	}
+
+	// Every failure leaves the old root, cipher and memory, and the file
+	// opens with the old cipher
+	for n := uint64(1); ; n += 5 {
+		db.allocator.Flush()
+		used := db.allocator.GetUsed()
+
+		mm := db.allocator
+		faults := balloc.NewFaultInjector(mm, 1)
+		db.allocator = &faultyAllocator{allocator: mm, faults: faults}
+		faults.FailAt(n)
+		err := db.Rekey(newTestCipher(t, 2))
+		db.allocator = mm
+		if err == nil {
+			break
+		}
+		if faults.Failures() == 0 {
+			t.Fatal("Failed to rekey", err)
+		}
+
+		checkNoLeaks(t, db, used)
+		check(db)
+		db.Close()
+
+		db, err = Open(path, 0, &Options{Cipher: newTestCipher(t, 1)})
+		if err != nil || db == nil {
+			t.Fatal("Failed to open with the old cipher", n, err)
+		}
+		check(db)
+	}
+	db.Close()
+
+	db, err = Open(path, 0, &Options{Cipher: newTestCipher(t, 2)})
+	if err != nil || db == nil {
+		t.Fatal("Failed to open with the new cipher", err)
+	}
+	check(db)
+	db.Close()
+}
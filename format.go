@@ -0,0 +1,84 @@
+package ebakusdb
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// Database files are accessed in place through their mapping, so the
+// structs below are the file format, as laid out on little-endian 64-bit
+// hosts. Padding is spelled out so that the offsets are visible in the
+// structs. Offsets are from the start of the file and all pointers are
+// offsets.
+//
+// Fields are not encoded one by one, as nodes and values are read where
+// they lie on every lookup, so files only move between little-endian 64-bit
+// hosts. Big-endian and 32-bit hosts refuse them with
+// ErrUnsupportedPlatform.
+//
+//	header (72 bytes, at 0)
+//	   0 magic        uint32   0xff01cf11
+//	   4 version      uint32
+//	   8 root         uint64   root node
+//	  16 flags        uint32   features needed to read the file
+//	  24 cipherCheck  uint64
+//	  32 allocHeader  uint64   allocator header, zero when at 72
+//	  40 leases       uint64   lease table, zero when there is none
+//	  48 compatFlags  uint32   features that can be ignored
+//
+//	allocator header (776 bytes, see balloc, older versions end before
+//	the fields they lack: 56 bytes in version 0, 120 in 1, 248 in 2, 256
+//	in 3 and 768 in 4)
+//	   0 magic 0xca01af01 uint32, 4 BufferStart uint32, 8 PageSize uint16,
+//	  10 Version uint16, 16 DataWatermark, 24 FreePage, 32 TotalUsed,
+//	  40 LegacyLimit uint64, 48 LegacyPageSize uint16, 56 Classes [8]uint64,
+//	 120 Buckets [16]uint64, 248 NodesUsed uint64,
+//	 256 Cached [8][8]uint64, 768 Nodes uint64
+//
+//	byte array reference (16 bytes)
+//	   0 offset       uint64   the bytes themselves when inline
+//	   8 size         uint32
+//	  12 flags        uint32   inline, overflow, encrypted, codec id << 8
+//
+//	byte array data, at offset
+//	   0 refCount     int32
+//	   8 data, or the uint64 segment offsets of overflow arrays
+//
+//	node (24 bytes, followed by its layout)
+//	   0 refCount     int32
+//	   4 kind         uint8
+//	   5 numEdges     uint8
+//	   8 prefix       byte array reference
+//
+//	layouts by kind, edges are uint64 node offsets, zero when missing
+//	  0  edges [16] at 24, leaf at 152
+//	  1  leaf at 24
+//	  2  labels [4]byte at 24, edges [4] at 32, leaf at 64
+//	  3  labels [16]byte at 24, edges [16] at 40, leaf at 168
+//	  4  index [256]uint8 at 24, edges [48] at 280, leaf at 664
+//	  5  edges [256] at 24, leaf at 2072
+//
+//	leaf (40 bytes)
+//	   0 key          byte array reference, one byte per 4 bits of the
+//	                  key unless the file has flagRadix256
+//	  16 value        byte array reference
+//	  32 node         uint64   root of the rows of a table
+//
+//	lease table (whole pages, page aligned, at leases)
+//	   0 magic        uint32   0x1ea5e7ab
+//	   4 retired      uint32   number of retired roots
+//	   8 roots        [256]uint64 retired roots kept while leased
+//	2056 leases       [256] of pid uint32, 4 padding, root uint64
+
+// ErrUnsupportedPlatform is returned on hosts that are not little-endian
+// and 64-bit, which can not use the files in place
+var ErrUnsupportedPlatform = errors.New("Database files can only be used on little-endian 64-bit hosts")
+
+// platformError tells if the host can use the file format
+var platformError = func() error {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) != 1 || unsafe.Sizeof(uintptr(0)) != 8 {
+		return ErrUnsupportedPlatform
+	}
+	return nil
+}()
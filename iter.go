@@ -1,7 +1,6 @@
 package ebakusdb
 
 import (
-	"bytes"
 	"reflect"
 	"strings"
 
@@ -19,20 +18,73 @@ type Iterator struct {
 	rootNode Ptr
 	node     Ptr
 	stack    []edges
+	db       *DB
 	mm       balloc.MemoryManager
+
+	// Keys of the path to node and to the owners of the stack edges, only
+	// tracked when the database omits the leaf keys
+	nodeKey []byte
+	keys    [][]byte
+
+	// err is the error of reading a value, which ends the iteration
+	err error
+
+	// snap is the snapshot of a follower leasing the root, released with
+	// the iterator
+	snap *Snapshot
+
+	// endScan ends the sequential access advice of the scans of Select, when
+	// the iterator reaches its end or is released
+	endScan func()
 }
 
+// Release ends the use of the iterator and the scan it runs for Select.
+// Iterators of snapshots do not retain their root, the snapshot keeps it,
+// while those of followers made by DB.Iter end the lease of their root.
 func (i *Iterator) Release() {
-	i.rootNode.NodeRelease(i.mm)
+	i.stopScan()
+	if i.snap != nil {
+		i.snap.Release()
+		i.snap = nil
+	}
+}
+
+// stopScan ends the scan of the iterator, if any
+func (i *Iterator) stopScan() {
+	if i.endScan != nil {
+		i.endScan()
+		i.endScan = nil
+	}
+}
+
+// Err returns the error that ended the iteration, if a value could not be
+// read.
+func (i *Iterator) Err() error {
+	return i.err
+}
+
+// pathKey returns the key of node n, reached from a node with the parent key
+func (i *Iterator) pathKey(parent []byte, n *Node) []byte {
+	if !i.db.omitLeafKeys {
+		return nil
+	}
+	return concat(parent, n.prefixPtr.getBytes(i.mm))
+}
+
+// key returns the user key of an encoded key
+func (i *Iterator) key(k []byte) []byte {
+	return i.db.decryptKey(i.db.decodeKey(k))
 }
 
 func (i *Iterator) SeekPrefix(prefix []byte) {
-	prefix = encodeKey(prefix)
+	prefix = i.db.encodeKey(i.db.encryptKey(prefix))
 	i.stack = nil
 	n := i.node
 	if n.isNull() {
 		n = i.rootNode
+		i.nodeKey = nil
 	}
+	key := i.pathKey(i.nodeKey, n.getNode(i.mm))
 	search := prefix
 	for {
 		if len(search) == 0 {
@@ -40,18 +92,20 @@ func (i *Iterator) SeekPrefix(prefix []byte) {
 			return
 		}
 
-		nPtr := n.getNode(i.mm).edges[search[0]]
+		nPtr := n.getNode(i.mm).getEdge(search[0])
 		if nPtr.isNull() {
 			i.node = 0
 			return
 		}
+		i.nodeKey = key
 		n = nPtr
+		key = i.pathKey(i.nodeKey, n.getNode(i.mm))
 
-		nprefix := n.getNode(i.mm).prefixPtr.getBytes(i.mm)
-		if bytes.HasPrefix(search, nprefix) {
-			search = search[len(nprefix):]
+		nprefix := &n.getNode(i.mm).prefixPtr
+		if nprefix.isPrefixOf(i.mm, search) {
+			search = search[nprefix.Size:]
 
-		} else if bytes.HasPrefix(nprefix, search) {
+		} else if nprefix.hasPrefix(i.mm, search) {
 			i.node = n
 			return
 		} else {
@@ -68,37 +122,49 @@ func (i *Iterator) Next() ([]byte, []byte, bool) {
 				edge{node: i.node},
 			},
 		}
+		i.keys = [][]byte{i.nodeKey}
 	}
 
 	for len(i.stack) > 0 {
 		n := len(i.stack)
 		last := i.stack[n-1]
 		elem := last[0].node
+		parentKey := i.keys[n-1]
 
 		if len(last) > 1 {
 			i.stack[n-1] = last[1:]
 		} else {
 			i.stack = i.stack[:n-1]
+			i.keys = i.keys[:n-1]
 		}
 
-		es := make(edges, 0)
-		for k, nPtr := range elem.getNode(i.mm).edges {
-			if !nPtr.isNull() {
-				e := edge{key: byte(k), node: nPtr}
-				es = append(es, e)
-			}
-		}
+		elemNode := elem.getNode(i.mm)
+		elemKey := i.pathKey(parentKey, elemNode)
+		es := elemNode.edgeList()
 
 		if len(es) > 0 {
 			i.stack = append(i.stack, es)
+			i.keys = append(i.keys, elemKey)
 		}
 
-		elemNode := elem.getNode(i.mm)
 		if elemNode.isLeaf() {
-			return decodeKey(elemNode.keyPtr.getBytes(i.mm)), elemNode.valPtr.getBytes(i.mm), true
+			l := elemNode.leaf()
+			key := l.keyPtr.getBytes(i.mm)
+			if i.db.omitLeafKeys {
+				key = elemKey
+			}
+			v, err := i.db.getValue(&l.valPtr)
+			if err != nil {
+				i.err = err
+				i.stack = nil
+				i.stopScan()
+				return nil, nil, false
+			}
+			return i.key(key), v, true
 		}
 	}
 
+	i.stopScan()
 	return nil, nil, false
 }
 
@@ -109,38 +175,52 @@ func (i *Iterator) Prev() ([]byte, []byte, bool) {
 				edge{node: i.node},
 			},
 		}
+		i.keys = [][]byte{i.nodeKey}
 	}
 
 	for len(i.stack) > 0 {
 		n := len(i.stack)
 		last := i.stack[n-1]
 		elem := last[0].node
+		parentKey := i.keys[n-1]
 
 		if len(last) > 1 {
 			i.stack[n-1] = last[1:]
 		} else {
 			i.stack = i.stack[:n-1]
+			i.keys = i.keys[:n-1]
 		}
 
-		es := make(edges, 0)
 		elemNode := elem.getNode(i.mm)
-		for k, _ := range elemNode.edges {
-			nPtr := elemNode.edges[len(elemNode.edges)-k-1]
-			if !nPtr.isNull() {
-				e := edge{key: byte(k), node: nPtr}
-				es = append(es, e)
-			}
+		elemKey := i.pathKey(parentKey, elemNode)
+		es := elemNode.edgeList()
+		for l, r := 0, len(es)-1; l < r; l, r = l+1, r-1 {
+			es[l], es[r] = es[r], es[l]
 		}
 
 		if len(es) > 0 {
 			i.stack = append(i.stack, es)
+			i.keys = append(i.keys, elemKey)
 		}
 
 		if elemNode.isLeaf() {
-			return decodeKey(elemNode.keyPtr.getBytes(i.mm)), elemNode.valPtr.getBytes(i.mm), true
+			l := elemNode.leaf()
+			key := l.keyPtr.getBytes(i.mm)
+			if i.db.omitLeafKeys {
+				key = elemKey
+			}
+			v, err := i.db.getValue(&l.valPtr)
+			if err != nil {
+				i.err = err
+				i.stack = nil
+				i.stopScan()
+				return nil, nil, false
+			}
+			return i.key(key), v, true
 		}
 	}
 
+	i.stopScan()
 	return nil, nil, false
 }
 
@@ -153,18 +233,30 @@ type ResultIterator struct {
 
 	whereClause *WhereField
 	orderClause *OrderField
+
+	// err is the error of reading a row, which ends the iteration
+	err error
 }
 
 func (ri *ResultIterator) Release() {
 	ri.iter.Release()
 }
 
+// Err returns the error that ended the iteration, if a row could not be read.
+func (ri *ResultIterator) Err() error {
+	if ri.err != nil {
+		return ri.err
+	}
+	return ri.iter.Err()
+}
+
 func (ri *ResultIterator) Next(val interface{}) bool {
 	nextIter := func() ([]byte, []byte, bool) {
+		next := ri.iter.Next
 		if ri.orderClause.Order == DESC {
-			return ri.iter.Prev()
+			next = ri.iter.Prev
 		}
-		return ri.iter.Next()
+		return next()
 	}
 
 	zeroOutReflect(val)
@@ -221,8 +313,13 @@ func (ri *ResultIterator) Next(val interface{}) bool {
 			ri.entries = ri.entries[1:]
 		}
 
-		ik = encodeKey(ik)
-		value, ok := ri.tableRoot.getNode(ri.db.allocator).Get(ri.db, ik)
+		ik = ri.db.tableKey(ik)
+		value, ok, err := ri.tableRoot.getNode(ri.db.allocator).Get(ri.db, ik)
+		if err != nil {
+			ri.err = err
+			ri.iter.stopScan()
+			return false
+		}
 		if !ok {
 			return false
 		}
@@ -0,0 +1,353 @@
+package ebakusdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// maxLeases is the number of roots the readers following a writer can
+// lease at once
+const maxLeases = 256
+
+const leaseMagic uint32 = 0x1ea5e7ab
+
+// ErrLeasesUnsupported is returned when opening a follower, or a writer with
+// a lease table, on hosts without the locks the leases need
+var ErrLeasesUnsupported = errors.New("Followers are only supported on Linux")
+
+// ErrRootReleased is returned by followers for snapshots of roots they can
+// not lease, as the writer may have released them
+var ErrRootReleased = errors.New("Root is not leased and may have been released")
+
+// lease is a root leased by a reader process. The reader holds the lock of
+// the slot, see lockLease, while the lease lasts, so that the lease ends
+// when it dies. pid only tells who holds it.
+type lease struct {
+	pid  uint32
+	_    uint32
+	root uint64
+}
+
+// leaseTable lets readers of other processes follow a writer. Readers lease
+// the roots of their snapshots, as they can not retain them in a read-only
+// mapping, and the writer keeps the roots it replaced in retired while they
+// are leased, holding the reference the header had on them.
+type leaseTable struct {
+	magic   uint32
+	retired uint32
+	roots   [maxLeases]uint64
+	leases  [maxLeases]lease
+}
+
+// localLease counts the snapshots of a follower using a leased root
+type localLease struct {
+	slot  int
+	count int
+}
+
+// leases returns the lease table, or nil when the database has none
+func (db *DB) leases() *leaseTable {
+	if db.leaseMapping != nil {
+		return (*leaseTable)(unsafe.Pointer(&db.leaseMapping[0]))
+	}
+	if db.header.leases == 0 {
+		return nil
+	}
+	return (*leaseTable)(db.allocator.GetPtr(db.header.leases))
+}
+
+// leaseTableSize is the space of the lease table, whole pages so that
+// followers can map it writable on its own
+func leaseTableSize() uint64 {
+	page := uint64(os.Getpagesize())
+	return (uint64(unsafe.Sizeof(leaseTable{})) + page - 1) / page * page
+}
+
+// initLeases creates the lease table of a writer if asked to, and releases
+// the retired roots no longer leased
+func (db *DB) initLeases(create bool) error {
+	if db.header.leases == 0 && !create {
+		return nil
+	}
+	if err := checkLeaseLocks(); err != nil {
+		return err
+	}
+
+	if db.header.leases == 0 {
+		page := uint64(os.Getpagesize())
+		p, err := db.allocator.Allocate(leaseTableSize()+page, true)
+		if err != nil {
+			return fmt.Errorf("No room for the lease table: %s", err)
+		}
+		db.header.leases = (p + page - 1) / page * page
+		db.header.compatFlags |= compatLeases
+		db.leases().magic = leaseMagic
+	}
+
+	if db.leases().magic != leaseMagic {
+		return fmt.Errorf("Corrupted lease table")
+	}
+
+	db.retire(0)
+	return nil
+}
+
+// initFollower maps the lease table of a follower
+func (db *DB) initFollower() error {
+	if err := checkLeaseLocks(); err != nil {
+		return err
+	}
+	if db.header.leases == 0 {
+		return fmt.Errorf("Database has no lease table, its writer has to be opened with Followers")
+	}
+	if err := db.mmapLeases(); err != nil {
+		return err
+	}
+	if db.leases().magic != leaseMagic {
+		return fmt.Errorf("Corrupted lease table")
+	}
+
+	db.leased = make(map[Ptr]*localLease)
+	return nil
+}
+
+// followSnapshot returns a snapshot of root for a follower, or of the root
+// the writer last set when it is zero
+func (db *DB) followSnapshot(root Ptr) (*Snapshot, error) {
+	// The header moves when the file is mapped again
+	db.allocator.Lock()
+	root, err := db.leaseRoot(root)
+	db.allocator.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.followGrowth(); err != nil {
+		db.unleaseRoot(root)
+		return nil, err
+	}
+	db.count(MetricSnapshotRetain, 1)
+
+	return &Snapshot{
+		db:   db,
+		root: root,
+	}, nil
+}
+
+// retire releases root, which was replaced in the header, unless readers
+// following the writer have leased it. Retired roots still leased are
+// released by later calls once their leases end.
+func (db *DB) retire(root Ptr) {
+	mm := db.allocator
+
+	t := db.leases()
+	if t == nil {
+		root.NodeRelease(mm)
+		return
+	}
+
+	db.leaseLock.Lock()
+	defer db.leaseLock.Unlock()
+
+	retired := make([]Ptr, 0, t.retired+1)
+	for _, r := range t.roots[:t.retired] {
+		retired = append(retired, Ptr(r))
+	}
+	if root != 0 {
+		retired = append(retired, root)
+	}
+
+	leased := make(map[Ptr]bool)
+	for i := range t.leases {
+		l := &t.leases[i]
+		r := Ptr(atomic.LoadUint64(&l.root))
+		if r == 0 || leased[r] {
+			continue
+		}
+		if db.lockLease(i) {
+			// Readers that died do not release their leases
+			db.log.Warn("Ended the lease of a reader that died", "pid", atomic.LoadUint32(&l.pid), "root", r)
+			atomic.StoreUint64(&l.root, 0)
+			atomic.StoreUint32(&l.pid, 0)
+			db.unlockLease(i)
+			continue
+		}
+		leased[r] = true
+	}
+
+	t.retired = 0
+	for _, r := range retired {
+		if leased[r] {
+			t.roots[t.retired] = uint64(r)
+			t.retired++
+		} else {
+			r.NodeRelease(mm)
+		}
+	}
+}
+
+// leaseRoot leases root for a snapshot of a follower, or the root of the
+// header when it is zero, returning the root leased. The root of the header
+// is leased only if it is still the root after the lease is visible, so
+// that the writer sees the lease before releasing it. Other roots are
+// leased only while the follower already leases them or they are the root
+// of the header, and fail with ErrRootReleased otherwise.
+func (db *DB) leaseRoot(root Ptr) (Ptr, error) {
+	db.leaseLock.Lock()
+	defer db.leaseLock.Unlock()
+
+	current := root == 0
+	if current {
+		root = Ptr(atomic.LoadUint64((*uint64)(&db.header.root)))
+	}
+
+	slot := -1
+	for {
+		if l, ok := db.leased[root]; ok {
+			l.count++
+			if slot != -1 {
+				db.unleaseSlot(slot)
+			}
+			return root, nil
+		}
+
+		if slot == -1 {
+			slot = db.leaseSlot()
+		}
+		atomic.StoreUint64(&db.leases().leases[slot].root, uint64(root))
+
+		r := Ptr(atomic.LoadUint64((*uint64)(&db.header.root)))
+		if r == root {
+			break
+		}
+		if !current {
+			db.unleaseSlot(slot)
+			return 0, ErrRootReleased
+		}
+		root = r
+	}
+
+	db.leased[root] = &localLease{slot: slot}
+	db.leased[root].count++
+	return root, nil
+}
+
+// leaseSlot takes a slot of the lease table no other reader holds, which
+// may be the slot of a reader that died. When all are taken it waits for
+// one.
+func (db *DB) leaseSlot() int {
+	t := db.leases()
+	pid := uint32(os.Getpid())
+
+	// Locks of the same open file do not conflict
+	own := make(map[int]bool)
+	for _, l := range db.leased {
+		own[l.slot] = true
+	}
+
+	for {
+		for i := range t.leases {
+			if !own[i] && db.lockLease(i) {
+				atomic.StoreUint32(&t.leases[i].pid, pid)
+				return i
+			}
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// unleaseSlot frees a slot of the lease table
+func (db *DB) unleaseSlot(slot int) {
+	l := &db.leases().leases[slot]
+	atomic.StoreUint64(&l.root, 0)
+	atomic.StoreUint32(&l.pid, 0)
+	db.unlockLease(slot)
+}
+
+// unleaseRoot ends a lease of leaseRoot
+func (db *DB) unleaseRoot(root Ptr) {
+	db.leaseLock.Lock()
+	defer db.leaseLock.Unlock()
+
+	l, ok := db.leased[root]
+	if !ok {
+		return
+	}
+	if l.count--; l.count == 0 {
+		db.unleaseSlot(l.slot)
+		delete(db.leased, root)
+	}
+}
+
+// retainRoot retains the root of a snapshot, which followers lease
+func (db *DB) retainRoot(root Ptr) {
+	db.count(MetricSnapshotRetain, 1)
+	if db.follow {
+		db.leaseRoot(root)
+		return
+	}
+	root.NodeRetain(db.allocator)
+}
+
+// releaseRoot releases the root of a snapshot
+func (db *DB) releaseRoot(root Ptr) {
+	db.count(MetricSnapshotRelease, 1)
+	if db.follow {
+		db.unleaseRoot(root)
+		return
+	}
+	root.NodeRelease(db.allocator)
+}
+
+// followGrowth maps the part of the file the writer added since it was
+// last checked
+func (db *DB) followGrowth() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	if size <= db.allocator.GetCapacity() {
+		return nil
+	}
+
+	ra := db.allocator.(resizableAllocator)
+
+	db.growLock.Lock()
+	if size <= uint64(len(db.mapping)) {
+		oldSize := db.bufferSize
+		db.bufferRef = db.mapping[:size]
+		db.bufferSize = size
+		ra.Extend(size)
+		db.adviseGrowth(oldSize)
+		db.growLock.Unlock()
+		return nil
+	}
+	db.growLock.Unlock()
+
+	db.allocator.WLock()
+	defer db.allocator.WUnlock()
+
+	db.growLock.Lock()
+	defer db.growLock.Unlock()
+
+	if size <= db.allocator.GetCapacity() {
+		return nil
+	}
+
+	if err := db.munmap(); err != nil {
+		return fmt.Errorf("Failed to unmap memory error: %s", err)
+	}
+	if err := db.mmap(int(size)); err != nil {
+		return fmt.Errorf("Failed to map memory error: %s", err)
+	}
+
+	db.header = (*header)(unsafe.Pointer(&db.bufferRef[0]))
+	ra.SetBuffer(unsafe.Pointer(&db.buffer[0]), size, db.allocatorOffset())
+
+	return nil
+}
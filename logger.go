@@ -0,0 +1,99 @@
+package ebakusdb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the diagnostics of a database. The context holds pairs
+// of keys and values, as in the loggers of go-ethereum, which can be passed
+// as they are.
+type Logger interface {
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+}
+
+// LogLevel is the severity of a message
+type LogLevel uint8
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL%d", l)
+}
+
+// writerLogger writes messages of at least its level as lines of text
+type writerLogger struct {
+	lock  sync.Mutex
+	w     io.Writer
+	level LogLevel
+}
+
+// NewLogger returns a Logger writing the messages of at least level to w,
+// one per line
+func NewLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{w: w, level: level}
+}
+
+func (l *writerLogger) log(level LogLevel, msg string, ctx []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", time.Now().Format("2006-01-02T15:04:05.000"), level, msg)
+	for i := 0; i < len(ctx); i += 2 {
+		if i+1 < len(ctx) {
+			fmt.Fprintf(&b, " %v=%v", ctx[i], ctx[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v=<missing>", ctx[i])
+		}
+	}
+	b.WriteByte('\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+func (l *writerLogger) Debug(msg string, ctx ...interface{}) { l.log(LevelDebug, msg, ctx) }
+func (l *writerLogger) Info(msg string, ctx ...interface{})  { l.log(LevelInfo, msg, ctx) }
+func (l *writerLogger) Warn(msg string, ctx ...interface{})  { l.log(LevelWarn, msg, ctx) }
+func (l *writerLogger) Error(msg string, ctx ...interface{}) { l.log(LevelError, msg, ctx) }
+
+// nopLogger discards all messages, it is used when no Logger is given
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, ctx ...interface{}) {}
+func (nopLogger) Info(msg string, ctx ...interface{})  {}
+func (nopLogger) Warn(msg string, ctx ...interface{})  {}
+func (nopLogger) Error(msg string, ctx ...interface{}) {}
+
+// optionsLogger returns the logger of options, one discarding all messages
+// when none is given
+func optionsLogger(options *Options) Logger {
+	if options.Logger == nil {
+		return nopLogger{}
+	}
+	return options.Logger
+}
@@ -0,0 +1,72 @@
+package ebakusdb
+
+import "time"
+
+// Metrics receives the measurements of a database, named by the Metric
+// constants. It is called while operations run, so implementations should
+// be cheap and safe for concurrent use.
+type Metrics interface {
+	// Counter adds delta to a counter
+	Counter(name string, delta int64)
+	// Gauge sets the current value of a gauge
+	Gauge(name string, value int64)
+	// Histogram adds a sample to a histogram, durations are in seconds
+	Histogram(name string, value float64)
+}
+
+// Names of the metrics
+const (
+	MetricGet             = "ebakusdb/get"              // counter
+	MetricGetTime         = "ebakusdb/get/time"         // histogram
+	MetricInsert          = "ebakusdb/insert"           // counter
+	MetricInsertTime      = "ebakusdb/insert/time"      // histogram
+	MetricDelete          = "ebakusdb/delete"           // counter
+	MetricDeleteTime      = "ebakusdb/delete/time"      // histogram
+	MetricSelect          = "ebakusdb/select"           // counter
+	MetricSelectTime      = "ebakusdb/select/time"      // histogram
+	MetricNodes           = "ebakusdb/nodes"            // gauge, see DBInfo.Nodes
+	MetricMemoryUsed      = "ebakusdb/memory/used"      // gauge
+	MetricMemoryFree      = "ebakusdb/memory/free"      // gauge
+	MetricMemoryCapacity  = "ebakusdb/memory/capacity"  // gauge
+	MetricGrow            = "ebakusdb/grow"             // counter
+	MetricGrowTime        = "ebakusdb/grow/time"        // histogram
+	MetricSnapshotRetain  = "ebakusdb/snapshot/retain"  // counter
+	MetricSnapshotRelease = "ebakusdb/snapshot/release" // counter
+)
+
+// opStart returns the start time of an operation measured by opEnd, zero
+// when the database has no metrics
+func (db *DB) opStart() time.Time {
+	if db.metrics == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// opEnd counts an operation started at start and observes its latency
+func (db *DB) opEnd(counter, latency string, start time.Time) {
+	if db.metrics == nil {
+		return
+	}
+	db.metrics.Counter(counter, 1)
+	db.metrics.Histogram(latency, time.Since(start).Seconds())
+}
+
+// count adds delta to a counter
+func (db *DB) count(name string, delta int64) {
+	if db.metrics != nil {
+		db.metrics.Counter(name, delta)
+	}
+}
+
+// reportMemory sets the gauges of the nodes and the memory of the database
+func (db *DB) reportMemory() {
+	if db.metrics == nil {
+		return
+	}
+	mm := db.allocator
+	db.metrics.Gauge(MetricNodes, mm.NodeCount())
+	db.metrics.Gauge(MetricMemoryUsed, int64(mm.GetUsed()))
+	db.metrics.Gauge(MetricMemoryFree, int64(mm.GetFree()))
+	db.metrics.Gauge(MetricMemoryCapacity, int64(mm.GetCapacity()))
+}
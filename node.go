@@ -1,8 +1,9 @@
 package ebakusdb
 
 import (
-	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"sync/atomic"
 	"unsafe"
 
@@ -10,76 +11,109 @@ import (
 	"github.com/hashicorp/golang-lru/simplelru"
 )
 
+// Node is the header common to all node layouts. The layout specific edges
+// and the leaf data follow it in memory, see nodelayout.go.
 type Node struct {
 	RefCountedObject
+	kind      nodeKind
+	numEdges  uint8 // used edges of sparse layouts
+	_         uint16
 	prefixPtr ByteArray
-	edges     [16]Ptr // Nodes
-
-	// leaf case
-	keyPtr ByteArray
-	valPtr ByteArray
-
-	nodePtr Ptr
 }
 
 var nodeCount int64
 
+// GetNodeCount returns the number of nodes allocated by all databases.
+//
+// Deprecated: DBInfo.Nodes counts the nodes of one database.
 func GetNodeCount() int64 {
 	return atomic.LoadInt64(&nodeCount)
 }
 
-func newNode(mm balloc.MemoryManager) (*Ptr, *Node, error) {
-	size := uint64(unsafe.Sizeof(Node{}))
-	offset, err := mm.Allocate(size, true)
+func newNode(mm balloc.MemoryManager, kind nodeKind) (*Ptr, *Node, error) {
+	size := kind.size()
+	offset, err := mm.AllocateNode(size)
 	if err != nil {
 		return nil, nil, err
 	}
 	p := Ptr(offset)
 	n := p.getNode(mm)
 	n.refCount = 1
+	n.kind = kind
 
 	atomic.AddInt64(&nodeCount, 1)
 
 	return &p, n, nil
 }
 
+// copyNode creates a new node with the given layout holding the same
+// prefix, leaf data and edges as n. All references are retained.
+func copyNode(mm balloc.MemoryManager, n *Node, kind nodeKind) (*Ptr, *Node, error) {
+	ncPtr, nc, err := newNode(mm, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nc.prefixPtr = n.prefixPtr
+	nc.prefixPtr.Retain(mm)
+
+	l, ncl := n.leaf(), nc.leaf()
+	ncl.keyPtr = l.keyPtr
+	ncl.keyPtr.Retain(mm)
+	ncl.valPtr = l.valPtr
+	ncl.valPtr.Retain(mm)
+
+	if !l.nodePtr.isNull() {
+		ncl.nodePtr = l.nodePtr
+		ncl.nodePtr.NodeRetain(mm)
+	}
+
+	for _, e := range n.edgeList() {
+		nc.addEdge(e.key, e.node)
+		e.node.NodeRetain(mm)
+	}
+
+	return ncPtr, nc, nil
+}
+
 func (p *Ptr) getNode(mm balloc.MemoryManager) *Node {
 	return (*Node)(mm.GetPtr(uint64(*p)))
 }
 
+// NodeRetain retains the node, unless it is in read-only memory
 func (p *Ptr) NodeRetain(mm balloc.MemoryManager) bool {
-	if *p == 0 {
+	if *p == 0 || balloc.IsReadOnly(mm) {
 		return false
 	}
 	p.getNode(mm).Retain()
 	return true
 }
 
-func (p *Ptr) getNodeIterator(mm balloc.MemoryManager) *Iterator {
-	return &Iterator{rootNode: *p, node: *p, mm: mm}
+func (p *Ptr) getNodeIterator(db *DB) *Iterator {
+	return &Iterator{rootNode: *p, node: *p, db: db, mm: db.allocator}
 }
 
 func (nPtr *Ptr) NodeRelease(mm balloc.MemoryManager) bool {
-	if *nPtr == 0 {
+	if *nPtr == 0 || balloc.IsReadOnly(mm) {
 		return false
 	}
 	n := nPtr.getNode(mm)
 
 	if atomic.AddInt32(&n.refCount, -1) <= 0 {
+		l := n.leaf()
 		n.prefixPtr.Release(mm)
-		n.keyPtr.Release(mm)
-		n.valPtr.Release(mm)
+		l.keyPtr.Release(mm)
+		l.valPtr.Release(mm)
 
-		for _, ePtr := range n.edges {
+		for _, ePtr := range n.edgeSlots() {
 			ePtr.NodeRelease(mm)
 		}
 
-		n.nodePtr.NodeRelease(mm)
+		l.nodePtr.NodeRelease(mm)
 
-		size := uint64(unsafe.Sizeof(Node{}))
-		nodeCount--
-		// println("**NODE** Release", *nPtr, nodeCount, mm.GetUsed())
-		if err := mm.Deallocate(uint64(*nPtr), size); err != nil {
+		size := n.kind.size()
+		atomic.AddInt64(&nodeCount, -1)
+		if err := mm.DeallocateNode(uint64(*nPtr), size); err != nil {
 			panic(err)
 		}
 
@@ -90,24 +124,16 @@ func (nPtr *Ptr) NodeRelease(mm balloc.MemoryManager) bool {
 }
 
 func (n *Node) isLeaf() bool {
-	return !n.keyPtr.isNull() || !n.nodePtr.isNull()
+	l := n.leaf()
+	return !l.keyPtr.isNull() || !l.valPtr.isNull() || !l.nodePtr.isNull()
 }
 
 func (n *Node) hasOneChild() bool {
-	count := 0
-	for _, edgeNode := range n.edges {
-		if !edgeNode.isNull() {
-			count++
-			if count > 1 {
-				return false
-			}
-		}
-	}
-	return count == 1
+	return n.edgeCount() == 1
 }
 
 func (n *Node) getFirstChild() Ptr {
-	for _, edgeNodePtr := range n.edges {
+	for _, edgeNodePtr := range n.edgeSlots() {
 		if !edgeNodePtr.isNull() {
 			return edgeNodePtr
 		}
@@ -115,140 +141,212 @@ func (n *Node) getFirstChild() Ptr {
 	return 0
 }
 
-func (n *Node) Get(db *DB, k []byte) (*[]byte, bool) {
+// addNodeEdge adds an edge to the writable node at nPtr. When the node is
+// full it is replaced by a copy with a larger layout, in which case the
+// reference held by nPtr is released and the new node is returned. If the
+// copy can not be allocated nothing is changed.
+func addNodeEdge(db *DB, writable *simplelru.LRU, nPtr *Ptr, label byte, child Ptr) (*Ptr, error) {
+	mm := db.allocator
+	n := nPtr.getNode(mm)
+	if n.addEdge(label, child) {
+		return nPtr, nil
+	}
+
+	ncPtr, nc, err := copyNode(mm, n, kindForEdges(n.edgeCount()+1, db.radix))
+	if err != nil {
+		return nil, err
+	}
+	nc.addEdge(label, child)
+
+	writable.Remove(*nPtr)
+	nPtr.NodeRelease(mm)
+	writable.Add(*ncPtr, nil)
+
+	return ncPtr, nil
+}
+
+// mergeNodeChild merges the writable node at nPtr with its only child. The
+// merged node takes the layout of the child and replaces the one at nPtr.
+// If the merged node can not be allocated nothing is changed.
+func mergeNodeChild(db *DB, writable *simplelru.LRU, nPtr *Ptr) (*Ptr, error) {
+	mm := db.allocator
+	n := nPtr.getNode(mm)
+
+	childPtr := n.getFirstChild()
+	child := childPtr.getNode(mm)
+
+	// Merge the prefixes
+	mergedPrefix, err := allocBytes(mm, concat(n.prefixPtr.getBytes(mm), child.prefixPtr.getBytes(mm)))
+	if err != nil {
+		return nil, err
+	}
+
+	mPtr, m, err := copyNode(mm, child, kindForEdges(child.edgeCount(), db.radix))
+	if err != nil {
+		mergedPrefix.Release(mm)
+		return nil, err
+	}
+
+	m.prefixPtr.Release(mm)
+	m.prefixPtr = *mergedPrefix
+
+	writable.Remove(*nPtr)
+	nPtr.NodeRelease(mm)
+	writable.Add(*mPtr, nil)
+
+	return mPtr, nil
+}
+
+// Get returns the value of k. A value that is found but can not be read
+// returns its error.
+func (n *Node) Get(db *DB, k []byte) (*[]byte, bool, error) {
+	l := n.getLeaf(db, k)
+	if l == nil {
+		return nil, false, nil
+	}
+
+	b, err := db.getValue(&l.valPtr)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// Overflow and encrypted values are already copied out of the buffer
+	if l.valPtr.isOverflow() || l.valPtr.isEncrypted() {
+		return &b, true, nil
+	}
+
+	ob := make([]byte, len(b))
+	copy(ob, b)
+	return &ob, true, nil
+}
+
+// getLeaf returns the leaf data of key k or nil if it is not found
+func (n *Node) getLeaf(db *DB, k []byte) *nodeLeaf {
 	mm := db.allocator
 	search := k
 	for {
 		// Check for key exhaustion
 		if len(search) == 0 {
 			if n.isLeaf() {
-				b := n.valPtr.getBytes(mm)
-				ob := make([]byte, len(b))
-				copy(ob, b)
-				return &ob, true
+				return n.leaf()
 			}
 			break
 		}
 
 		// Look for an edge
-		nPtr := &n.edges[search[0]]
-		if nPtr.isNull() {
+		nPtr := n.edgeRef(search[0])
+		if nPtr == nil {
 			break
 		}
 
 		n = nPtr.getNode(mm)
 
 		// Consume the search prefix
-		nprefix := n.prefixPtr.getBytes(mm)
-		if bytes.HasPrefix(search, nprefix) {
+		if n.prefixPtr.isPrefixOf(mm, search) {
 			search = search[n.prefixPtr.Size:]
 		} else {
 			break
 		}
 	}
-	return nil, false
+	return nil
 }
 
-func (n *Node) LongestPrefix(db *DB, k []byte) ([]byte, interface{}, bool) {
+func (n *Node) LongestPrefix(db *DB, k []byte) ([]byte, interface{}, bool, error) {
 	mm := db.allocator
 	var last *Node
+	var lastKey []byte
 	search := k
 	for {
 		if n.isLeaf() {
 			last = n
+			lastKey = k[:len(k)-len(search)]
 		}
 
 		if len(search) == 0 {
 			break
 		}
 
-		nPtr := n.edges[search[0]]
+		nPtr := n.getEdge(search[0])
 		if nPtr.isNull() {
 			break
 		}
 		n = nPtr.getNode(mm)
 
-		prefix := n.prefixPtr.getBytes(mm)
-		if bytes.HasPrefix(search, prefix) {
-			search = search[len(prefix):]
+		if n.prefixPtr.isPrefixOf(mm, search) {
+			search = search[n.prefixPtr.Size:]
 		} else {
 			break
 		}
 	}
 	if last != nil {
-		return last.keyPtr.getBytes(mm), last.valPtr.getBytes(mm), true
+		v, err := db.getValue(&last.leaf().valPtr)
+		if err != nil {
+			return lastKey, nil, true, err
+		}
+		return lastKey, v, true, nil
 	}
-	return nil, nil, false
+	return nil, nil, false, nil
 }
 
-func (n *Node) printTree(mm balloc.MemoryManager, child int, indent string, last bool) {
-	fmt.Printf(indent)
+func (n *Node) printTree(w io.Writer, db *DB, child int, indent string, last bool) {
+	mm := db.allocator
+
+	fmt.Fprint(w, indent)
 
 	if last {
-		fmt.Printf("\\-(%d)", child)
+		fmt.Fprintf(w, "\\-(%d)", child)
 		indent += "  "
 	} else {
-		fmt.Printf("|-(%d)", child)
+		fmt.Fprintf(w, "|-(%d)", child)
 		indent += "| "
 	}
 
-	fmt.Printf("[%d] Prefix[%d]: (%s) Refs: %d ", mm.GetOffset(unsafe.Pointer(n)), n.prefixPtr, safeStringFromEncoded(n.prefixPtr.getBytes(mm)), n.refCount)
+	fmt.Fprintf(w, "[%d] Prefix[%d]: (%s) Refs: %d ", mm.GetOffset(unsafe.Pointer(n)), n.prefixPtr, db.safeStringFromEncoded(n.prefixPtr.getBytes(mm)), n.refCount)
 
+	l := n.leaf()
 	if n.isLeaf() {
-		fmt.Printf(" Key[%d]: (%s)[%d] Value[%d]: (%s)[%d] ",
-			n.keyPtr,
-			string(decodeKey(n.keyPtr.getBytes(mm))),
-			*n.keyPtr.getBytesRefCount(mm),
-			n.valPtr,
-			string(n.valPtr.getBytes(mm)),
-			*n.valPtr.getBytesRefCount(mm))
+		fmt.Fprintf(w, " Key[%d]: (%s)[%d] Value[%d]: (%s)[%d] ",
+			l.keyPtr,
+			string(db.decodeKey(l.keyPtr.getBytes(mm))),
+			l.keyPtr.refCount(mm),
+			l.valPtr,
+			string(l.valPtr.getBytes(mm)),
+			l.valPtr.refCount(mm))
 	}
 
-	fmt.Println("")
+	fmt.Fprintln(w)
 
-	lastIndex := 16
-	for i := 15; i >= 0; i-- {
-		if !n.edges[i].isNull() {
-			lastIndex = i
-			break
-		}
+	es := n.edgeList()
+	for i, e := range es {
+		edgeNode := e.node.getNode(mm)
+		edgeNode.printTree(w, db, int(e.key)+1, indent, i == len(es)-1)
 	}
 
-	i := 0
-	for _, edgeNodePtr := range n.edges {
-		i++
-		if edgeNodePtr.isNull() {
-			continue
-		}
-
-		edgeNode := edgeNodePtr.getNode(mm)
-		edgeNode.printTree(mm, i, indent, i-1 == lastIndex)
+	if !l.nodePtr.isNull() {
+		edgeNode := l.nodePtr.getNode(mm)
+		edgeNode.printTree(w, db, -1, indent, true)
 	}
+}
 
-	if !n.nodePtr.isNull() {
-		edgeNode := n.nodePtr.getNode(mm)
-		edgeNode.printTree(mm, -1, indent, true)
-	}
+const defaultWritableCache = 8192
 
-	// fmt.Printf("%*s", ident, "")
-	// fmt.Printf("Prefix: (%s) ", safeStringFromEncoded(n.prefixPtr.getBytes(mm)))
-	// if n.isLeaf() {
-	// 	fmt.Printf("%*s", ident, "")
-	// 	fmt.Printf("Key: (%s) Value: (%s) ", string(decodeKey(n.keyPtr.getBytes(mm))), string(n.valPtr.getBytes(mm)))
-	// }
-	// fmt.Printf("Refs: %d\n", n.refCount)
-	// for label, edgeNodePtr := range n.edges {
-	// 	if edgeNodePtr.isNull() {
-	// 		continue
-	// 	}
-	// 	fmt.Printf("%*s", ident+4, "")
-	// 	fmt.Printf("Edge %d (%d):\n", label, edgeNodePtr)
-	// 	edgeNode := edgeNodePtr.getNode(mm)
-	// 	edgeNode.printTree(mm, ident+8)
-	// }
+// mustNewLeafKey is newLeafKey panicking when out of memory
+func (db *DB) mustNewLeafKey(k []byte) ByteArray {
+	b, err := db.newLeafKey(k)
+	if err != nil {
+		panic(err)
+	}
+	return b
 }
 
-const defaultWritableCache = 8192
+// mustNewValue is newValue panicking when out of memory
+func (db *DB) mustNewValue(data []byte, c Compressor) *ByteArray {
+	b, err := db.newValue(data, c)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
 
 type Txn struct {
 	db       *DB
@@ -277,29 +375,11 @@ func (t *Txn) writeNode(nodePtr *Ptr) *Ptr {
 
 	//println("miss", t.writable.Len())
 
-	ncPtr, nc, err := newNode(mm)
+	ncPtr, _, err := copyNode(mm, n, kindForEdges(n.edgeCount(), t.db.radix))
 	if err != nil {
 		panic(err)
 	}
 
-	nc.keyPtr = n.keyPtr
-	nc.keyPtr.Retain(mm)
-	nc.valPtr = n.valPtr
-	nc.valPtr.Retain(mm)
-	nc.prefixPtr = n.prefixPtr
-	nc.prefixPtr.Retain(mm)
-
-	nc.edges = n.edges
-
-	for _, edgeNode := range nc.edges {
-		edgeNode.NodeRetain(mm)
-	}
-
-	if !n.nodePtr.isNull() {
-		nc.nodePtr = n.nodePtr
-		nc.nodePtr.NodeRetain(mm)
-	}
-
 	t.writable.Add(*ncPtr, nil)
 
 	return ncPtr
@@ -319,53 +399,56 @@ func (t *Txn) insert(nodePtr *Ptr, k, search []byte, vPtr ByteArray) (*Ptr, *Byt
 		if n.isLeaf() {
 			didUpdate = true
 
-			oldVal = n.valPtr
+			oldVal = n.leaf().valPtr
 			oldVal.Retain(mm)
 		}
 
 		ncPtr := t.writeNode(nodePtr)
-		nc := ncPtr.getNode(mm)
+		ncl := ncPtr.getNode(mm).leaf()
 
-		nc.keyPtr = *newBytesFromSlice(mm, k)
-		nc.valPtr = vPtr
-		nc.valPtr.Retain(mm)
+		ncl.keyPtr = t.db.mustNewLeafKey(k)
+		ncl.valPtr = vPtr
+		ncl.valPtr.Retain(mm)
 
 		return ncPtr, &oldVal, didUpdate
 	}
 
 	edgeLabel := search[0]
-	childPtr := n.edges[edgeLabel]
+	childPtr := n.getEdge(edgeLabel)
 
 	// No edge, create one
 	if childPtr.isNull() {
-		nnPtr, nn, err := newNode(mm)
+		nnPtr, nn, err := newNode(mm, nodeKind0)
 		if err != nil {
 			panic(err)
 		}
 
-		nn.keyPtr = *newBytesFromSlice(mm, k)
-		nn.valPtr = vPtr
-		nn.valPtr.Retain(mm)
+		nnl := nn.leaf()
+		nnl.keyPtr = t.db.mustNewLeafKey(k)
+		nnl.valPtr = vPtr
+		nnl.valPtr.Retain(mm)
 		nn.prefixPtr = *newBytesFromSlice(mm, search)
 
 		nc := t.writeNode(nodePtr)
-		nc.getNode(mm).edges[edgeLabel] = *nnPtr
-		return nc, nil, false
+		ncPtr, err := addNodeEdge(t.db, t.writable, nc, edgeLabel, *nnPtr)
+		if err != nil {
+			panic(err)
+		}
+		return ncPtr, nil, false
 	}
 
 	child := childPtr.getNode(mm)
 
 	// Determine longest prefix of the search key on match
-	childPrefix := child.prefixPtr.getBytes(mm)
-	commonPrefix := longestPrefix(search, childPrefix)
-	if commonPrefix == len(childPrefix) {
+	commonPrefix := child.prefixPtr.commonPrefix(mm, search)
+	if commonPrefix == int(child.prefixPtr.Size) {
 		search = search[commonPrefix:]
 		newChildPtr, oldVal, didUpdate := t.insert(&childPtr, k, search, vPtr)
 		if newChildPtr != nil {
 			ncPtr := t.writeNode(nodePtr)
-			nc := ncPtr.getNode(mm)
-			nc.edges[edgeLabel].NodeRelease(mm)
-			nc.edges[edgeLabel] = *newChildPtr
+			e := ncPtr.getNode(mm).edgeRef(edgeLabel)
+			e.NodeRelease(mm)
+			*e = *newChildPtr
 			return ncPtr, oldVal, didUpdate
 		}
 		return nil, oldVal, didUpdate
@@ -375,7 +458,7 @@ func (t *Txn) insert(nodePtr *Ptr, k, search []byte, vPtr ByteArray) (*Ptr, *Byt
 	ncPtr := t.writeNode(nodePtr)
 	nc := ncPtr.getNode(mm)
 
-	splitNodePtr, splitNode, err := newNode(mm)
+	splitNodePtr, splitNode, err := newNode(mm, nodeKind4)
 	if err != nil {
 		panic(err)
 	}
@@ -387,60 +470,45 @@ func (t *Txn) insert(nodePtr *Ptr, k, search []byte, vPtr ByteArray) (*Ptr, *Byt
 	modChild := modChildPtr.getNode(mm)
 	pref := modChild.prefixPtr.getBytes(mm)
 
-	splitNode.edges[pref[commonPrefix]] = *modChildPtr
+	splitNode.addEdge(pref[commonPrefix], *modChildPtr)
 
-	nc.edges[edgeLabel].NodeRelease(mm)
-	nc.edges[edgeLabel] = *splitNodePtr
+	e := nc.edgeRef(edgeLabel)
+	e.NodeRelease(mm)
+	*e = *splitNodePtr
 
 	modChild.prefixPtr = *newBytesFromSlice(mm, pref[commonPrefix:])
 
 	// If the new key is a subset, add to to this node
 	search = search[commonPrefix:]
 	if len(search) == 0 {
-		splitNode.keyPtr = *newBytesFromSlice(mm, k)
-		splitNode.valPtr = vPtr
+		sl := splitNode.leaf()
+		sl.keyPtr = t.db.mustNewLeafKey(k)
+		sl.valPtr = vPtr
 		vPtr.Retain(mm)
 		return ncPtr, nil, false
 	}
 
-	enPtr, en, err := newNode(mm)
+	enPtr, en, err := newNode(mm, nodeKind0)
 	if err != nil {
 		panic(err)
 	}
-	en.keyPtr = *newBytesFromSlice(mm, k)
-	en.valPtr = vPtr
+	enl := en.leaf()
+	enl.keyPtr = t.db.mustNewLeafKey(k)
+	enl.valPtr = vPtr
 	vPtr.Retain(mm)
 	en.prefixPtr = *newBytesFromSlice(mm, search)
 
-	splitNode.edges[search[0]] = *enPtr
+	splitNode.addEdge(search[0], *enPtr)
 
 	return ncPtr, nil, false
 }
 
-func (t *Txn) mergeChild(n *Node) {
-	mm := t.db.allocator
-
-	childPtr := n.getFirstChild()
-	child := childPtr.getNode(mm)
-
-	// Merge the nodes.
-	mergedPrefix := concat(n.prefixPtr.getBytes(mm), child.prefixPtr.getBytes(mm))
-	n.prefixPtr.Release(mm)
-	n.prefixPtr = *newBytesFromSlice(mm, mergedPrefix)
-	n.keyPtr.Release(mm) // check if needed
-	n.valPtr.Release(mm) // check if needed
-	n.keyPtr = child.keyPtr
-	n.keyPtr.Retain(mm)
-	n.valPtr = child.valPtr
-	n.valPtr.Retain(mm)
-
-	n.edges = child.edges
-
-	for _, edgeNode := range n.edges {
-		edgeNode.NodeRetain(mm)
+func (t *Txn) mergeChild(nPtr *Ptr) *Ptr {
+	mPtr, err := mergeNodeChild(t.db, t.writable, nPtr)
+	if err != nil {
+		panic(err)
 	}
-
-	childPtr.NodeRelease(mm)
+	return mPtr
 }
 
 func (t *Txn) delete(parentPtr, nPtr *Ptr, search []byte) (node *Ptr) {
@@ -456,32 +524,31 @@ func (t *Txn) delete(parentPtr, nPtr *Ptr, search []byte) (node *Ptr) {
 		// Remove the leaf node
 		ncPtr := t.writeNode(nPtr)
 		nc := ncPtr.getNode(mm)
-		nc.keyPtr.Release(mm)
-		nc.valPtr.Release(mm)
+		ncl := nc.leaf()
+		ncl.keyPtr.Release(mm)
+		ncl.valPtr.Release(mm)
 
 		// Check if this node should be merged
 		if *nPtr != t.root && nc.hasOneChild() {
-			t.mergeChild(nc)
+			ncPtr = t.mergeChild(ncPtr)
 		}
 
 		return ncPtr
 	}
 
 	edgeLabel := search[0]
-	childPtr := n.edges[edgeLabel]
+	childPtr := n.getEdge(edgeLabel)
 	if childPtr.isNull() {
 		return nil
 	}
 
 	child := childPtr.getNode(mm)
-	childPrefix := child.prefixPtr.getBytes(mm)
-
-	if !bytes.HasPrefix(search, childPrefix) {
+	if !child.prefixPtr.isPrefixOf(mm, search) {
 		return nil
 	}
 
 	// Consume the search prefix
-	search = search[len(childPrefix):]
+	search = search[child.prefixPtr.Size:]
 	newChildPtr := t.delete(nPtr, &childPtr, search)
 	if newChildPtr == nil {
 		return nil
@@ -492,28 +559,31 @@ func (t *Txn) delete(parentPtr, nPtr *Ptr, search []byte) (node *Ptr) {
 	ncPtr := t.writeNode(nPtr)
 	nc := ncPtr.getNode(mm)
 
-	nc.edges[edgeLabel].NodeRelease(mm)
+	e := nc.edgeRef(edgeLabel)
+	e.NodeRelease(mm)
 	if newChild.isLeaf() == false && newChild.getFirstChild() == 0 {
-		nc.edges[edgeLabel] = 0
+		nc.removeEdge(edgeLabel)
 		if *nPtr != t.root && nc.hasOneChild() && !nc.isLeaf() {
-			t.mergeChild(nc)
+			ncPtr = t.mergeChild(ncPtr)
 		}
 		newChildPtr.NodeRelease(mm)
 	} else {
-		nc.edges[edgeLabel] = *newChildPtr
+		*e = *newChildPtr
 	}
 
 	return ncPtr
 }
 
 func (t *Txn) Insert(k, v []byte) (*[]byte, bool) {
+	defer t.db.opEnd(MetricInsert, MetricInsertTime, t.db.opStart())
+
 	if err := checkBytesLength(v); err != nil {
 		return nil, false
 	}
 
 	mm := t.db.allocator
-	k = encodeKey(k)
-	vPtr := *newBytesFromSlice(mm, v)
+	vPtr := *t.db.mustNewValue(v, t.db.compressorFor(k))
+	k = t.db.rootKey(k)
 	newRoot, oldVal, didUpdate := t.insert(&t.root, k, k, vPtr)
 	vPtr.Release(mm)
 	if newRoot != nil {
@@ -524,18 +594,24 @@ func (t *Txn) Insert(k, v []byte) (*[]byte, bool) {
 	if oldVal == nil {
 		return nil, didUpdate
 	}
+	defer oldVal.Release(mm)
 
-	val := oldVal.getBytes(mm)
+	// The value is replaced even when the old one can not be read
+	val, err := t.db.getValue(oldVal)
+	if err != nil {
+		return nil, didUpdate
+	}
 	oVal := make([]byte, len(val))
 	copy(oVal, val)
-	oldVal.Release(mm)
 
 	return &oVal, didUpdate
 }
 
 func (t *Txn) Delete(k []byte) bool {
+	defer t.db.opEnd(MetricDelete, MetricDeleteTime, t.db.opStart())
+
 	mm := t.db.allocator
-	k = encodeKey(k)
+	k = t.db.rootKey(k)
 	newRoot := t.delete(nil, &t.root, k)
 	if newRoot != nil {
 		t.root.NodeRelease(mm)
@@ -573,16 +649,21 @@ func (t *Txn) RootNode() *Node {
 }
 
 func (t *Txn) printTree() {
-	t.RootNode().printTree(t.db.allocator, 0, "", false)
+	t.RootNode().printTree(os.Stdout, t.db, 0, "", false)
 }
 
-// Get returns the key
-func (t *Txn) Get(k []byte) (*[]byte, bool) {
-	k = encodeKey(k)
+// Get returns the value of k, or the error of reading it
+func (t *Txn) Get(k []byte) (*[]byte, bool, error) {
+	defer t.db.opEnd(MetricGet, MetricGetTime, t.db.opStart())
+
+	k = t.db.rootKey(k)
 	return t.root.getNode(t.db.allocator).Get(t.db, k)
 }
 
 func (db *DB) Commit(txn *Txn) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	txn.Commit()
 	return nil
 }
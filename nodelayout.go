@@ -0,0 +1,299 @@
+package ebakusdb
+
+import "unsafe"
+
+type nodeKind uint8
+
+const (
+	nodeKind16       nodeKind = iota // dense array of 16 edges, the version 1 layout
+	nodeKind0                        // no edges, leaf only
+	nodeKind4                        // up to 4 sorted edges
+	nodeKind16Sparse                 // up to 16 sorted edges
+	nodeKind48                       // up to 48 edges indexed by label
+	nodeKind256                      // dense array of 256 edges
+)
+
+type nodeLeaf struct {
+	keyPtr ByteArray
+	valPtr ByteArray
+
+	nodePtr Ptr
+}
+
+type node0 struct {
+	Node
+	leaf nodeLeaf
+}
+
+type node4 struct {
+	Node
+	labels [4]byte
+	_      [4]byte
+	edges  [4]Ptr
+	leaf   nodeLeaf
+}
+
+type node16 struct {
+	Node
+	edges [16]Ptr // Nodes
+	leaf  nodeLeaf
+}
+
+type node16Sparse struct {
+	Node
+	labels [16]byte
+	edges  [16]Ptr
+	leaf   nodeLeaf
+}
+
+type node48 struct {
+	Node
+	index [256]uint8 // slot of each label plus one, zero when missing
+	edges [48]Ptr
+	leaf  nodeLeaf
+}
+
+type node256 struct {
+	Node
+	edges [256]Ptr
+	leaf  nodeLeaf
+}
+
+func (k nodeKind) size() uint64 {
+	switch k {
+	case nodeKind0:
+		return uint64(unsafe.Sizeof(node0{}))
+	case nodeKind4:
+		return uint64(unsafe.Sizeof(node4{}))
+	case nodeKind16Sparse:
+		return uint64(unsafe.Sizeof(node16Sparse{}))
+	case nodeKind48:
+		return uint64(unsafe.Sizeof(node48{}))
+	case nodeKind256:
+		return uint64(unsafe.Sizeof(node256{}))
+	}
+	return uint64(unsafe.Sizeof(node16{}))
+}
+
+// kindForEdges returns the smallest layout able to hold count edges
+func kindForEdges(count int, radix RadixMode) nodeKind {
+	switch {
+	case count == 0:
+		return nodeKind0
+	case count <= 4:
+		return nodeKind4
+	case radix == Radix16:
+		return nodeKind16
+	case count <= 16:
+		return nodeKind16Sparse
+	case count <= 48:
+		return nodeKind48
+	}
+	return nodeKind256
+}
+
+// leaf returns the leaf data of the node, located after the edges
+func (n *Node) leaf() *nodeLeaf {
+	switch n.kind {
+	case nodeKind0:
+		return &(*node0)(unsafe.Pointer(n)).leaf
+	case nodeKind4:
+		return &(*node4)(unsafe.Pointer(n)).leaf
+	case nodeKind16Sparse:
+		return &(*node16Sparse)(unsafe.Pointer(n)).leaf
+	case nodeKind48:
+		return &(*node48)(unsafe.Pointer(n)).leaf
+	case nodeKind256:
+		return &(*node256)(unsafe.Pointer(n)).leaf
+	}
+	return &(*node16)(unsafe.Pointer(n)).leaf
+}
+
+// sparseEdges returns the label and edge arrays of the sorted layouts
+func (n *Node) sparseEdges() ([]byte, []Ptr) {
+	switch n.kind {
+	case nodeKind4:
+		n4 := (*node4)(unsafe.Pointer(n))
+		return n4.labels[:], n4.edges[:]
+	case nodeKind16Sparse:
+		n16 := (*node16Sparse)(unsafe.Pointer(n))
+		return n16.labels[:], n16.edges[:]
+	}
+	return nil, nil
+}
+
+// denseEdges returns the edge array of the layouts indexed by label
+func (n *Node) denseEdges() []Ptr {
+	switch n.kind {
+	case nodeKind16:
+		return (*node16)(unsafe.Pointer(n)).edges[:]
+	case nodeKind256:
+		return (*node256)(unsafe.Pointer(n)).edges[:]
+	}
+	return nil
+}
+
+// edgeSlots returns the edge array of the node. Dense layouts may contain
+// null edges, the rest only the used ones.
+func (n *Node) edgeSlots() []Ptr {
+	switch n.kind {
+	case nodeKind0:
+		return nil
+	case nodeKind48:
+		return (*node48)(unsafe.Pointer(n)).edges[:n.numEdges]
+	case nodeKind16, nodeKind256:
+		return n.denseEdges()
+	}
+	_, edges := n.sparseEdges()
+	return edges[:n.numEdges]
+}
+
+// edgeRef returns the edge with the given label or nil if there is none
+func (n *Node) edgeRef(label byte) *Ptr {
+	switch n.kind {
+	case nodeKind0:
+		return nil
+	case nodeKind48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		if i := n48.index[label]; i != 0 {
+			return &n48.edges[i-1]
+		}
+		return nil
+	case nodeKind16, nodeKind256:
+		edges := n.denseEdges()
+		if int(label) >= len(edges) || edges[label].isNull() {
+			return nil
+		}
+		return &edges[label]
+	}
+	labels, edges := n.sparseEdges()
+	for i := 0; i < int(n.numEdges); i++ {
+		if labels[i] == label {
+			return &edges[i]
+		}
+	}
+	return nil
+}
+
+func (n *Node) getEdge(label byte) Ptr {
+	if e := n.edgeRef(label); e != nil {
+		return *e
+	}
+	return 0
+}
+
+// addEdge adds an edge with a label not yet present in the node. It returns
+// false when the layout of the node has no room for it.
+func (n *Node) addEdge(label byte, p Ptr) bool {
+	switch n.kind {
+	case nodeKind0:
+		return false
+	case nodeKind48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		if int(n.numEdges) == len(n48.edges) {
+			return false
+		}
+		n48.edges[n.numEdges] = p
+		n.numEdges++
+		n48.index[label] = n.numEdges
+		return true
+	case nodeKind16, nodeKind256:
+		edges := n.denseEdges()
+		if int(label) >= len(edges) {
+			return false
+		}
+		edges[label] = p
+		return true
+	}
+	labels, edges := n.sparseEdges()
+	if int(n.numEdges) == len(edges) {
+		return false
+	}
+	i := int(n.numEdges)
+	for ; i > 0 && labels[i-1] > label; i-- {
+		labels[i] = labels[i-1]
+		edges[i] = edges[i-1]
+	}
+	labels[i] = label
+	edges[i] = p
+	n.numEdges++
+	return true
+}
+
+// removeEdge drops the edge with the given label without releasing it
+func (n *Node) removeEdge(label byte) {
+	switch n.kind {
+	case nodeKind0:
+	case nodeKind48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		i := n48.index[label]
+		if i == 0 {
+			return
+		}
+		// Move the last edge to the freed slot
+		last := n.numEdges - 1
+		n48.edges[i-1] = n48.edges[last]
+		n48.edges[last] = 0
+		for l, j := range n48.index {
+			if j == last+1 {
+				n48.index[l] = i
+				break
+			}
+		}
+		n48.index[label] = 0
+		n.numEdges--
+	case nodeKind16, nodeKind256:
+		if edges := n.denseEdges(); int(label) < len(edges) {
+			edges[label] = 0
+		}
+	default:
+		labels, edges := n.sparseEdges()
+		for i := 0; i < int(n.numEdges); i++ {
+			if labels[i] == label {
+				copy(labels[i:], labels[i+1:n.numEdges])
+				copy(edges[i:], edges[i+1:n.numEdges])
+				n.numEdges--
+				labels[n.numEdges] = 0
+				edges[n.numEdges] = 0
+				return
+			}
+		}
+	}
+}
+
+// edgeList returns the edges of the node ordered by label
+func (n *Node) edgeList() edges {
+	es := make(edges, 0)
+	switch n.kind {
+	case nodeKind0:
+	case nodeKind48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		for l, i := range n48.index {
+			if i != 0 {
+				es = append(es, edge{key: byte(l), node: n48.edges[i-1]})
+			}
+		}
+	case nodeKind16, nodeKind256:
+		for k, nPtr := range n.denseEdges() {
+			if !nPtr.isNull() {
+				es = append(es, edge{key: byte(k), node: nPtr})
+			}
+		}
+	default:
+		labels, edges := n.sparseEdges()
+		for i := 0; i < int(n.numEdges); i++ {
+			es = append(es, edge{key: labels[i], node: edges[i]})
+		}
+	}
+	return es
+}
+
+func (n *Node) edgeCount() int {
+	count := 0
+	for _, edgeNode := range n.edgeSlots() {
+		if !edgeNode.isNull() {
+			count++
+		}
+	}
+	return count
+}
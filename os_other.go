@@ -0,0 +1,16 @@
+//go:build !linux
+
+package ebakusdb
+
+// checkLeaseLocks tells if the host has the locks of the lease table. They
+// are open file description locks, which only Linux has.
+func checkLeaseLocks() error {
+	return ErrLeasesUnsupported
+}
+
+func (db *DB) lockLease(slot int) bool {
+	return false
+}
+
+func (db *DB) unlockLease(slot int) {
+}
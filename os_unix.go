@@ -2,33 +2,206 @@ package ebakusdb
 
 import (
 	"fmt"
+	"os"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
+// lockRetryInterval is how often a lock held by another process is tried
+const lockRetryInterval = 50 * time.Millisecond
+
+// flock locks the file, shared for read-only databases and exclusive
+// otherwise. A lock held by another process is tried again until timeout,
+// failing with ErrLocked, or indefinitely when it is negative.
+func (db *DB) flock(timeout time.Duration) error {
+	how := syscall.LOCK_EX
+	if db.readOnly {
+		how = syscall.LOCK_SH
+	}
+
+	start := time.Now()
+	waiting := false
+	for {
+		err := syscall.Flock(int(db.file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			return fmt.Errorf("flock error: %s", err)
+		}
+
+		if timeout >= 0 && time.Since(start) >= timeout {
+			return ErrLocked
+		}
+		if !waiting {
+			db.log.Info("Waiting for another process to release the database", "path", db.path)
+			waiting = true
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// mmap maps the first sz bytes of the file. The mapping reserves the
+// address space of db.mapSize bytes, or more for larger files, so that the
+// file can grow without being mapped again. The range past the end of the
+// file is never accessed. When the address space can not be reserved only
+// sz bytes are mapped.
 func (db *DB) mmap(sz int) error {
-	b, err := syscall.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
+	reserve := db.mapSize
+	for reserve < uint64(sz) {
+		reserve *= 2
+	}
+
+	prot := syscall.PROT_WRITE | syscall.PROT_READ
+	if db.readOnly {
+		prot = syscall.PROT_READ
+	}
+	b, err := syscall.Mmap(int(db.file.Fd()), 0, int(reserve), prot, syscall.MAP_SHARED|syscall.MAP_NORESERVE)
 	if err != nil {
-		return err
+		if b, err = syscall.Mmap(int(db.file.Fd()), 0, sz, prot, syscall.MAP_SHARED); err != nil {
+			return err
+		}
 	}
 
-	_, _, e := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), syscall.MADV_RANDOM)
-	if e != 0 {
-		return fmt.Errorf("madvise error: %s", e)
+	// Only the part within the file, the rest of the reservation is
+	// advised as the file grows into it
+	if err := madvise(b[:sz], db.currentAdvice()); err != nil {
+		syscall.Munmap(b)
+		return fmt.Errorf("madvise error: %s", err)
 	}
 
-	db.bufferRef = b
+	db.mapping = b
+	db.bufferRef = b[:sz]
 	db.buffer = (*[0x9000000000]byte)(unsafe.Pointer(&b[0]))
 	db.bufferSize = uint64(sz)
 	return nil
 }
 
+// madvise advises the kernel of the access pattern of b
+func madvise(b []byte, advice MmapAdvice) error {
+	var a int
+	switch advice {
+	case AdviceRandom:
+		a = syscall.MADV_RANDOM
+	case AdviceNormal:
+		a = syscall.MADV_NORMAL
+	case AdviceSequential:
+		a = syscall.MADV_SEQUENTIAL
+	case AdviceWillNeed:
+		a = syscall.MADV_WILLNEED
+	default:
+		return fmt.Errorf("Unknown mmap advice %d", advice)
+	}
+
+	_, _, e := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(a))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// currentAdvice is the advice of the mapping, sequential while scans run.
+// The caller holds growLock, or is opening the database.
+func (db *DB) currentAdvice() MmapAdvice {
+	if db.scans != 0 {
+		return AdviceSequential
+	}
+	return db.advice
+}
+
+// adviseGrowth advises the part of the mapping the file grew into from
+// offset from. The caller holds growLock.
+func (db *DB) adviseGrowth(from uint64) {
+	page := uint64(os.Getpagesize())
+	if err := madvise(db.mapping[from&^(page-1):db.bufferSize], db.currentAdvice()); err != nil {
+		db.log.Warn("Failed to advise the grown mapping", "err", err)
+	}
+}
+
+// beginScan advises sequential access to the mapping while a full scan
+// runs, when the database is advised random access otherwise. It returns
+// the function ending the scan.
+func (db *DB) beginScan() func() {
+	db.growLock.Lock()
+	defer db.growLock.Unlock()
+
+	if db.mapping == nil || db.advice != AdviceRandom {
+		return func() {}
+	}
+	if db.scans++; db.scans == 1 {
+		if err := madvise(db.mapping[:db.bufferSize], AdviceSequential); err != nil {
+			db.log.Warn("Failed to advise sequential access", "err", err)
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(db.endScan)
+	}
+}
+
+// endScan ends a scan of beginScan, advising random access again after the
+// last one
+func (db *DB) endScan() {
+	db.growLock.Lock()
+	defer db.growLock.Unlock()
+
+	if db.scans--; db.scans == 0 && db.mapping != nil {
+		if err := madvise(db.mapping[:db.bufferSize], AdviceRandom); err != nil {
+			db.log.Warn("Failed to advise random access", "err", err)
+		}
+	}
+}
+
+// prefetch reads the pages of size bytes at offset in the background
+func (db *DB) prefetch(offset, size uint64) {
+	db.growLock.Lock()
+	defer db.growLock.Unlock()
+
+	if db.mapping == nil || offset >= db.bufferSize {
+		return
+	}
+	end := offset + size
+	if end > db.bufferSize {
+		end = db.bufferSize
+	}
+
+	// madvise needs a page aligned address
+	page := uint64(os.Getpagesize())
+	if err := madvise(db.mapping[offset&^(page-1):end], AdviceWillNeed); err != nil {
+		db.log.Debug("Failed to prefetch", "offset", offset, "err", err)
+	}
+}
+
+// mmapLeases maps the lease table of a follower writable, apart from the
+// read-only mapping of the rest of the file
+func (db *DB) mmapLeases() error {
+	b, err := syscall.Mmap(int(db.file.Fd()), int64(db.header.leases), int(leaseTableSize()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	db.leaseMapping = b
+	return nil
+}
+
+func (db *DB) munmapLeases() error {
+	if db.leaseMapping == nil {
+		return nil
+	}
+	err := syscall.Munmap(db.leaseMapping)
+	db.leaseMapping = nil
+	return err
+}
+
 func (db *DB) munmap() error {
-	if db.bufferRef == nil {
+	if db.mapping == nil {
 		return nil
 	}
 
-	err := syscall.Munmap(db.bufferRef)
+	err := syscall.Munmap(db.mapping)
+	db.mapping = nil
 	db.bufferRef = nil
 	db.buffer = nil
 	db.bufferSize = 0
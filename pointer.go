@@ -22,11 +22,53 @@ func (p *RefCountedObject) Retain() {
 	atomic.AddInt32(&p.refCount, 1)
 }
 
+// ByteArray references Size bytes stored at Offset. Arrays of up to
+// maxInlineSize bytes are stored inline, in place of the Offset, and arrays
+// over overflowSegmentSize bytes are stored in segments.
 type ByteArray struct {
 	Offset uint64
 	Size   uint32
+	flags  uint32
 }
 
+const (
+	byteArrayInline uint32 = 1 << iota
+	byteArrayOverflow
+	byteArrayEncrypted
+
+	// The id of the compressor of the data is kept in the second byte
+	byteArrayCodecShift = 8
+	byteArrayCodecMask  = 0xff << byteArrayCodecShift
+)
+
 func (p *ByteArray) isNull() bool {
-	return p.Offset == 0
+	return p.Offset == 0 && !p.isInline()
+}
+
+func (p *ByteArray) isInline() bool {
+	return p.flags&byteArrayInline != 0
+}
+
+func (p *ByteArray) isOverflow() bool {
+	return p.flags&byteArrayOverflow != 0
+}
+
+func (p *ByteArray) codec() uint8 {
+	return uint8((p.flags & byteArrayCodecMask) >> byteArrayCodecShift)
+}
+
+func (p *ByteArray) setCodec(id uint8) {
+	p.flags = p.flags&^byteArrayCodecMask | uint32(id)<<byteArrayCodecShift
+}
+
+func (p *ByteArray) isEncrypted() bool {
+	return p.flags&byteArrayEncrypted != 0
+}
+
+func (p *ByteArray) setEncrypted(encrypted bool) {
+	if encrypted {
+		p.flags |= byteArrayEncrypted
+	} else {
+		p.flags &^= byteArrayEncrypted
+	}
 }
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"os"
 	"reflect"
 	"sort"
 	"strings"
@@ -19,6 +22,7 @@ type Table struct {
 	Indexes []string
 	Node    Ptr
 	Schema  string
+	Codec   uint8 // id of the compressor of the rows, 0 for none
 }
 
 type IndexField struct {
@@ -211,7 +215,7 @@ func (s *Snapshot) Release() {
 	defer mm.Unlock()
 
 	s.writable = nil
-	s.root.NodeRelease(mm)
+	s.db.releaseRoot(s.root)
 }
 
 func (s *Snapshot) GetId() uint64 {
@@ -226,7 +230,9 @@ func (s *Snapshot) GetUsedMemory() uint64 {
 	return s.db.allocator.GetUsed()
 }
 
-func (s *Snapshot) Get(k []byte) (*[]byte, bool) {
+func (s *Snapshot) Get(k []byte) (*[]byte, bool, error) {
+	defer s.db.opEnd(MetricGet, MetricGetTime, s.db.opStart())
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
@@ -234,17 +240,94 @@ func (s *Snapshot) Get(k []byte) (*[]byte, bool) {
 	return s.get(k)
 }
 
-func (s *Snapshot) get(k []byte) (*[]byte, bool) {
-	k = encodeKey(k)
+func (s *Snapshot) get(k []byte) (*[]byte, bool, error) {
+	k = s.db.rootKey(k)
 	return s.root.getNode(s.db.allocator).Get(s.db, k)
 }
 
+// GetReader returns a reader streaming the value of k. Get, iterators and
+// Select return values in one slice, so they assemble large values in
+// memory, while the reader copies them one overflow segment at a time. The
+// value is kept alive until the reader is closed, through the root of s on
+// read-only databases, where followers lease it.
+func (s *Snapshot) GetReader(k []byte) (io.ReadCloser, bool, error) {
+	mm := s.db.allocator
+	mm.Lock()
+	defer mm.Unlock()
+
+	l := s.root.getNode(mm).getLeaf(s.db, s.db.rootKey(k))
+	if l == nil {
+		return nil, false, nil
+	}
+
+	if l.valPtr.codec() != 0 || l.valPtr.isEncrypted() {
+		v, err := s.db.getValue(&l.valPtr)
+		if err != nil {
+			return nil, true, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(v)), true, nil
+	}
+
+	r := &byteArrayReader{mm: mm, b: l.valPtr}
+	if s.db.readOnly {
+		s.db.retainRoot(s.root)
+		r.snap = &Snapshot{db: s.db, root: s.root}
+	} else {
+		r.b.Retain(mm)
+	}
+
+	return r, true, nil
+}
+
+// reserve grows the database ahead of allocating a value of the given size,
+// as large values may not fit in the space left after the last growth.
+// Files grow within their mapping while holding the lock, otherwise it is
+// released for the buffer to be mapped again. For smaller values it only
+// keeps the share of free space, and a database that can not grow any more
+// fails when they are allocated.
+func (s *Snapshot) reserve(size int) error {
+	if size <= overflowSegmentSize {
+		size = 0
+	}
+
+	grown, err := s.db.growInPlace(uint64(size))
+	if !grown && err == nil {
+		mm := s.db.allocator
+		mm.Unlock()
+		err = s.db.growFor(uint64(size))
+		mm.Lock()
+	}
+
+	if size == 0 && err == ErrDatabaseFull {
+		return nil
+	}
+	return err
+}
+
 func (s *Snapshot) CreateTable(table string, obj interface{}) error {
+	return s.CreateCompressedTable(table, obj, nil)
+}
+
+// CreateCompressedTable creates a table whose rows are compressed with c
+func (s *Snapshot) CreateCompressedTable(table string, obj interface{}, c Compressor) error {
+	if s.db.readOnly {
+		return ErrReadOnly
+	}
+
+	var codec uint8
+	if c != nil {
+		if err := RegisterCompressor(c); err != nil {
+			return err
+		}
+		codec = c.ID()
+		s.db.setFlag(flagCompression)
+	}
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
 
-	nPtr, _, err := newNode(mm)
+	nPtr, _, err := newNode(mm, nodeKind0)
 	if err != nil {
 		return err
 	}
@@ -270,41 +353,54 @@ func (s *Snapshot) CreateTable(table string, obj interface{}) error {
 		Node:    *nPtr,
 		Indexes: make([]string, 0),
 		Schema:  schema,
+		Codec:   codec,
 	}
 
 	tbl.Indexes = append(tbl.Indexes, "Id")
 
 	v, _ := s.db.encode(tbl)
-	s.insertWithNode(getTableKey(table), v, tbl.Node)
+	_, _, err = s.insertWithNode(getTableKey(table), v, tbl.Node)
+	nPtr.NodeRelease(mm)
 
-	return nil
+	return err
 }
 
 func (s *Snapshot) CreateIndex(index IndexField) error {
+	if s.db.readOnly {
+		return ErrReadOnly
+	}
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
 
-	tPtrMarshaled, found := s.get(getTableKey(index.Table))
+	tPtrMarshaled, found, err := s.get(getTableKey(index.Table))
+	if err != nil {
+		return err
+	}
 	if found == false {
 		return fmt.Errorf("Unknown table")
 	}
 	var tbl Table
 	s.db.decode(*tPtrMarshaled, &tbl)
 
-	tbl.Indexes = append(tbl.Indexes, index.Field)
-
-	v, _ := s.db.encode(tbl)
-	s.insertWithNode(getTableKey(index.Table), v, tbl.Node)
-
-	nPtr, _, err := newNode(mm)
+	nPtr, _, err := newNode(mm, nodeKind0)
+	if err != nil {
+		return err
+	}
+	v, _ := s.db.encode(nPtr)
+	_, _, err = s.insertWithNode(index.getIndexKey(), v, *nPtr)
+	nPtr.NodeRelease(mm)
 	if err != nil {
 		return err
 	}
-	v, _ = s.db.encode(nPtr)
-	s.insertWithNode(index.getIndexKey(), v, *nPtr)
 
-	return nil
+	tbl.Indexes = append(tbl.Indexes, index.Field)
+
+	v, _ = s.db.encode(tbl)
+	_, _, err = s.insertWithNode(getTableKey(index.Table), v, tbl.Node)
+
+	return err
 }
 
 func (s *Snapshot) HasTable(table string) bool {
@@ -312,7 +408,7 @@ func (s *Snapshot) HasTable(table string) bool {
 	mm.Lock()
 	defer mm.Unlock()
 
-	_, exists := s.get(getTableKey(table))
+	_, exists, _ := s.get(getTableKey(table))
 
 	return exists
 }
@@ -322,8 +418,7 @@ func (s *Snapshot) Iter() *Iterator {
 	mm.Lock()
 	defer mm.Unlock()
 
-	iter := s.root.getNodeIterator(mm)
-	return iter
+	return s.root.getNodeIterator(s.db)
 }
 
 func (s *Snapshot) Snapshot() *Snapshot {
@@ -333,7 +428,7 @@ func (s *Snapshot) Snapshot() *Snapshot {
 
 	s.writable = nil
 
-	s.root.getNode(mm).Retain()
+	s.db.retainRoot(s.root)
 
 	return &Snapshot{
 		db:   s.db,
@@ -351,10 +446,10 @@ func (s *Snapshot) ResetTo(to *Snapshot) {
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
-	s.root.getNode(mm).Retain()
+	s.db.retainRoot(s.root)
 }
 
-func (s *Snapshot) writeNode(nodePtr *Ptr) *Ptr {
+func (s *Snapshot) writeNode(nodePtr *Ptr) (*Ptr, error) {
 	mm := s.db.allocator
 	if s.writable == nil {
 		lru, err := simplelru.NewLRU(defaultWritableCache, nil)
@@ -369,42 +464,40 @@ func (s *Snapshot) writeNode(nodePtr *Ptr) *Ptr {
 	if _, ok := s.writable.Get(*nodePtr); ok {
 		//println("hit", t.writable.Len())
 		n.Retain()
-		return nodePtr
+		return nodePtr, nil
 	}
 
 	//println("miss", t.writable.Len())
 
-	ncPtr, nc, err := newNode(mm)
+	ncPtr, _, err := copyNode(mm, n, kindForEdges(n.edgeCount(), s.db.radix))
 	if err != nil {
-		panic(err)
-	}
-
-	nc.keyPtr = n.keyPtr
-	nc.keyPtr.Retain(mm)
-	nc.valPtr = n.valPtr
-	nc.valPtr.Retain(mm)
-	nc.prefixPtr = n.prefixPtr
-	nc.prefixPtr.Retain(mm)
-
-	nc.edges = n.edges
-
-	for _, edgeNode := range nc.edges {
-		edgeNode.NodeRetain(mm)
-	}
-
-	if !n.nodePtr.isNull() {
-		nc.nodePtr = n.nodePtr
-		nc.nodePtr.NodeRetain(mm)
+		return nil, err
 	}
 
 	s.writable.Add(*ncPtr, nil)
 
-	return ncPtr
+	return ncPtr, nil
 }
 
-func (s *Snapshot) insert(nodePtr *Ptr, k, search []byte, vPtr ByteArray, vNode Ptr) (*Ptr, *ByteArray, bool) {
+// dropNode releases a node returned by writeNode that is not used because
+// of an error. The nodes written below it may be freed with it, so all the
+// writable nodes are forgotten and the next changes copy them again.
+func (s *Snapshot) dropNode(nPtr *Ptr) {
+	nPtr.NodeRelease(s.db.allocator)
+	s.writable = nil
+}
+
+// insert adds k to the trie at nodePtr, returning the node replacing it.
+// The value vPtr and the node vNode are retained by the leaf of k.
+//
+// Each level allocates everything it needs before changing any node, so
+// when an allocation fails the error is returned with the trie unchanged.
+// The nodes of the levels below are written before the ones above, so a
+// level whose node was changed in place has writable ancestors, which
+// do not allocate.
+func (s *Snapshot) insert(nodePtr *Ptr, k, search []byte, vPtr ByteArray, vNode Ptr) (*Ptr, *ByteArray, bool, error) {
 	if err := vPtr.checkBytesLength(); err != nil {
-		return nil, nil, false
+		return nil, nil, false, err
 	}
 
 	mm := s.db.allocator
@@ -412,279 +505,393 @@ func (s *Snapshot) insert(nodePtr *Ptr, k, search []byte, vPtr ByteArray, vNode
 
 	// Handle key exhaustion
 	if len(search) == 0 {
-		var oldVal ByteArray
-		didUpdate := false
-		if n.isLeaf() {
-			didUpdate = true
+		keyPtr, err := s.db.newLeafKey(k)
+		if err != nil {
+			return nil, nil, false, err
+		}
 
-			oldVal = n.valPtr
-			oldVal.Retain(mm)
+		ncPtr, err := s.writeNode(nodePtr)
+		if err != nil {
+			keyPtr.Release(mm)
+			return nil, nil, false, err
 		}
 
-		ncPtr := s.writeNode(nodePtr)
-		nc := ncPtr.getNode(mm)
+		var oldVal *ByteArray
+		if n.isLeaf() {
+			oldVal = &ByteArray{}
+			*oldVal = n.leaf().valPtr
+			oldVal.Retain(mm)
+		}
 
-		nc.keyPtr.Release(mm)
-		nc.keyPtr = *newBytesFromSlice(mm, k)
-		nc.valPtr.Release(mm)
-		nc.valPtr = vPtr
-		nc.valPtr.Retain(mm)
-		if nc.nodePtr != vNode {
-			nc.nodePtr.NodeRelease(mm)
-			nc.nodePtr = vNode
+		ncl := ncPtr.getNode(mm).leaf()
+
+		ncl.keyPtr.Release(mm)
+		ncl.keyPtr = keyPtr
+		ncl.valPtr.Release(mm)
+		ncl.valPtr = vPtr
+		ncl.valPtr.Retain(mm)
+		if ncl.nodePtr != vNode {
+			ncl.nodePtr.NodeRelease(mm)
+			ncl.nodePtr = vNode
+			ncl.nodePtr.NodeRetain(mm)
 		}
 
-		return ncPtr, &oldVal, didUpdate
+		return ncPtr, oldVal, oldVal != nil, nil
 	}
 
 	edgeLabel := search[0]
-	childPtr := n.edges[edgeLabel]
+	childPtr := n.getEdge(edgeLabel)
 
 	// No edge, create one
 	if childPtr.isNull() {
-		nnPtr, nn, err := newNode(mm)
+		nnPtr, nn, err := s.newLeafNode(k, search)
 		if err != nil {
-			panic(err)
+			return nil, nil, false, err
+		}
+
+		nc, err := s.writeNode(nodePtr)
+		if err != nil {
+			nnPtr.NodeRelease(mm)
+			return nil, nil, false, err
 		}
 
-		nn.keyPtr = *newBytesFromSlice(mm, k)
-		nn.valPtr = vPtr
-		nn.valPtr.Retain(mm)
-		nn.nodePtr = vNode
-		nn.prefixPtr = *newBytesFromSlice(mm, search)
+		ncPtr, err := addNodeEdge(s.db, s.writable, nc, edgeLabel, *nnPtr)
+		if err != nil {
+			s.dropNode(nc)
+			nnPtr.NodeRelease(mm)
+			return nil, nil, false, err
+		}
 
-		nc := s.writeNode(nodePtr)
-		nc.getNode(mm).edges[edgeLabel] = *nnPtr
+		nnl := nn.leaf()
+		nnl.valPtr = vPtr
+		nnl.valPtr.Retain(mm)
+		nnl.nodePtr = vNode
+		nnl.nodePtr.NodeRetain(mm)
 
-		return nc, nil, false
+		return ncPtr, nil, false, nil
 	}
 
 	child := childPtr.getNode(mm)
 
 	// Determine longest prefix of the search key on match
-	childPrefix := child.prefixPtr.getBytes(mm)
-	commonPrefix := longestPrefix(search, childPrefix)
-	if commonPrefix == len(childPrefix) {
+	commonPrefix := child.prefixPtr.commonPrefix(mm, search)
+	if commonPrefix == int(child.prefixPtr.Size) {
 		search = search[commonPrefix:]
-		newChildPtr, oldVal, didUpdate := s.insert(&childPtr, k, search, vPtr, vNode)
+		newChildPtr, oldVal, didUpdate, err := s.insert(&childPtr, k, search, vPtr, vNode)
+		if err != nil {
+			return nil, nil, false, err
+		}
 		if newChildPtr != nil {
-			ncPtr := s.writeNode(nodePtr)
-			nc := ncPtr.getNode(mm)
-			nc.edges[edgeLabel].NodeRelease(mm)
-			nc.edges[edgeLabel] = *newChildPtr
-			return ncPtr, oldVal, didUpdate
+			ncPtr, err := s.writeNode(nodePtr)
+			if err != nil {
+				s.dropNode(newChildPtr)
+				if oldVal != nil {
+					oldVal.Release(mm)
+				}
+				return nil, nil, false, err
+			}
+			e := ncPtr.getNode(mm).edgeRef(edgeLabel)
+			e.NodeRelease(mm)
+			*e = *newChildPtr
+			return ncPtr, oldVal, didUpdate, nil
 		}
-		return nil, oldVal, didUpdate
+		return nil, oldVal, didUpdate, nil
 	}
 
 	// Split the node
-	ncPtr := s.writeNode(nodePtr)
-	nc := ncPtr.getNode(mm)
+	childPrefix := child.prefixPtr.getBytes(mm)
+	splitNodePtr, splitNode, err := newNode(mm, nodeKind4)
+	if err != nil {
+		return nil, nil, false, err
+	}
 
-	splitNodePtr, splitNode, err := newNode(mm)
+	splitPrefix, err := allocBytes(mm, search[:commonPrefix])
 	if err != nil {
-		panic(err)
+		splitNodePtr.NodeRelease(mm)
+		return nil, nil, false, err
 	}
+	splitNode.prefixPtr = *splitPrefix
 
-	splitNode.prefixPtr = *newBytesFromSlice(mm, search[:commonPrefix])
+	newPrefix, err := allocBytes(mm, childPrefix[commonPrefix:])
+	if err != nil {
+		splitNodePtr.NodeRelease(mm)
+		return nil, nil, false, err
+	}
+
+	// The new key is either a leaf of the split node or a new edge of it
+	search = search[commonPrefix:]
+	var leafNodePtr *Ptr
+	var leafNode *Node
+	if len(search) == 0 {
+		leafNode = splitNode
+		leafNode.leaf().keyPtr, err = s.db.newLeafKey(k)
+	} else {
+		leafNodePtr, leafNode, err = s.newLeafNode(k, search)
+	}
+	if err != nil {
+		newPrefix.Release(mm)
+		splitNodePtr.NodeRelease(mm)
+		return nil, nil, false, err
+	}
+
+	fail := func(err error) (*Ptr, *ByteArray, bool, error) {
+		newPrefix.Release(mm)
+		splitNodePtr.NodeRelease(mm)
+		if leafNodePtr != nil {
+			leafNodePtr.NodeRelease(mm)
+		}
+		return nil, nil, false, err
+	}
+
+	ncPtr, err := s.writeNode(nodePtr)
+	if err != nil {
+		return fail(err)
+	}
+	nc := ncPtr.getNode(mm)
 
 	// Restore the existing child node
-	modChildPtr := s.writeNode(&childPtr)
+	modChildPtr, err := s.writeNode(&childPtr)
+	if err != nil {
+		s.dropNode(ncPtr)
+		return fail(err)
+	}
 	modChild := modChildPtr.getNode(mm)
-	pref := modChild.prefixPtr.getBytes(mm)
 
-	splitNode.edges[pref[commonPrefix]] = *modChildPtr
+	splitNode.addEdge(childPrefix[commonPrefix], *modChildPtr)
 
-	nc.edges[edgeLabel].NodeRelease(mm)
-	nc.edges[edgeLabel] = *splitNodePtr
+	e := nc.edgeRef(edgeLabel)
+	e.NodeRelease(mm)
+	*e = *splitNodePtr
 
-	newPrefix := *newBytesFromSlice(mm, pref[commonPrefix:])
 	modChild.prefixPtr.Release(mm)
-	modChild.prefixPtr = newPrefix
+	modChild.prefixPtr = *newPrefix
 
-	// If the new key is a subset, add to this node
-	search = search[commonPrefix:]
-	if len(search) == 0 {
-		splitNode.keyPtr = *newBytesFromSlice(mm, k)
-		splitNode.valPtr = vPtr
-		vPtr.Retain(mm)
-		splitNode.nodePtr = vNode
-		return ncPtr, nil, false
+	if leafNodePtr != nil {
+		splitNode.addEdge(search[0], *leafNodePtr)
 	}
 
-	enPtr, en, err := newNode(mm)
+	l := leafNode.leaf()
+	l.valPtr = vPtr
+	vPtr.Retain(mm)
+	l.nodePtr = vNode
+	l.nodePtr.NodeRetain(mm)
+
+	return ncPtr, nil, false, nil
+}
+
+// newLeafNode allocates a node with prefix search holding the key k, to
+// which the caller sets the value
+func (s *Snapshot) newLeafNode(k, search []byte) (*Ptr, *Node, error) {
+	mm := s.db.allocator
+
+	nPtr, n, err := newNode(mm, nodeKind0)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+
+	if n.leaf().keyPtr, err = s.db.newLeafKey(k); err != nil {
+		nPtr.NodeRelease(mm)
+		return nil, nil, err
 	}
-	en.keyPtr = *newBytesFromSlice(mm, k)
-	en.valPtr = vPtr
-	vPtr.Retain(mm)
-	en.nodePtr = vNode
-	en.prefixPtr = *newBytesFromSlice(mm, search)
 
-	splitNode.edges[search[0]] = *enPtr
+	prefix, err := allocBytes(mm, search)
+	if err != nil {
+		nPtr.NodeRelease(mm)
+		return nil, nil, err
+	}
+	n.prefixPtr = *prefix
 
-	return ncPtr, nil, false
+	return nPtr, n, nil
 }
 
-// mergeChild merges a trie node with its parent node.
+// mergeChild merges a trie node with its parent node. The merged node
+// replaces the node at nPtr and is returned.
 //
 // NOTE: don't merge back to the root trie node,
 //       as insert() doesn't handle search lookup properly.
-func (s *Snapshot) mergeChild(n *Node) {
-	mm := s.db.allocator
-
-	childPtr := n.getFirstChild()
-	child := childPtr.getNode(mm)
+func (s *Snapshot) mergeChild(nPtr *Ptr) (*Ptr, error) {
+	n := nPtr.getNode(s.db.allocator)
 
 	if !n.hasOneChild() || n.isLeaf() {
 		panic("Can't merge non leaf child node")
 	}
 
-	// Merge the nodes.
-	mergedPrefix := concat(n.prefixPtr.getBytes(mm), child.prefixPtr.getBytes(mm))
-	n.prefixPtr.Release(mm)
-	n.prefixPtr = *newBytesFromSlice(mm, mergedPrefix)
-	n.keyPtr.Release(mm) // check if needed
-	n.valPtr.Release(mm) // check if needed
-	//n.nodePtr.NodeRelease(mm)
-	n.keyPtr = child.keyPtr
-	n.keyPtr.Retain(mm)
-	n.valPtr = child.valPtr
-	n.valPtr.Retain(mm)
-	n.nodePtr = child.nodePtr
-	n.nodePtr.NodeRetain(mm)
-
-	n.edges = child.edges
-
-	for _, edgeNode := range n.edges {
-		edgeNode.NodeRetain(mm)
-	}
-
-	childPtr.NodeRelease(mm)
+	return mergeNodeChild(s.db, s.writable, nPtr)
 }
 
-func (s *Snapshot) delete(parentPtr, nPtr *Ptr, search []byte) (*Ptr, *ByteArray) {
+// delete removes the key search from the trie at nPtr, returning the node
+// replacing it. As with insert a failed allocation leaves the trie
+// unchanged. Merging nodes only compacts the trie, so it is skipped when
+// the merged node can not be allocated.
+func (s *Snapshot) delete(parentPtr, nPtr *Ptr, search []byte) (*Ptr, *ByteArray, error) {
 	mm := s.db.allocator
 	n := nPtr.getNode(mm)
 
 	// Check for key exhaustion
 	if len(search) == 0 {
 		if !n.isLeaf() {
-			return nil, nil
+			return nil, nil, nil
+		}
+
+		// Remove the leaf node
+		ncPtr, err := s.writeNode(nPtr)
+		if err != nil {
+			return nil, nil, err
 		}
 
 		var oldVal ByteArray
-		oldVal = n.valPtr
+		oldVal = n.leaf().valPtr
 		oldVal.Retain(mm)
 
-		// Remove the leaf node
-		ncPtr := s.writeNode(nPtr)
 		nc := ncPtr.getNode(mm)
-		nc.keyPtr.Release(mm)
-		nc.valPtr.Release(mm)
-		nc.nodePtr.NodeRelease(mm)
+		ncl := nc.leaf()
+		ncl.keyPtr.Release(mm)
+		ncl.valPtr.Release(mm)
+		ncl.nodePtr.NodeRelease(mm)
 
 		// Check if this node should be merged
 		if *nPtr != s.root && nc.hasOneChild() && parentPtr != nil {
-			s.mergeChild(nc)
+			if mPtr, err := s.mergeChild(ncPtr); err == nil {
+				ncPtr = mPtr
+			}
 		}
 
-		return ncPtr, &oldVal
+		return ncPtr, &oldVal, nil
 	}
 
 	edgeLabel := search[0]
-	childPtr := n.edges[edgeLabel]
+	childPtr := n.getEdge(edgeLabel)
 	if childPtr.isNull() {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	child := childPtr.getNode(mm)
-	childPrefix := child.prefixPtr.getBytes(mm)
-
-	if !bytes.HasPrefix(search, childPrefix) {
-		return nil, nil
+	if !child.prefixPtr.isPrefixOf(mm, search) {
+		return nil, nil, nil
 	}
 
 	// Consume the search prefix
-	search = search[len(childPrefix):]
-	newChildPtr, oldVal := s.delete(nPtr, &childPtr, search)
-	if newChildPtr == nil {
-		return nil, oldVal
+	search = search[child.prefixPtr.Size:]
+	newChildPtr, oldVal, err := s.delete(nPtr, &childPtr, search)
+	if err != nil || newChildPtr == nil {
+		return nil, oldVal, err
 	}
 
 	newChild := newChildPtr.getNode(mm)
 
-	ncPtr := s.writeNode(nPtr)
+	ncPtr, err := s.writeNode(nPtr)
+	if err != nil {
+		s.dropNode(newChildPtr)
+		oldVal.Release(mm)
+		return nil, nil, err
+	}
 	nc := ncPtr.getNode(mm)
 
-	nc.edges[edgeLabel].NodeRelease(mm)
+	e := nc.edgeRef(edgeLabel)
+	e.NodeRelease(mm)
 	if newChild.isLeaf() == false && newChild.getFirstChild() == 0 {
-		nc.edges[edgeLabel] = 0
+		nc.removeEdge(edgeLabel)
 		if *nPtr != s.root && parentPtr != nil && nc.hasOneChild() && !nc.isLeaf() {
-			s.mergeChild(nc)
+			if mPtr, err := s.mergeChild(ncPtr); err == nil {
+				ncPtr = mPtr
+			}
+		}
+		if newChildPtr.NodeRelease(mm) {
+			s.writable.Remove(*newChildPtr)
 		}
-		newChildPtr.NodeRelease(mm)
 	} else {
-		nc.edges[edgeLabel] = *newChildPtr
+		*e = *newChildPtr
 	}
 
-	return ncPtr, oldVal
+	return ncPtr, oldVal, nil
 }
 
 func (s *Snapshot) Insert(k, v []byte) (*[]byte, bool) {
 	return s.InsertWithNode(k, v, 0)
 }
 
+// InsertWithNode inserts k with the value v and the node vp, whose
+// reference the snapshot takes over. When the value can not be stored
+// nothing is changed and false is returned.
 func (s *Snapshot) InsertWithNode(k, v []byte, vp Ptr) (*[]byte, bool) {
+	defer s.db.opEnd(MetricInsert, MetricInsertTime, s.db.opStart())
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
 
-	return s.insertWithNode(k, v, vp)
+	oVal, didUpdate, _ := s.insertWithNode(k, v, vp)
+	vp.NodeRelease(mm)
+	return oVal, didUpdate
 }
 
-func (s *Snapshot) insertWithNode(k, v []byte, vp Ptr) (*[]byte, bool) {
+// insertWithNode inserts k with the value v and the node vp, which is
+// retained
+func (s *Snapshot) insertWithNode(k, v []byte, vp Ptr) (*[]byte, bool, error) {
+	if s.db.readOnly {
+		return nil, false, ErrReadOnly
+	}
+
 	if err := checkBytesLength(v); err != nil {
-		return nil, false
+		return nil, false, err
 	}
 
-	k = encodeKey(k)
-	mm := s.db.allocator
+	if err := s.reserve(len(v)); err != nil {
+		return nil, false, err
+	}
 
-	vPtr := *newBytesFromSlice(mm, v)
+	vPtr, err := s.db.newValue(v, s.db.compressorFor(k))
+	if err != nil {
+		return nil, false, s.db.fullError(err)
+	}
+
+	k = s.db.rootKey(k)
+	mm := s.db.allocator
 
 	s.writer.Lock()
 
-	newRoot, oldVal, didUpdate := s.insert(&s.root, k, k, vPtr, vp)
+	newRoot, oldVal, didUpdate, err := s.insert(&s.root, k, k, *vPtr, vp)
 	if newRoot != nil {
 		s.root.NodeRelease(mm)
 		s.root = *newRoot
 	}
 
-	mm.Unlock()
-	s.db.Grow()
-	mm.Lock()
-
 	s.writer.Unlock()
 
 	vPtr.Release(mm)
 
+	if err != nil {
+		return nil, false, s.db.fullError(err)
+	}
+
 	if oldVal == nil {
-		return nil, didUpdate
+		return nil, didUpdate, nil
 	}
 
 	mm.Lock()
-	val := oldVal.getBytes(mm)
+	defer mm.Unlock()
+	defer oldVal.Release(mm)
+
+	// The value is replaced even when the old one can not be read
+	val, err := s.db.getValue(oldVal)
+	if err != nil {
+		return nil, didUpdate, nil
+	}
 	oVal := make([]byte, len(val))
 	copy(oVal, val)
-	oldVal.Release(mm)
-	mm.Unlock()
 
-	return &oVal, didUpdate
+	return &oVal, didUpdate, nil
 }
 
+// Delete removes k, returning false when it is not found or can not be
+// removed
 func (s *Snapshot) Delete(k []byte) bool {
+	defer s.db.opEnd(MetricDelete, MetricDeleteTime, s.db.opStart())
+
+	if s.db.readOnly {
+		return false
+	}
+
 	s.writer.Lock()
 	defer s.writer.Unlock()
 
@@ -692,13 +899,13 @@ func (s *Snapshot) Delete(k []byte) bool {
 	mm.Lock()
 	defer mm.Unlock()
 
-	k = encodeKey(k)
-	newRoot, oldVal := s.delete(nil, &s.root, k)
+	k = s.db.rootKey(k)
+	newRoot, oldVal, err := s.delete(nil, &s.root, k)
 	if oldVal != nil {
 		oldVal.Release(mm)
 	}
 
-	if newRoot != nil {
+	if err == nil && newRoot != nil {
 		s.root.NodeRelease(mm)
 		s.root = *newRoot
 		return true
@@ -721,12 +928,47 @@ func compKeys(a []byte, b []byte) bool {
 	return false
 }
 
-func (s *Snapshot) InsertObj(table string, obj interface{}) error {
+// replaceTree stores under k the value v of a trie whose root changed from
+// root to newRoot. A trie changed in place is already stored, otherwise the
+// new trie is released when it can not be stored.
+func (s *Snapshot) replaceTree(k, v []byte, root, newRoot Ptr) error {
+	mm := s.db.allocator
+	if newRoot == root {
+		newRoot.NodeRelease(mm)
+		return nil
+	}
+
+	if _, _, err := s.insertWithNode(k, v, newRoot); err != nil {
+		s.dropNode(&newRoot)
+		return err
+	}
+	newRoot.NodeRelease(mm)
+	return nil
+}
+
+// InsertObj inserts obj in table, updating its indexes. When an allocation
+// fails the error is returned and nothing leaks, but indexes updated before
+// the failure are not restored. ErrDatabaseFull is returned when it does not
+// fit in the maximum size of the database.
+func (s *Snapshot) InsertObj(table string, obj interface{}) (err error) {
+	defer s.db.opEnd(MetricInsert, MetricInsertTime, s.db.opStart())
+
+	if s.db.readOnly {
+		return ErrReadOnly
+	}
+
+	defer func() {
+		err = s.db.fullError(err)
+	}()
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
 
-	tPtrMarshaled, found := s.get(getTableKey(table))
+	tPtrMarshaled, found, err := s.get(getTableKey(table))
+	if err != nil {
+		return err
+	}
 	if found == false {
 		return fmt.Errorf("Unknown table")
 	}
@@ -755,37 +997,58 @@ func (s *Snapshot) InsertObj(table string, obj interface{}) error {
 		return err
 	}
 
+	if err := s.reserve(len(objMarshaled)); err != nil {
+		return err
+	}
+
 	k, err := getEncodedIndexKey(pv)
 	if err != nil {
 		return err
 	}
-	ek := encodeKey(k)
+	ek := s.db.tableKey(k)
 
 	s.addObjAllocated(len(objMarshaled))
 	s.addObjAllocated(len(k))
 
-	objPtr := *newBytesFromSlice(mm, objMarshaled)
-	newRoot, oldVal, _ := s.insert(&tbl.Node, ek, ek, objPtr, 0)
-	if *newRoot == tbl.Node {
-		newRoot.NodeRelease(mm)
+	var c Compressor
+	if tbl.Codec != 0 {
+		if c, err = getCompressor(tbl.Codec); err != nil {
+			return err
+		}
+	}
+
+	objPtr, err := s.db.newValue(objMarshaled, c)
+	if err != nil {
+		return err
 	}
+	newRoot, oldVal, _, err := s.insert(&tbl.Node, ek, ek, *objPtr, 0)
 	objPtr.Release(mm)
+	if err != nil {
+		return err
+	}
 
-	if newRoot != nil {
-		tbl.Node = *newRoot
-		tblMarshaled, _ := s.db.encode(tbl)
-		s.insertWithNode(getTableKey(table), tblMarshaled, tbl.Node)
+	root := tbl.Node
+	tbl.Node = *newRoot
+	tblMarshaled, _ := s.db.encode(tbl)
+	if err := s.replaceTree(getTableKey(table), tblMarshaled, root, tbl.Node); err != nil {
+		if oldVal != nil {
+			oldVal.Release(mm)
+		}
+		return err
 	}
 
 	var oldV reflect.Value
 	if oldVal != nil {
-		oldBytes := oldVal.getBytes(mm)
+		defer oldVal.Release(mm)
+
+		oldBytes, err := s.db.getValue(oldVal)
+		if err != nil {
+			return err
+		}
 		t := reflect.TypeOf(obj)
 		oldV = reflect.New(t)
 		s.db.decode(oldBytes, oldV.Interface())
 		oldV = reflect.Indirect(oldV)
-
-		defer oldVal.Release(mm)
 	}
 
 	// Do the additional indexes
@@ -795,7 +1058,10 @@ func (s *Snapshot) InsertObj(table string, obj interface{}) error {
 		}
 
 		ifield := IndexField{Table: table, Field: indexField}
-		tPtrMarshaled, found := s.get(ifield.getIndexKey())
+		tPtrMarshaled, found, err := s.get(ifield.getIndexKey())
+		if err != nil {
+			return err
+		}
 		if found == false {
 			return fmt.Errorf("Unknown index")
 		}
@@ -823,10 +1089,13 @@ func (s *Snapshot) InsertObj(table string, obj interface{}) error {
 				return err
 			}
 			s.addObjAllocated(-len(oldIk))
-			oldIk = encodeKey(oldIk)
+			oldIk = s.db.tableKey(oldIk)
 
 			oldUKeys := make([][]byte, 0)
-			oldUKeysMarshalled, found := tPtr.getNode(mm).Get(s.db, oldIk)
+			oldUKeysMarshalled, found, err := tPtr.getNode(mm).Get(s.db, oldIk)
+			if err != nil {
+				return err
+			}
 			if found {
 				s.db.decode(*oldUKeysMarshalled, &oldUKeys)
 			}
@@ -859,25 +1128,33 @@ func (s *Snapshot) InsertObj(table string, obj interface{}) error {
 					return err
 				}
 
-				pKeyPtr := *newBytesFromSlice(mm, ivMarshaled)
-				newRoot, oldIVal, _ = s.insert(&tPtr, oldIk, oldIk, pKeyPtr, 0)
+				pKeyPtr, err := s.db.newValue(ivMarshaled, c)
+				if err != nil {
+					return err
+				}
+				newRoot, oldIVal, _, err = s.insert(&tPtr, oldIk, oldIk, *pKeyPtr, 0)
 				pKeyPtr.Release(mm)
+				if err != nil {
+					return err
+				}
 
 				// When single entry, remove the node
 			} else {
-				newRoot, oldIVal = s.delete(nil, &tPtr, oldIk)
+				if newRoot, oldIVal, err = s.delete(nil, &tPtr, oldIk); err != nil {
+					return err
+				}
 			}
 
 			if oldIVal != nil {
 				oldIVal.Release(mm)
 			}
-			if *newRoot == tPtr {
-				newRoot.NodeRelease(mm)
-			}
 			if newRoot != nil {
+				root := tPtr
 				tPtr = *newRoot
 				tPtrMarshaled, _ := s.db.encode(tPtr)
-				s.insertWithNode(ifield.getIndexKey(), tPtrMarshaled, tPtr)
+				if err := s.replaceTree(ifield.getIndexKey(), tPtrMarshaled, root, tPtr); err != nil {
+					return err
+				}
 			}
 		}
 
@@ -888,10 +1165,13 @@ func (s *Snapshot) InsertObj(table string, obj interface{}) error {
 
 		s.addObjAllocated(len(ik))
 
-		ik = encodeKey(ik)
+		ik = s.db.tableKey(ik)
 
 		oldKeys := make([][]byte, 0)
-		oldKeysMarshalled, found := tPtr.getNode(mm).Get(s.db, ik)
+		oldKeysMarshalled, found, err := tPtr.getNode(mm).Get(s.db, ik)
+		if err != nil {
+			return err
+		}
 		if found {
 			s.db.decode(*oldKeysMarshalled, &oldKeys)
 		}
@@ -908,31 +1188,47 @@ func (s *Snapshot) InsertObj(table string, obj interface{}) error {
 			return err
 		}
 
-		pKeyPtr := *newBytesFromSlice(mm, ivMarshaled)
-		newRoot, oldValue, _ := s.insert(&tPtr, ik, ik, pKeyPtr, 0)
-		if oldValue != nil {
-			oldValue.Release(mm)
+		pKeyPtr, err := s.db.newValue(ivMarshaled, c)
+		if err != nil {
+			return err
 		}
+		newRoot, oldValue, _, err := s.insert(&tPtr, ik, ik, *pKeyPtr, 0)
 		pKeyPtr.Release(mm)
-		if *newRoot == tPtr {
-			newRoot.NodeRelease(mm)
+		if err != nil {
+			return err
 		}
-		if newRoot != nil {
-			tPtr = *newRoot
-			tPtrMarshaled, _ := s.db.encode(tPtr)
-			s.insertWithNode(ifield.getIndexKey(), tPtrMarshaled, tPtr)
+		if oldValue != nil {
+			oldValue.Release(mm)
+		}
+
+		root := tPtr
+		tPtr = *newRoot
+		rootMarshaled, _ := s.db.encode(tPtr)
+		if err := s.replaceTree(ifield.getIndexKey(), rootMarshaled, root, tPtr); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// DeleteObj deletes the object with the given id from table, updating its
+// indexes. As with InsertObj a failed allocation leaves nothing leaked.
 func (s *Snapshot) DeleteObj(table string, id interface{}) error {
+	defer s.db.opEnd(MetricDelete, MetricDeleteTime, s.db.opStart())
+
+	if s.db.readOnly {
+		return ErrReadOnly
+	}
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
 
-	tPtrMarshaled, found := s.get(getTableKey(table))
+	tPtrMarshaled, found, err := s.get(getTableKey(table))
+	if err != nil {
+		return err
+	}
 	if found == false {
 		return fmt.Errorf("Unknown table")
 	}
@@ -940,17 +1236,24 @@ func (s *Snapshot) DeleteObj(table string, id interface{}) error {
 	var tbl Table
 	s.db.decode(*tPtrMarshaled, &tbl)
 
+	var c Compressor
+	if tbl.Codec != 0 {
+		if c, err = getCompressor(tbl.Codec); err != nil {
+			return err
+		}
+	}
+
 	k, err := getEncodedIndexKey(reflect.ValueOf(id))
 	if err != nil {
 		return err
 	}
-	ek := encodeKey(k)
+	ek := s.db.tableKey(k)
 
 	s.addObjAllocated(-len(k))
 
-	newRoot, oldVal := s.delete(nil, &tbl.Node, ek)
-	if *newRoot == tbl.Node {
-		newRoot.NodeRelease(mm)
+	newRoot, oldVal, err := s.delete(nil, &tbl.Node, ek)
+	if err != nil {
+		return err
 	}
 	if oldVal != nil {
 		defer oldVal.Release(mm)
@@ -970,15 +1273,21 @@ func (s *Snapshot) DeleteObj(table string, id interface{}) error {
 
 		oldV = reflect.ValueOf(obj)
 
-		oldBytes := oldVal.getBytes(mm)
+		oldBytes, err := s.db.getValue(oldVal)
+		if err != nil {
+			return err
+		}
 		s.db.decode(oldBytes, obj)
 		oldV = reflect.Indirect(oldV)
 	}
 
 	if newRoot != nil {
+		root := tbl.Node
 		tbl.Node = *newRoot
 		tblMarshaled, _ := s.db.encode(tbl)
-		s.insertWithNode(getTableKey(table), tblMarshaled, tbl.Node)
+		if err := s.replaceTree(getTableKey(table), tblMarshaled, root, tbl.Node); err != nil {
+			return err
+		}
 	}
 
 	// Do the additional indexes
@@ -988,7 +1297,10 @@ func (s *Snapshot) DeleteObj(table string, id interface{}) error {
 		}
 
 		ifield := IndexField{Table: table, Field: indexField}
-		tPtrMarshaled, found := s.get(ifield.getIndexKey())
+		tPtrMarshaled, found, err := s.get(ifield.getIndexKey())
+		if err != nil {
+			return err
+		}
 		if found == false {
 			return fmt.Errorf("Unknown index")
 		}
@@ -1006,10 +1318,13 @@ func (s *Snapshot) DeleteObj(table string, id interface{}) error {
 			return err
 		}
 		s.addObjAllocated(-len(ik))
-		ik = encodeKey(ik)
+		ik = s.db.tableKey(ik)
 
 		oldKeys := make([][]byte, 0)
-		oldKeysMarshalled, found := n.Get(s.db, ik)
+		oldKeysMarshalled, found, err := n.Get(s.db, ik)
+		if err != nil {
+			return err
+		}
 		if found {
 			s.db.decode(*oldKeysMarshalled, &oldKeys)
 		}
@@ -1024,8 +1339,9 @@ func (s *Snapshot) DeleteObj(table string, id interface{}) error {
 				if bytes.Equal(k, v) {
 					oldKeys = append(oldKeys[:i], oldKeys[i+1:]...)
 					found = true
-					okMar, _ := s.db.encode(oldKeys[i])
+					okMar, _ := s.db.encode(v)
 					s.addObjAllocated(-len(okMar))
+					break
 				}
 			}
 			if !found {
@@ -1042,25 +1358,33 @@ func (s *Snapshot) DeleteObj(table string, id interface{}) error {
 				return err
 			}
 
-			pKeyPtr := *newBytesFromSlice(mm, ivMarshaled)
-			newRoot, oldIVal, _ = s.insert(&tPtr, ik, ik, pKeyPtr, 0)
+			pKeyPtr, err := s.db.newValue(ivMarshaled, c)
+			if err != nil {
+				return err
+			}
+			newRoot, oldIVal, _, err = s.insert(&tPtr, ik, ik, *pKeyPtr, 0)
 			pKeyPtr.Release(mm)
+			if err != nil {
+				return err
+			}
 
 			// When single entry, remove the node
 		} else {
-			newRoot, oldIVal = s.delete(nil, &tPtr, ik)
+			if newRoot, oldIVal, err = s.delete(nil, &tPtr, ik); err != nil {
+				return err
+			}
 		}
 
 		if oldIVal != nil {
 			oldIVal.Release(mm)
 		}
-		if *newRoot == tPtr {
-			newRoot.NodeRelease(mm)
-		}
 		if newRoot != nil {
+			root := tPtr
 			tPtr = *newRoot
 			tPtrMarshaled, _ := s.db.encode(tPtr)
-			s.insertWithNode(ifield.getIndexKey(), tPtrMarshaled, tPtr)
+			if err := s.replaceTree(ifield.getIndexKey(), tPtrMarshaled, root, tPtr); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -1164,11 +1488,16 @@ func (s *Snapshot) OrderParser(input []byte) (*OrderField, error) {
 }
 
 func (s *Snapshot) Select(table string, args ...interface{}) (*ResultIterator, error) {
+	defer s.db.opEnd(MetricSelect, MetricSelectTime, s.db.opStart())
+
 	mm := s.db.allocator
 	mm.Lock()
 	defer mm.Unlock()
 
-	tPtrMarshaled, found := s.get(getTableKey(table))
+	tPtrMarshaled, found, err := s.get(getTableKey(table))
+	if err != nil {
+		return nil, err
+	}
 	if found == false {
 		return nil, fmt.Errorf("Unknown table")
 	}
@@ -1203,20 +1532,25 @@ func (s *Snapshot) Select(table string, args ...interface{}) (*ResultIterator, e
 	}
 
 	if orderClause.Field == "Id" {
-		iter = tbl.Node.getNodeIterator(mm)
+		iter = tbl.Node.getNodeIterator(s.db)
 	} else {
 		ifield := IndexField{Table: table, Field: orderClause.Field}
-		tPtrMarshaled, found := s.get(ifield.getIndexKey())
+		tPtrMarshaled, found, err := s.get(ifield.getIndexKey())
+		if err != nil {
+			return nil, err
+		}
 		if found == false {
 			return nil, fmt.Errorf("Unknown index")
 		}
 		var tPtr Ptr
 		s.db.decode(*tPtrMarshaled, &tPtr)
-		iter = tPtr.getNodeIterator(mm)
+		iter = tPtr.getNodeIterator(s.db)
 
 		tblNode = tbl.Node
 	}
 
+	iter.endScan = s.db.beginScan()
+
 	return &ResultIterator{
 		db:          s.db,
 		iter:        iter,
@@ -1235,8 +1569,13 @@ func (s *Snapshot) RootNode() *Node {
 }
 
 func (s *Snapshot) PrintTree() {
-	fmt.Println("<>")
-	s.RootNode().printTree(s.db.allocator, 0, "", false)
+	s.FprintTree(os.Stdout)
+}
+
+// FprintTree writes the nodes of the snapshot to w
+func (s *Snapshot) FprintTree(w io.Writer) {
+	fmt.Fprintln(w, "<>")
+	s.RootNode().printTree(w, s.db, 0, "", false)
 }
 
 func concat(a, b []byte) []byte {
@@ -0,0 +1,205 @@
+package ebakusdb
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/ebakus/ebakusdb/balloc"
+)
+
+// UpgradeStep is a step converting a database file to a newer format
+type UpgradeStep struct {
+	From        uint32
+	To          uint32
+	Description string
+}
+
+// formatUpgrade converts a database from the version it is registered for
+// to the next one
+type formatUpgrade struct {
+	description string
+	upgrade     func(db *DB) error
+}
+
+// formatUpgrades are the upgrade steps by the version they convert from
+var formatUpgrades = map[uint32]formatUpgrade{
+	1: {"move the allocator header after the version 2 header and reduce its page size", (*DB).upgradeFromV1},
+	2: {"allow inline byte arrays", func(db *DB) error { db.upgradeFromV2(); return nil }},
+	3: {"add the offset of the allocator header", func(db *DB) error { db.upgradeFromV3(); return nil }},
+}
+
+// upgradePlan returns the steps converting the database to the current
+// version, ending with the upgrade of the allocator header if it needs one
+func (db *DB) upgradePlan() []UpgradeStep {
+	var steps []UpgradeStep
+	for v := db.header.version; v < version; v++ {
+		steps = append(steps, UpgradeStep{From: v, To: v + 1, Description: formatUpgrades[v].description})
+	}
+
+	offset := db.allocatorOffset()
+	if db.header.version == 1 {
+		offset = v1HeaderSize
+	}
+	if from, to := balloc.HeaderUpgrade(unsafe.Pointer(&db.bufferRef[0]), offset); from != to {
+		steps = append(steps, UpgradeStep{
+			From:        version,
+			To:          version,
+			Description: fmt.Sprintf("upgrade the allocator header from version %d to %d and count the nodes", from, to),
+		})
+	}
+
+	return steps
+}
+
+// upgradeFormat runs the upgrade steps from the version of the database to
+// the current one
+func (db *DB) upgradeFormat() error {
+	for db.header.version < version {
+		u, ok := formatUpgrades[db.header.version]
+		if !ok {
+			return fmt.Errorf("No upgrade from EbakusDB file version %d", db.header.version)
+		}
+		db.log.Info("Upgrading database", "from", db.header.version, "to", db.header.version+1, "step", u.description)
+		if err := u.upgrade(db); err != nil {
+			return fmt.Errorf("Upgrade from EbakusDB file version %d failed: %s", db.header.version, err)
+		}
+	}
+	return nil
+}
+
+// Upgrade converts a database opened with Options.NoUpgrade to the current
+// format and returns the steps it took. A dry run only returns them. The
+// steps are empty when the database is up to date.
+func (db *DB) Upgrade(dryRun bool) ([]UpgradeStep, error) {
+	if db.allocator != nil {
+		return nil, nil
+	}
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	steps := db.upgradePlan()
+	if dryRun {
+		return steps, nil
+	}
+
+	db.noUpgrade = false
+	if err := db.init(); err != nil {
+		return nil, err
+	}
+	if err := db.initLeases(db.followers); err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+// features returns the names of the features the database file uses
+func (db *DB) features() []string {
+	var features []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{db.header.flags&flagRadix256 != 0, "radix256"},
+		{db.header.flags&flagOmitLeafKeys != 0, "omit-leaf-keys"},
+		{db.header.flags&flagCompression != 0, "compression"},
+		{db.header.flags&flagEncryption != 0, "encryption"},
+		{db.header.flags&flagEncryptedKeys != 0, "encrypted-keys"},
+		{db.header.compatFlags&compatLeases != 0, "leases"},
+	} {
+		if f.set {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// Version 1 files have a 16 byte header followed by the allocator header and
+// use the size of the 16 edge node as the allocator page size.
+const v1HeaderSize = 16
+
+// upgradeFromV1 converts a version 1 database in place. Version 1 nodes
+// already have the nodeKind16 layout, so only the allocator header is moved
+// after the larger header and its page size is reduced.
+func (db *DB) upgradeFromV1() error {
+	headerSize := uint64(unsafe.Sizeof(header{}))
+	bufPtr := unsafe.Pointer(&db.bufferRef[0])
+	bufSize := uint64(len(db.bufferRef))
+
+	allocator, err := balloc.NewBufferAllocator(bufPtr, bufSize, v1HeaderSize, pageSize)
+	if err != nil {
+		return err
+	}
+	if uint64(allocator.GetHeader().BufferStart) < headerSize+balloc.LegacyHeaderSize {
+		return fmt.Errorf("No room for the version 2 header")
+	}
+
+	copy(db.bufferRef[headerSize:headerSize+balloc.LegacyHeaderSize], db.bufferRef[v1HeaderSize:v1HeaderSize+balloc.LegacyHeaderSize])
+	for i := uint64(v1HeaderSize); i < headerSize; i++ {
+		db.bufferRef[i] = 0
+	}
+
+	allocator, err = balloc.NewBufferAllocator(bufPtr, bufSize, headerSize, pageSize)
+	if err != nil {
+		return err
+	}
+	if err := allocator.ChangePageSize(pageSize); err != nil {
+		return err
+	}
+
+	db.header.version = 2
+
+	return nil
+}
+
+// upgradeFromV2 converts a version 2 database. Version 3 adds inline byte
+// arrays, which version 2 files never contain, so only the version changes.
+func (db *DB) upgradeFromV2() {
+	db.header.version = 3
+}
+
+// upgradeFromV3 converts a version 3 database. Version 4 adds the offset of
+// the allocator header, which is zero in older files, and the allocator
+// upgrades its own header when it is opened.
+func (db *DB) upgradeFromV3() {
+	db.header.version = 4
+}
+
+// countNodes rebuilds the statistics of the nodes of allocators upgraded
+// from versions that did not keep them
+func (db *DB) countNodes(mm *balloc.BufferAllocator) {
+	db.walkNodes(func(nPtr Ptr, n *Node) {
+		mm.CountNode(uint64(nPtr), n.kind.size())
+	})
+}
+
+// walkNodes calls fn once for every node reachable from the root and from
+// the retired roots that readers following the writer still lease
+func (db *DB) walkNodes(fn func(nPtr Ptr, n *Node)) {
+	visited := make(map[Ptr]bool)
+	var walk func(nPtr Ptr)
+	walk = func(nPtr Ptr) {
+		if nPtr.isNull() || visited[nPtr] {
+			return
+		}
+		visited[nPtr] = true
+
+		n := nPtr.getNode(db.allocator)
+		fn(nPtr, n)
+
+		if n.isLeaf() {
+			walk(n.leaf().nodePtr)
+		}
+		for _, e := range n.edgeList() {
+			walk(e.node)
+		}
+	}
+
+	walk(db.header.root)
+	if t := db.leases(); t != nil && t.magic == leaseMagic {
+		for _, r := range t.roots[:t.retired] {
+			walk(Ptr(r))
+		}
+	}
+}